@@ -0,0 +1,170 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// accountAgeBuckets are the upper bounds, in seconds, of the buckets of the
+// account age histograms. They range from a day to two years.
+var accountAgeBuckets = []float64{
+	(24 * time.Hour).Seconds(),
+	(7 * 24 * time.Hour).Seconds(),
+	(30 * 24 * time.Hour).Seconds(),
+	(90 * 24 * time.Hour).Seconds(),
+	(180 * 24 * time.Hour).Seconds(),
+	(365 * 24 * time.Hour).Seconds(),
+	(730 * 24 * time.Hour).Seconds(),
+}
+
+// account is the metadata tracked for a user or service account.
+type account struct {
+	id string
+	// description is a service account's description or a user's name.
+	description string
+	// created is the zero time if the account's creation time is unknown.
+	created time.Time
+	locked  bool
+}
+
+// accountDescs are the descriptors of the metrics produced for one kind of
+// account, i.e. users or service accounts. All of them are separated by
+// whether accounts are locked.
+type accountDescs struct {
+	totalDesc *prometheus.Desc
+	ageDesc   *prometheus.Desc
+	staleDesc *prometheus.Desc
+	infoDesc  *prometheus.Desc
+}
+
+// newAccountDescs returns the descriptors for the kind of account with the
+// specified singular and plural names, as used in metric names, and
+// description, as used in help text. The info metric identifies each account
+// using the specified labels for its ID and description.
+func newAccountDescs(
+	singular string,
+	plural string,
+	help string,
+	idLabel string,
+	descriptionLabel string,
+) accountDescs {
+	return accountDescs{
+		totalDesc: prometheus.NewDesc(
+			"brigade_"+plural+"_total",
+			"The total number of "+help+", separated by whether they are locked",
+			[]string{"locked"},
+			nil,
+		),
+		ageDesc: prometheus.NewDesc(
+			"brigade_"+singular+"_age_seconds",
+			"Time since "+help+" were created",
+			[]string{"locked"},
+			nil,
+		),
+		staleDesc: prometheus.NewDesc(
+			"brigade_stale_"+plural,
+			"Number of "+help+" older than the configured stale account age",
+			[]string{"locked"},
+			nil,
+		),
+		infoDesc: prometheus.NewDesc(
+			"brigade_"+singular+"_info",
+			"Information about each of the "+help+", always 1",
+			[]string{idLabel, descriptionLabel, "locked", "created"},
+			nil,
+		),
+	}
+}
+
+func (a accountDescs) describe(ch chan<- *prometheus.Desc) {
+	ch <- a.totalDesc
+	ch <- a.ageDesc
+	ch <- a.staleDesc
+	ch <- a.infoDesc
+}
+
+// metrics returns the metrics for the provided accounts as of the specified
+// time. Accounts are stale once they're older than options.staleAccountAge.
+// Per-account info metrics are only returned if options.accountInfoEnabled is
+// set, since there is one series per account.
+func (a accountDescs) metrics(
+	accounts []account,
+	now time.Time,
+	options collectorOptions,
+) []prometheus.Metric {
+	totals := map[bool]int{}
+	stale := map[bool]int{}
+	ageCounts := map[bool]uint64{}
+	ageSums := map[bool]float64{}
+	ageBuckets := map[bool]map[float64]uint64{}
+	for _, locked := range []bool{true, false} {
+		ageBuckets[locked] = make(map[float64]uint64, len(accountAgeBuckets))
+		for _, bound := range accountAgeBuckets {
+			ageBuckets[locked][bound] = 0
+		}
+	}
+	metrics := []prometheus.Metric{}
+	for _, acct := range accounts {
+		totals[acct.locked]++
+		if options.accountInfoEnabled {
+			var created string
+			if !acct.created.IsZero() {
+				created = acct.created.UTC().Format(time.RFC3339)
+			}
+			metrics = append(
+				metrics,
+				prometheus.MustNewConstMetric(
+					a.infoDesc,
+					prometheus.GaugeValue,
+					1,
+					acct.id,
+					acct.description,
+					strconv.FormatBool(acct.locked),
+					created,
+				),
+			)
+		}
+		if acct.created.IsZero() {
+			continue
+		}
+		age := now.Sub(acct.created)
+		if age > options.staleAccountAge {
+			stale[acct.locked]++
+		}
+		ageCounts[acct.locked]++
+		ageSums[acct.locked] += age.Seconds()
+		for _, bound := range accountAgeBuckets {
+			if age.Seconds() <= bound {
+				ageBuckets[acct.locked][bound]++
+			}
+		}
+	}
+	for _, locked := range []bool{true, false} {
+		lockedLabel := strconv.FormatBool(locked)
+		metrics = append(
+			metrics,
+			prometheus.MustNewConstMetric(
+				a.totalDesc,
+				prometheus.GaugeValue,
+				float64(totals[locked]),
+				lockedLabel,
+			),
+			prometheus.MustNewConstHistogram(
+				a.ageDesc,
+				ageCounts[locked],
+				ageSums[locked],
+				ageBuckets[locked],
+				lockedLabel,
+			),
+			prometheus.MustNewConstMetric(
+				a.staleDesc,
+				prometheus.GaugeValue,
+				float64(stale[locked]),
+				lockedLabel,
+			),
+		)
+	}
+	return metrics
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/brigadecore/brigade/sdk/v2"
+	"github.com/brigadecore/brigade/sdk/v2/meta"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// unexpectedStatusRegex matches the error the Brigade SDK returns when the API
+// server responds with a status code it doesn't map to a more specific error.
+var unexpectedStatusRegex = regexp.MustCompile(
+	`received (\d{3}) from API server`,
+)
+
+// maxRetryBackoff caps the wait before any retry.
+const maxRetryBackoff = 30 * time.Second
+
+// retryPolicy determines how calls that fail with retryable errors are
+// retried.
+type retryPolicy struct {
+	// maxRetries is the maximum number of times a call is retried.
+	maxRetries int
+	// backoff is the longest wait before the first retry. It doubles for each
+	// subsequent retry, up to maxRetryBackoff.
+	backoff time.Duration
+}
+
+// wait returns how long to wait before the specified retry, where the first
+// retry is 1. The wait is chosen at random, up to the backoff for that retry,
+// so that calls that failed together aren't retried in lockstep.
+func (r retryPolicy) wait(retry int) time.Duration {
+	if r.backoff <= 0 {
+		return 0
+	}
+	// Doubling stops at the cap, so the backoff can't overflow however many
+	// retries there are
+	backoff := r.backoff
+	for i := 1; i < retry && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+// apiCaller makes Brigade API calls on behalf of collectors. Every call is
+// bounded by a timeout and the number of calls that may be in flight at once
+// is limited, so collectors running concurrently cannot overwhelm the API
+// server. Calls that fail with retryable errors are retried with backoff, and
+// a circuit breaker stops calls altogether while the API server is failing.
+// Every call is also counted by endpoint and outcome.
+type apiCaller struct {
+	// mu guards client, timeout, inFlight, and retries, all of which are
+	// replaced when the apiCaller is reconfigured.
+	mu      sync.RWMutex
+	client  sdk.APIClient
+	timeout time.Duration
+	// inFlight is a semaphore with capacity equal to the maximum number of
+	// calls that may be in flight at once.
+	inFlight chan struct{}
+	retries  retryPolicy
+	breaker  *circuitBreaker
+	// requests counts completed calls by endpoint and response code. Each
+	// retry is counted separately.
+	requests *prometheus.CounterVec
+
+	// lastSuccessMu guards lastSuccess.
+	lastSuccessMu sync.RWMutex
+	// lastSuccess is when the most recent successful call completed.
+	lastSuccess time.Time
+}
+
+// newAPICaller returns an apiCaller that makes calls using the provided API
+// client. Each call is bounded by the specified timeout and no more than
+// maxInFlight calls are permitted to be in flight at once. Failed calls are
+// retried and the circuit breaker operated according to the provided
+// policies.
+func newAPICaller(
+	client sdk.APIClient,
+	timeout time.Duration,
+	maxInFlight int,
+	retries retryPolicy,
+	breaker circuitBreakerPolicy,
+) *apiCaller {
+	a := &apiCaller{
+		breaker: newCircuitBreaker(breaker),
+		requests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "brigade_exporter_api_requests_total",
+				Help: "Brigade API requests made by the exporter",
+			},
+			[]string{"endpoint", "code"},
+		),
+	}
+	a.reconfigure(client, timeout, maxInFlight, retries, breaker)
+	return a
+}
+
+// reconfigure replaces the API client, timeout, maximum number of calls in
+// flight, and retry policy used by all subsequent calls, as well as the
+// circuit breaker's policy. Calls already waiting or in flight continue with
+// the previous settings, but the circuit breaker's state is retained.
+func (a *apiCaller) reconfigure(
+	client sdk.APIClient,
+	timeout time.Duration,
+	maxInFlight int,
+	retries retryPolicy,
+	breaker circuitBreakerPolicy,
+) {
+	if maxInFlight < 1 {
+		maxInFlight = 1
+	}
+	a.breaker.reconfigure(breaker)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.client = client
+	a.timeout = timeout
+	a.inFlight = make(chan struct{}, maxInFlight)
+	a.retries = retries
+}
+
+// call invokes the provided function, which should make a single API call to
+// the specified endpoint using the client and the context it is passed. That
+// context is derived from the provided one and is canceled once the timeout
+// elapses. If the call fails with a retryable error, it is retried, up to the
+// maximum number of retries, after a backoff. Calls are only made when the
+// number of calls in flight is below the maximum and the circuit breaker
+// permits it. Calls abandoned before they are made are not counted.
+func (a *apiCaller) call(
+	ctx context.Context,
+	endpoint string,
+	fn func(ctx context.Context, client sdk.APIClient) error,
+) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	a.mu.RLock()
+	client, timeout, inFlight, retries :=
+		a.client, a.timeout, a.inFlight, a.retries
+	a.mu.RUnlock()
+	var err error
+	for retry := 0; ; retry++ {
+		if retry > 0 {
+			select {
+			case <-time.After(retries.wait(retry)):
+			case <-ctx.Done():
+				return err
+			}
+		}
+		err = a.attempt(ctx, endpoint, client, timeout, inFlight, fn)
+		if err == nil || !retryable(err) || retry == retries.maxRetries ||
+			ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+// attempt makes a single attempt at a call on behalf of call.
+func (a *apiCaller) attempt(
+	ctx context.Context,
+	endpoint string,
+	client sdk.APIClient,
+	timeout time.Duration,
+	inFlight chan struct{},
+	fn func(ctx context.Context, client sdk.APIClient) error,
+) error {
+	select {
+	case inFlight <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() {
+		<-inFlight
+	}()
+	ticket, err := a.breaker.allow()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err = fn(ctx, client)
+	a.breaker.done(ticket, err)
+	a.requests.With(
+		prometheus.Labels{"endpoint": endpoint, "code": responseCode(err)},
+	).Inc()
+	if err == nil {
+		a.lastSuccessMu.Lock()
+		a.lastSuccess = time.Now()
+		a.lastSuccessMu.Unlock()
+	}
+	return err
+}
+
+// lastSuccessfulCall returns when the most recent successful call completed,
+// or the zero time if no call has succeeded yet.
+func (a *apiCaller) lastSuccessfulCall() time.Time {
+	a.lastSuccessMu.RLock()
+	defer a.lastSuccessMu.RUnlock()
+	return a.lastSuccess
+}
+
+// responseCode returns the HTTP status code implied by an error returned from
+// the Brigade SDK, or "200" if there was no error. Calls that never received a
+// response are reported as "timeout", "canceled", or, for any other failure,
+// "error".
+func responseCode(err error) string {
+	if err == nil {
+		return strconv.Itoa(http.StatusOK)
+	}
+	switch errors.Cause(err).(type) {
+	case *meta.ErrAuthentication:
+		return strconv.Itoa(http.StatusUnauthorized)
+	case *meta.ErrAuthorization:
+		return strconv.Itoa(http.StatusForbidden)
+	case *meta.ErrBadRequest:
+		return strconv.Itoa(http.StatusBadRequest)
+	case *meta.ErrNotFound:
+		return strconv.Itoa(http.StatusNotFound)
+	case *meta.ErrConflict:
+		return strconv.Itoa(http.StatusConflict)
+	case *meta.ErrNotSupported:
+		return strconv.Itoa(http.StatusNotImplemented)
+	case *meta.ErrInternalServer:
+		return strconv.Itoa(http.StatusInternalServerError)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timeout"
+	}
+	if errors.Is(err, context.Canceled) {
+		return "canceled"
+	}
+	matches := unexpectedStatusRegex.FindStringSubmatch(err.Error())
+	if matches != nil {
+		return matches[1]
+	}
+	return "error"
+}
+
+// retryable returns whether a call that failed with the provided error may
+// succeed if retried. That's the case if the API server responded with a 5xx,
+// the call timed out, or no response was received at all. Any other response,
+// such as a 401 or 403, would only be repeated.
+func retryable(err error) bool {
+	switch code := responseCode(err); {
+	case err == nil, code == "canceled", errors.Is(err, errCircuitOpen):
+		return false
+	case code == "timeout", code == "error":
+		return true
+	default:
+		return code[0] == '5'
+	}
+}
+
+// errorReason returns a short, low-cardinality description of why a
+// collection failed, suitable for use as a label value.
+func errorReason(err error) string {
+	if errors.Is(err, errCircuitOpen) {
+		return "circuit_open"
+	}
+	switch code := responseCode(err); {
+	case code == "timeout", code == "canceled":
+		return code
+	case code == strconv.Itoa(http.StatusUnauthorized):
+		return "unauthenticated"
+	case code == strconv.Itoa(http.StatusForbidden):
+		return "unauthorized"
+	case code[0] == '5':
+		return "server_error"
+	case code[0] == '4':
+		return "client_error"
+	default:
+		return "other"
+	}
+}
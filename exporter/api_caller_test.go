@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brigadecore/brigade/sdk/v2"
+	"github.com/brigadecore/brigade/sdk/v2/meta"
+	sdkTesting "github.com/brigadecore/brigade/sdk/v2/testing"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewAPICaller(t *testing.T) {
+	client := &sdkTesting.MockAPIClient{}
+	a := newAPICaller(
+		client,
+		time.Second,
+		0,
+		retryPolicy{maxRetries: 2},
+		circuitBreakerPolicy{failureThreshold: 5},
+	)
+	require.Same(t, client, a.client)
+	require.Equal(t, time.Second, a.timeout)
+	require.Equal(t, 1, cap(a.inFlight))
+	require.Equal(t, retryPolicy{maxRetries: 2}, a.retries)
+	require.Equal(
+		t,
+		circuitBreakerPolicy{failureThreshold: 5},
+		a.breaker.policy,
+	)
+}
+
+func TestAPICallerReconfigure(t *testing.T) {
+	a := newAPICaller(
+		&sdkTesting.MockAPIClient{},
+		time.Second,
+		1,
+		retryPolicy{},
+		circuitBreakerPolicy{},
+	)
+	client := &sdkTesting.MockAPIClient{}
+	a.reconfigure(
+		client,
+		time.Minute,
+		3,
+		retryPolicy{maxRetries: 1},
+		circuitBreakerPolicy{failureThreshold: 2},
+	)
+	err := a.call(
+		context.Background(),
+		"foo.get",
+		func(ctx context.Context, c sdk.APIClient) error {
+			require.Same(t, client, c)
+			deadline, ok := ctx.Deadline()
+			require.True(t, ok)
+			require.Greater(t, time.Until(deadline).Seconds(), 30.0)
+			return nil
+		},
+	)
+	require.NoError(t, err)
+	require.Equal(t, 3, cap(a.inFlight))
+	require.Equal(t, retryPolicy{maxRetries: 1}, a.retries)
+	require.Equal(
+		t,
+		circuitBreakerPolicy{failureThreshold: 2},
+		a.breaker.policy,
+	)
+}
+
+func TestAPICallerCall(t *testing.T) {
+	testCases := []struct {
+		name       string
+		ctx        func() context.Context
+		fn         func(context.Context, sdk.APIClient) error
+		assertions func(*apiCaller, error)
+	}{
+		{
+			name: "call times out",
+			ctx:  context.Background,
+			fn: func(ctx context.Context, _ sdk.APIClient) error {
+				_, ok := ctx.Deadline()
+				require.True(t, ok)
+				<-ctx.Done()
+				return ctx.Err()
+			},
+			assertions: func(a *apiCaller, err error) {
+				require.Equal(t, context.DeadlineExceeded, err)
+				require.Equal(
+					t,
+					1.0,
+					testutil.ToFloat64(
+						a.requests.With(
+							prometheus.Labels{"endpoint": "foo.get", "code": "timeout"},
+						),
+					),
+				)
+				require.True(t, a.lastSuccessfulCall().IsZero())
+			},
+		},
+		{
+			name: "parent context canceled",
+			ctx: func() context.Context {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				return ctx
+			},
+			fn: func(ctx context.Context, _ sdk.APIClient) error {
+				return ctx.Err()
+			},
+			assertions: func(a *apiCaller, err error) {
+				require.Equal(t, context.Canceled, err)
+				require.Zero(t, testutil.CollectAndCount(a.requests))
+			},
+		},
+		{
+			name: "success",
+			ctx:  context.Background,
+			fn: func(context.Context, sdk.APIClient) error {
+				return nil
+			},
+			assertions: func(a *apiCaller, err error) {
+				require.NoError(t, err)
+				require.Equal(
+					t,
+					1.0,
+					testutil.ToFloat64(
+						a.requests.With(
+							prometheus.Labels{"endpoint": "foo.get", "code": "200"},
+						),
+					),
+				)
+				require.WithinDuration(
+					t,
+					time.Now(),
+					a.lastSuccessfulCall(),
+					time.Second,
+				)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			a := newAPICaller(
+				&sdkTesting.MockAPIClient{},
+				100*time.Millisecond,
+				1,
+				retryPolicy{},
+				circuitBreakerPolicy{},
+			)
+			err := a.call(testCase.ctx(), "foo.get", testCase.fn)
+			testCase.assertions(a, err)
+		})
+	}
+}
+
+func TestAPICallerRetries(t *testing.T) {
+	testCases := []struct {
+		name       string
+		errs       []error
+		assertions func(attempts int, err error)
+	}{
+		{
+			name: "retryable error until retries exhausted",
+			errs: []error{
+				&meta.ErrInternalServer{},
+				context.DeadlineExceeded,
+				&meta.ErrInternalServer{},
+				nil,
+			},
+			assertions: func(attempts int, err error) {
+				require.Equal(t, 3, attempts)
+				require.IsType(t, &meta.ErrInternalServer{}, err)
+			},
+		},
+		{
+			name: "success after retry",
+			errs: []error{errors.New("error invoking API"), nil},
+			assertions: func(attempts int, err error) {
+				require.Equal(t, 2, attempts)
+				require.NoError(t, err)
+			},
+		},
+		{
+			name: "non-retryable error",
+			errs: []error{&meta.ErrAuthorization{}, nil},
+			assertions: func(attempts int, err error) {
+				require.Equal(t, 1, attempts)
+				require.IsType(t, &meta.ErrAuthorization{}, err)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			a := newAPICaller(
+				&sdkTesting.MockAPIClient{},
+				time.Second,
+				1,
+				retryPolicy{maxRetries: 2, backoff: time.Millisecond},
+				circuitBreakerPolicy{},
+			)
+			var attempts int
+			err := a.call(
+				context.Background(),
+				"foo.get",
+				func(context.Context, sdk.APIClient) error {
+					attempts++
+					return testCase.errs[attempts-1]
+				},
+			)
+			testCase.assertions(attempts, err)
+			// Every attempt is counted
+			require.Equal(t, float64(attempts), requestCount(t, a))
+		})
+	}
+}
+
+func TestRetryPolicyWait(t *testing.T) {
+	r := retryPolicy{backoff: time.Second}
+	for i := 0; i < 10; i++ {
+		require.LessOrEqual(t, r.wait(1), time.Second)
+		require.LessOrEqual(t, r.wait(3), 4*time.Second)
+		require.LessOrEqual(t, r.wait(100), maxRetryBackoff)
+	}
+	// Shifting a multi-second backoff by this many retries would overflow
+	r = retryPolicy{backoff: 5 * time.Second}
+	for _, retry := range []int{32, 33, 63, 64, 1000} {
+		for i := 0; i < 10; i++ {
+			wait := r.wait(retry)
+			require.GreaterOrEqual(t, wait, time.Duration(0))
+			require.LessOrEqual(t, wait, maxRetryBackoff)
+		}
+	}
+	// A backoff beyond the cap is capped, even for the first retry
+	require.LessOrEqual(
+		t,
+		retryPolicy{backoff: time.Hour}.wait(1),
+		maxRetryBackoff,
+	)
+	require.Zero(t, retryPolicy{}.wait(1))
+}
+
+func TestAPICallerMaxInFlight(t *testing.T) {
+	const maxInFlight = 2
+	a := newAPICaller(
+		&sdkTesting.MockAPIClient{},
+		time.Second,
+		maxInFlight,
+		retryPolicy{},
+		circuitBreakerPolicy{},
+	)
+	var inFlight, maxObserved int
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := a.call(
+				context.Background(),
+				"foo.get",
+				func(context.Context, sdk.APIClient) error {
+					mu.Lock()
+					inFlight++
+					if inFlight > maxObserved {
+						maxObserved = inFlight
+					}
+					mu.Unlock()
+					<-time.After(10 * time.Millisecond)
+					mu.Lock()
+					inFlight--
+					mu.Unlock()
+					return nil
+				},
+			)
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, maxInFlight, maxObserved)
+}
+
+func TestResponseCode(t *testing.T) {
+	testCases := []struct {
+		name         string
+		err          error
+		expectedCode string
+	}{
+		{
+			name:         "no error",
+			expectedCode: "200",
+		},
+		{
+			name:         "authentication error",
+			err:          &meta.ErrAuthentication{},
+			expectedCode: "401",
+		},
+		{
+			name:         "wrapped not found error",
+			err:          errors.Wrap(&meta.ErrNotFound{}, "error getting event"),
+			expectedCode: "404",
+		},
+		{
+			name:         "unexpected status code",
+			err:          errors.New("received 502 from API server"),
+			expectedCode: "502",
+		},
+		{
+			name: "timeout",
+			err: errors.Wrap(
+				context.DeadlineExceeded,
+				"error invoking API",
+			),
+			expectedCode: "timeout",
+		},
+		{
+			name:         "other error",
+			err:          errors.New("connection refused"),
+			expectedCode: "error",
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			require.Equal(t, testCase.expectedCode, responseCode(testCase.err))
+		})
+	}
+}
+
+func TestErrorReason(t *testing.T) {
+	testCases := []struct {
+		name           string
+		err            error
+		expectedReason string
+	}{
+		{
+			name:           "authentication error",
+			err:            &meta.ErrAuthentication{},
+			expectedReason: "unauthenticated",
+		},
+		{
+			name:           "authorization error",
+			err:            &meta.ErrAuthorization{},
+			expectedReason: "unauthorized",
+		},
+		{
+			name:           "bad request",
+			err:            &meta.ErrBadRequest{},
+			expectedReason: "client_error",
+		},
+		{
+			name:           "server error",
+			err:            errors.New("received 503 from API server"),
+			expectedReason: "server_error",
+		},
+		{
+			name:           "timeout",
+			err:            context.DeadlineExceeded,
+			expectedReason: "timeout",
+		},
+		{
+			name:           "circuit breaker open",
+			err:            errors.Wrap(errCircuitOpen, "error listing users"),
+			expectedReason: "circuit_open",
+		},
+		{
+			name:           "other error",
+			err:            errors.New("something went wrong"),
+			expectedReason: "other",
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			require.Equal(t, testCase.expectedReason, errorReason(testCase.err))
+		})
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	testCases := []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{
+			name: "no error",
+		},
+		{
+			name:      "server error",
+			err:       &meta.ErrInternalServer{},
+			retryable: true,
+		},
+		{
+			name:      "unexpected server error",
+			err:       errors.New("received 502 from API server"),
+			retryable: true,
+		},
+		{
+			name:      "timeout",
+			err:       context.DeadlineExceeded,
+			retryable: true,
+		},
+		{
+			name:      "no response",
+			err:       errors.New("error invoking API"),
+			retryable: true,
+		},
+		{
+			name: "authentication error",
+			err:  &meta.ErrAuthentication{},
+		},
+		{
+			name: "authorization error",
+			err:  &meta.ErrAuthorization{},
+		},
+		{
+			name: "canceled",
+			err:  context.Canceled,
+		},
+		{
+			name: "circuit breaker open",
+			err:  errCircuitOpen,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			require.Equal(t, testCase.retryable, retryable(testCase.err))
+		})
+	}
+}
+
+// requestCount returns the total number of calls the provided apiCaller has
+// counted.
+func requestCount(t *testing.T, a *apiCaller) float64 {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(a.requests)
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	var count float64
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			count += metric.GetCounter().GetValue()
+		}
+	}
+	return count
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+
+	"github.com/brigadecore/brigade/sdk/v2"
+	"github.com/brigadecore/brigade/sdk/v2/system"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// apiServerCollector produces brigade_api_server_info, which carries the
+// version of the Brigade API server as a label.
+type apiServerCollector struct {
+	api               *apiCaller
+	apiServerInfoDesc *prometheus.Desc
+}
+
+func newAPIServerCollector(api *apiCaller) collector {
+	return &apiServerCollector{
+		api: api,
+		apiServerInfoDesc: prometheus.NewDesc(
+			"brigade_api_server_info",
+			"Information about the Brigade API server, always 1",
+			[]string{"version"},
+			nil,
+		),
+	}
+}
+
+func (a *apiServerCollector) describe(ch chan<- *prometheus.Desc) {
+	ch <- a.apiServerInfoDesc
+}
+
+func (a *apiServerCollector) collect(
+	ctx context.Context,
+) ([]prometheus.Metric, error) {
+	version, err := apiServerVersion(ctx, a.api)
+	if err != nil {
+		return nil, err
+	}
+	return []prometheus.Metric{
+		prometheus.MustNewConstMetric(
+			a.apiServerInfoDesc,
+			prometheus.GaugeValue,
+			1,
+			version,
+		),
+	}, nil
+}
+
+// apiServerVersion returns the version the Brigade API server reports when
+// pinged.
+func apiServerVersion(ctx context.Context, api *apiCaller) (string, error) {
+	var ping system.PingResponse
+	err := api.call(
+		ctx,
+		"system.ping",
+		func(ctx context.Context, client sdk.APIClient) (err error) {
+			ping, err = client.System().Ping(ctx)
+			return err
+		},
+	)
+	return ping.Version, err
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	libHTTP "github.com/willie-yao/brigade-metrics/exporter/internal/http"
+)
+
+// newCertificateExpiryGauge returns
+// brigade_exporter_tls_certificate_expiry_timestamp_seconds, a gauge that
+// reports when the certificate currently being served by the provided server
+// expires.
+func newCertificateExpiryGauge(server libHTTP.Server) prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "brigade_exporter_tls_certificate_expiry_timestamp_seconds",
+			Help: "Unix time at which the exporter's current TLS certificate " +
+				"expires",
+		},
+		func() float64 {
+			expiry := server.CertificateExpiry()
+			if expiry.IsZero() {
+				return 0
+			}
+			return float64(expiry.Unix())
+		},
+	)
+}
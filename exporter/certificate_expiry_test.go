@@ -0,0 +1,17 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewCertificateExpiryGauge(t *testing.T) {
+	expiry := time.Now().Add(30 * 24 * time.Hour).Truncate(time.Second)
+	gauge := newCertificateExpiryGauge(&mockServer{expiry: expiry})
+	require.Equal(t, float64(expiry.Unix()), testutil.ToFloat64(gauge))
+	gauge = newCertificateExpiryGauge(&mockServer{})
+	require.Zero(t, testutil.ToFloat64(gauge))
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// errCircuitOpen is returned for calls that aren't made because the circuit
+// breaker is open.
+var errCircuitOpen = errors.New(
+	"circuit breaker is open; not calling the Brigade API",
+)
+
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half_open"
+)
+
+// circuitBreakerPolicy determines when a circuitBreaker opens and for how
+// long.
+type circuitBreakerPolicy struct {
+	// failureThreshold is the number of consecutive calls that may fail with
+	// retryable errors before the circuit breaker opens. Zero disables the
+	// circuit breaker.
+	failureThreshold int
+	// cooldown is how long the circuit breaker stays open before permitting a
+	// trial call.
+	cooldown time.Duration
+}
+
+// circuitBreakerTicket identifies the state a circuitBreaker was in when it
+// permitted a call, so that the call's outcome only counts if the
+// circuitBreaker is still in that state once the call completes.
+type circuitBreakerTicket uint64
+
+// circuitBreaker stops calls to the Brigade API server after it has failed
+// repeatedly, so that a failing server isn't hammered by every collector in
+// every cycle. Once the cooldown elapses, the circuit breaker is half-open and
+// permits a single trial call. If that succeeds, the circuit breaker closes.
+// Otherwise, it opens again. Only retryable errors are considered failures,
+// since any other error means the server responded. Outcomes of calls that
+// were permitted before the most recent change of state are ignored, so only
+// the trial call can resolve the half-open state.
+type circuitBreaker struct {
+	// mu guards all fields other than states.
+	mu     sync.Mutex
+	policy circuitBreakerPolicy
+	state  string
+	// failures is the number of consecutive failed calls.
+	failures int
+	// openedAt is when the circuit breaker most recently opened.
+	openedAt time.Time
+	// trialInFlight indicates whether the trial call permitted while the
+	// circuit breaker is half-open has yet to complete.
+	trialInFlight bool
+	// generation is incremented whenever the state changes. It's issued to
+	// permitted calls as their ticket.
+	generation uint64
+	// states is 1 for the current state and 0 for all others.
+	states *prometheus.GaugeVec
+}
+
+// newCircuitBreaker returns a closed circuitBreaker that follows the provided
+// policy.
+func newCircuitBreaker(policy circuitBreakerPolicy) *circuitBreaker {
+	c := &circuitBreaker{
+		policy: policy,
+		states: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "brigade_exporter_api_circuit_breaker_state",
+				Help: "State of the Brigade API circuit breaker; 1 for the " +
+					"current state and 0 otherwise",
+			},
+			[]string{"state"},
+		),
+	}
+	c.setState(circuitClosed)
+	return c
+}
+
+// reconfigure replaces the circuitBreaker's policy without changing its
+// state.
+func (c *circuitBreaker) reconfigure(policy circuitBreakerPolicy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.policy = policy
+	if policy.failureThreshold <= 0 {
+		c.failures = 0
+		c.trialInFlight = false
+		c.setState(circuitClosed)
+	}
+}
+
+// allow returns errCircuitOpen if a call may not be made now. Otherwise, the
+// caller must report the outcome of the call using done, along with the
+// returned ticket.
+func (c *circuitBreaker) allow() (circuitBreakerTicket, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.state {
+	case circuitOpen:
+		if time.Since(c.openedAt) < c.policy.cooldown {
+			return 0, errCircuitOpen
+		}
+		c.setState(circuitHalfOpen)
+	case circuitHalfOpen:
+		if c.trialInFlight {
+			return 0, errCircuitOpen
+		}
+	default:
+		return circuitBreakerTicket(c.generation), nil
+	}
+	c.trialInFlight = true
+	return circuitBreakerTicket(c.generation), nil
+}
+
+// done records the outcome of the call that allow issued the provided ticket
+// to, unless the state has changed since.
+func (c *circuitBreaker) done(ticket circuitBreakerTicket, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.policy.failureThreshold <= 0 ||
+		ticket != circuitBreakerTicket(c.generation) {
+		return
+	}
+	// The only call permitted while half-open is the trial
+	halfOpen := c.state == circuitHalfOpen
+	c.trialInFlight = false
+	switch {
+	case responseCode(err) == "canceled":
+		// The call was abandoned, so it says nothing about the server
+	case retryable(err):
+		c.failures++
+		if halfOpen || c.failures >= c.policy.failureThreshold {
+			c.openedAt = time.Now()
+			c.setState(circuitOpen)
+		}
+	default:
+		c.failures = 0
+		c.setState(circuitClosed)
+	}
+}
+
+// setState changes the circuitBreaker's state. The caller must hold c.mu.
+func (c *circuitBreaker) setState(state string) {
+	if state != c.state {
+		c.generation++
+	}
+	c.state = state
+	for _, s := range []string{circuitClosed, circuitOpen, circuitHalfOpen} {
+		var val float64
+		if s == state {
+			val = 1
+		}
+		c.states.With(prometheus.Labels{"state": s}).Set(val)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/brigadecore/brigade/sdk/v2/meta"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	testCases := []struct {
+		name       string
+		policy     circuitBreakerPolicy
+		setup      func(*circuitBreaker)
+		assertions func(*circuitBreaker)
+	}{
+		{
+			name:   "disabled",
+			policy: circuitBreakerPolicy{},
+			setup: func(c *circuitBreaker) {
+				for i := 0; i < 10; i++ {
+					ticket, err := c.allow()
+					require.NoError(t, err)
+					c.done(ticket, &meta.ErrInternalServer{})
+				}
+			},
+			assertions: func(c *circuitBreaker) {
+				require.Equal(t, circuitClosed, c.state)
+				_, err := c.allow()
+				require.NoError(t, err)
+			},
+		},
+		{
+			name:   "opens after failure threshold",
+			policy: circuitBreakerPolicy{failureThreshold: 2, cooldown: time.Minute},
+			setup: func(c *circuitBreaker) {
+				for i := 0; i < 2; i++ {
+					ticket, err := c.allow()
+					require.NoError(t, err)
+					c.done(ticket, context.DeadlineExceeded)
+				}
+			},
+			assertions: func(c *circuitBreaker) {
+				require.Equal(t, circuitOpen, c.state)
+				_, err := c.allow()
+				require.Equal(t, errCircuitOpen, err)
+				require.Equal(
+					t,
+					1.0,
+					testutil.ToFloat64(
+						c.states.With(prometheus.Labels{"state": circuitOpen}),
+					),
+				)
+				require.Equal(
+					t,
+					0.0,
+					testutil.ToFloat64(
+						c.states.With(prometheus.Labels{"state": circuitClosed}),
+					),
+				)
+			},
+		},
+		{
+			name:   "non-retryable errors reset failures",
+			policy: circuitBreakerPolicy{failureThreshold: 2, cooldown: time.Minute},
+			setup: func(c *circuitBreaker) {
+				for _, callErr := range []error{
+					context.DeadlineExceeded,
+					&meta.ErrAuthorization{},
+					context.DeadlineExceeded,
+					context.Canceled,
+				} {
+					ticket, err := c.allow()
+					require.NoError(t, err)
+					c.done(ticket, callErr)
+				}
+			},
+			assertions: func(c *circuitBreaker) {
+				require.Equal(t, circuitClosed, c.state)
+				require.Equal(t, 1, c.failures)
+			},
+		},
+		{
+			name:   "half-open permits a single trial call",
+			policy: circuitBreakerPolicy{failureThreshold: 1, cooldown: time.Minute},
+			setup: func(c *circuitBreaker) {
+				c.setState(circuitOpen)
+				c.openedAt = time.Now().Add(-time.Minute)
+			},
+			assertions: func(c *circuitBreaker) {
+				trial, err := c.allow()
+				require.NoError(t, err)
+				require.Equal(t, circuitHalfOpen, c.state)
+				_, err = c.allow()
+				require.Equal(t, errCircuitOpen, err)
+				c.done(trial, nil)
+				require.Equal(t, circuitClosed, c.state)
+				_, err = c.allow()
+				require.NoError(t, err)
+			},
+		},
+		{
+			name:   "failed trial call reopens",
+			policy: circuitBreakerPolicy{failureThreshold: 3, cooldown: time.Minute},
+			setup: func(c *circuitBreaker) {
+				c.setState(circuitOpen)
+				c.openedAt = time.Now().Add(-time.Minute)
+			},
+			assertions: func(c *circuitBreaker) {
+				ticket, err := c.allow()
+				require.NoError(t, err)
+				c.done(ticket, &meta.ErrInternalServer{})
+				require.Equal(t, circuitOpen, c.state)
+				_, err = c.allow()
+				require.Equal(t, errCircuitOpen, err)
+			},
+		},
+		{
+			name:   "only the trial call resolves half-open",
+			policy: circuitBreakerPolicy{failureThreshold: 1, cooldown: time.Minute},
+			setup: func(c *circuitBreaker) {
+				// This call is permitted while closed but completes after the
+				// circuit breaker opens and becomes half-open
+				stale, err := c.allow()
+				require.NoError(t, err)
+				c.setState(circuitOpen)
+				c.openedAt = time.Now().Add(-time.Minute)
+				trial, err := c.allow()
+				require.NoError(t, err)
+				c.done(stale, &meta.ErrInternalServer{})
+				require.Equal(t, circuitHalfOpen, c.state)
+				// The trial is still in flight, so no other call is permitted
+				_, err = c.allow()
+				require.Equal(t, errCircuitOpen, err)
+				c.done(trial, nil)
+			},
+			assertions: func(c *circuitBreaker) {
+				require.Equal(t, circuitClosed, c.state)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			c := newCircuitBreaker(testCase.policy)
+			testCase.setup(c)
+			testCase.assertions(c)
+		})
+	}
+}
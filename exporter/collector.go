@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/brigadecore/brigade/sdk/v2"
+	"github.com/brigadecore/brigade/sdk/v2/core"
+	"github.com/brigadecore/brigade/sdk/v2/meta"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// collector is an independently enabled part of a collection cycle that
+// queries the Brigade API to produce a group of related metrics.
+type collector interface {
+	// describe sends the descriptors of all metrics the collector can produce
+	// to the provided channel.
+	describe(ch chan<- *prometheus.Desc)
+	// collect queries the Brigade API and returns the metrics produced. All
+	// API calls must be made using contexts derived from the provided one.
+	collect(ctx context.Context) ([]prometheus.Metric, error)
+}
+
+// collectorOptions holds settings for collectors that need any.
+type collectorOptions struct {
+	// eventsStatePath is the path to the file in which the events collector
+	// persists its state. If empty, state isn't persisted.
+	eventsStatePath string
+	// staleAccountAge is the age beyond which the users and service accounts
+	// collectors consider accounts stale.
+	staleAccountAge time.Duration
+	// accountInfoEnabled indicates whether the users and service accounts
+	// collectors produce an info metric for every account.
+	accountInfoEnabled bool
+}
+
+// configurableCollector is a collector that has settings of its own.
+type configurableCollector interface {
+	collector
+	// configure applies the provided options. It's never called concurrently
+	// with collect.
+	configure(options collectorOptions)
+}
+
+// unfinishedWorkerPhases and finishedWorkerPhases are every worker phase,
+// divided according to whether it's terminal. The SDK's own lists of phases
+// omit STARTING and SCHEDULING_FAILED, so they're listed here in full.
+var (
+	unfinishedWorkerPhases = []core.WorkerPhase{
+		core.WorkerPhasePending,
+		core.WorkerPhaseStarting,
+		core.WorkerPhaseRunning,
+		core.WorkerPhaseUnknown,
+	}
+	finishedWorkerPhases = []core.WorkerPhase{
+		core.WorkerPhaseAborted,
+		core.WorkerPhaseCanceled,
+		core.WorkerPhaseFailed,
+		core.WorkerPhaseSchedulingFailed,
+		core.WorkerPhaseSucceeded,
+		core.WorkerPhaseTimedOut,
+	}
+)
+
+// allWorkerPhases returns every worker phase.
+func allWorkerPhases() []core.WorkerPhase {
+	phases := make(
+		[]core.WorkerPhase,
+		0,
+		len(unfinishedWorkerPhases)+len(finishedWorkerPhases),
+	)
+	phases = append(phases, unfinishedWorkerPhases...)
+	return append(phases, finishedWorkerPhases...)
+}
+
+// collectorFactories maps the name of every available collector to a function
+// that constructs it.
+var collectorFactories = map[string]func(*apiCaller) collector{
+	"projects":         newProjectsCollector,
+	"users":            newUsersCollector,
+	"service_accounts": newServiceAccountsCollector,
+	"workers":          newWorkersCollector,
+	"pending_workers":  newPendingWorkersCollector,
+	"project_workers":  newProjectWorkersCollector,
+	"jobs":             newJobsCollector,
+	"durations":        newDurationsCollector,
+	"api_server":       newAPIServerCollector,
+	"events":           newEventsCollector,
+	"substrate":        newSubstrateCollector,
+	"secrets":          newSecretsCollector,
+	"role_assignments": newRoleAssignmentsCollector,
+}
+
+// collectorNames returns the names of all available collectors in
+// alphabetical order.
+func collectorNames() []string {
+	names := make([]string, 0, len(collectorFactories))
+	for name := range collectorFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// forEachEvent invokes the provided function for every event matching the
+// specified selector, following the continue token of each page of results
+// until the list is exhausted.
+func forEachEvent(
+	ctx context.Context,
+	api *apiCaller,
+	selector core.EventsSelector,
+	fn func(core.Event),
+) error {
+	return forEachEventWhile(
+		ctx,
+		api,
+		selector,
+		func(event core.Event) bool {
+			fn(event)
+			return true
+		},
+	)
+}
+
+// forEachEventWhile is like forEachEvent, but stops as soon as the provided
+// function returns false. Events are listed newest first, so this allows
+// iteration to stop once events are older than some point in time.
+func forEachEventWhile(
+	ctx context.Context,
+	api *apiCaller,
+	selector core.EventsSelector,
+	fn func(core.Event) bool,
+) error {
+	opts := &meta.ListOptions{}
+	for {
+		var events core.EventList
+		if err := api.call(
+			ctx,
+			"events.list",
+			func(ctx context.Context, client sdk.APIClient) (err error) {
+				events, err = client.Core().Events().List(ctx, &selector, opts)
+				return err
+			},
+		); err != nil {
+			return err
+		}
+		for _, event := range events.Items {
+			if !fn(event) {
+				return nil
+			}
+		}
+		if events.Continue == "" {
+			return nil
+		}
+		opts = &meta.ListOptions{Continue: events.Continue}
+	}
+}
+
+// listProjectIDs returns the IDs of all projects, following the continue
+// token of each page until the list is exhausted.
+func listProjectIDs(ctx context.Context, api *apiCaller) ([]string, error) {
+	projectIDs := []string{}
+	opts := &meta.ListOptions{}
+	for {
+		var projects core.ProjectList
+		if err := api.call(
+			ctx,
+			"projects.list",
+			func(ctx context.Context, client sdk.APIClient) (err error) {
+				projects, err = client.Core().Projects().List(
+					ctx,
+					&core.ProjectsSelector{},
+					opts,
+				)
+				return err
+			},
+		); err != nil {
+			return nil, err
+		}
+		for _, project := range projects.Items {
+			projectIDs = append(projectIDs, project.ID)
+		}
+		if projects.Continue == "" {
+			return projectIDs, nil
+		}
+		opts = &meta.ListOptions{Continue: projects.Continue}
+	}
+}
@@ -1,56 +1,1222 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/BurntSushi/toml"
 	"github.com/brigadecore/brigade/sdk/v2/restmachinery"
+	"github.com/pkg/errors"
 	"github.com/willie-yao/brigade-metrics/exporter/internal/http"
 	"github.com/willie-yao/brigade-metrics/exporter/internal/os"
+	"gopkg.in/yaml.v3"
 )
 
-// apiClientConfig populates the Brigade SDK's APIClientOptions from
-// environment variables.
-func apiClientConfig() (string, string, restmachinery.APIClientOptions, error) {
-	opts := restmachinery.APIClientOptions{}
-	address, err := os.GetRequiredEnvVar("API_ADDRESS")
+// config is the exporter's configuration. It is optionally loaded from a YAML
+// or TOML file, after which any values set using environment variables take
+// precedence over values from the file.
+type config struct {
+	API        apiConfig        `yaml:"api" toml:"api"`
+	Scrape     scrapeConfig     `yaml:"scrape" toml:"scrape"`
+	Collectors collectorsConfig `yaml:"collectors" toml:"collectors"`
+	Server     serverConfig     `yaml:"server" toml:"server"`
+	Auth       authConfig       `yaml:"auth" toml:"auth"`
+	Health     healthConfig     `yaml:"health" toml:"health"`
+	Push       pushConfig       `yaml:"push" toml:"push"`
+}
+
+// backgroundRefresh returns whether collection cycles should run on a fixed
+// interval. Pushing implies background refresh, since otherwise every push
+// would run a collection cycle of its own, adding to the load on the Brigade
+// API and to the scrape metrics, rather than pushing the latest snapshot.
+func (c config) backgroundRefresh() bool {
+	return c.Scrape.BackgroundRefresh || c.Push.enabled()
+}
+
+// apiConfig is configuration for communicating with the Brigade API.
+type apiConfig struct {
+	// Address is the address of the Brigade API server. It can also be set
+	// using the API_ADDRESS environment variable.
+	Address string `yaml:"address" toml:"address"`
+	// Token is the token used to authenticate to the Brigade API server. It can
+	// also be set using the API_TOKEN environment variable.
+	Token string `yaml:"token" toml:"token"`
+	// TokenPath, if set, is the path to a file containing the token, which
+	// takes precedence over Token. Since the file is read whenever the
+	// configuration is loaded, this allows the token to be rotated without a
+	// restart. It can also be set using the API_TOKEN_PATH environment
+	// variable.
+	TokenPath string `yaml:"tokenPath" toml:"tokenPath"`
+	// IgnoreCertWarnings indicates whether to accept an invalid certificate
+	// from the Brigade API server. It can also be set using the
+	// API_IGNORE_CERT_WARNINGS environment variable.
+	IgnoreCertWarnings bool `yaml:"ignoreCertWarnings" toml:"ignoreCertWarnings"`
+	// RequestTimeout bounds each individual Brigade API call. It can also be
+	// set using the API_REQUEST_TIMEOUT environment variable.
+	RequestTimeout duration `yaml:"requestTimeout" toml:"requestTimeout"`
+	// MaxInFlight is the maximum number of Brigade API calls that may be in
+	// flight at once. It can also be set using the API_MAX_IN_FLIGHT_REQUESTS
+	// environment variable.
+	MaxInFlight int `yaml:"maxInFlight" toml:"maxInFlight"`
+	// MaxRetries is the maximum number of times a Brigade API call that failed
+	// with a 5xx, timed out, or received no response is retried. It can also be
+	// set using the API_MAX_RETRIES environment variable.
+	MaxRetries int `yaml:"maxRetries" toml:"maxRetries"`
+	// RetryBackoff is the longest wait before the first retry of a call. It
+	// doubles for each subsequent retry, and the actual wait is chosen at
+	// random up to it. It can also be set using the API_RETRY_BACKOFF
+	// environment variable.
+	RetryBackoff duration `yaml:"retryBackoff" toml:"retryBackoff"`
+	// CircuitBreaker is configuration for the circuit breaker that stops
+	// Brigade API calls while the API server is failing.
+	CircuitBreaker circuitBreakerConfig `yaml:"circuitBreaker" toml:"circuitBreaker"` // nolint: lll
+}
+
+// circuitBreakerConfig is configuration for the Brigade API circuit breaker.
+type circuitBreakerConfig struct {
+	// FailureThreshold is the number of consecutive calls that may fail with
+	// retryable errors before the circuit breaker opens. Zero disables the
+	// circuit breaker. It can also be set using the
+	// API_CIRCUIT_BREAKER_FAILURE_THRESHOLD environment variable.
+	FailureThreshold int `yaml:"failureThreshold" toml:"failureThreshold"`
+	// Cooldown is how long the circuit breaker stays open before permitting a
+	// trial call. It can also be set using the API_CIRCUIT_BREAKER_COOLDOWN
+	// environment variable.
+	Cooldown duration `yaml:"cooldown" toml:"cooldown"`
+}
+
+// clientOptions returns the Brigade SDK's APIClientOptions.
+func (a apiConfig) clientOptions() restmachinery.APIClientOptions {
+	return restmachinery.APIClientOptions{
+		AllowInsecureConnections: a.IgnoreCertWarnings,
+	}
+}
+
+// retryPolicy returns the policy for retrying failed Brigade API calls.
+func (a apiConfig) retryPolicy() retryPolicy {
+	return retryPolicy{
+		maxRetries: a.MaxRetries,
+		backoff:    time.Duration(a.RetryBackoff),
+	}
+}
+
+// circuitBreakerPolicy returns the policy for the Brigade API circuit breaker.
+func (a apiConfig) circuitBreakerPolicy() circuitBreakerPolicy {
+	return circuitBreakerPolicy{
+		failureThreshold: a.CircuitBreaker.FailureThreshold,
+		cooldown:         time.Duration(a.CircuitBreaker.Cooldown),
+	}
+}
+
+// scrapeConfig is configuration for collection cycles.
+type scrapeConfig struct {
+	// Interval is the interval on which collection cycles run if background
+	// refresh is enabled. It can also be set using the PROM_SCRAPE_INTERVAL
+	// environment variable.
+	Interval duration `yaml:"interval" toml:"interval"`
+	// BackgroundRefresh indicates whether collection cycles should run on a
+	// fixed interval instead of on every scrape. It's implied if pushing to any
+	// other system is enabled. It can also be set using the
+	// BACKGROUND_REFRESH_ENABLED environment variable.
+	BackgroundRefresh bool `yaml:"backgroundRefresh" toml:"backgroundRefresh"`
+	// MaxFailedCycles is the number of consecutive cycles a collector may fail
+	// before the metrics it last produced are dropped instead of being served
+	// again. Zero means they're kept regardless. It can also be set using the
+	// SCRAPE_MAX_FAILED_CYCLES environment variable.
+	MaxFailedCycles int `yaml:"maxFailedCycles" toml:"maxFailedCycles"`
+	// MaxAge is how long after a collector last succeeded the metrics it
+	// produced are dropped if it has failed since. Zero means they're kept
+	// regardless. It can also be set using the SCRAPE_MAX_AGE environment
+	// variable.
+	MaxAge duration `yaml:"maxAge" toml:"maxAge"`
+}
+
+// stalenessPolicy returns the policy determining when a failing collector's
+// metrics are dropped.
+func (s scrapeConfig) stalenessPolicy() stalenessPolicy {
+	return stalenessPolicy{
+		maxFailedCycles: s.MaxFailedCycles,
+		maxAge:          time.Duration(s.MaxAge),
+	}
+}
+
+// collectorsConfig determines which collectors the exporter uses.
+type collectorsConfig struct {
+	// Enabled, if non-empty, lists the ONLY collectors that are enabled.
+	// Otherwise, all collectors are enabled. It can also be set using the
+	// comma-delimited ENABLED_COLLECTORS environment variable.
+	Enabled []string `yaml:"enabled" toml:"enabled"`
+	// Disabled lists collectors to exclude. It can also be set using the
+	// comma-delimited DISABLED_COLLECTORS environment variable.
+	Disabled []string                `yaml:"disabled" toml:"disabled"`
+	Events   eventsCollectorConfig   `yaml:"events" toml:"events"`
+	Accounts accountsCollectorConfig `yaml:"accounts" toml:"accounts"`
+}
+
+// eventsCollectorConfig is configuration for the events collector.
+type eventsCollectorConfig struct {
+	// StatePath, if set, is the path to a file in which the events collector
+	// persists its state, so that event counts survive restarts. It can also
+	// be set using the EVENTS_STATE_PATH environment variable.
+	StatePath string `yaml:"statePath" toml:"statePath"`
+}
+
+// accountsCollectorConfig is configuration for the users and service accounts
+// collectors.
+type accountsCollectorConfig struct {
+	// StaleAfter is the age beyond which users and service accounts are
+	// considered stale. It can also be set using the ACCOUNTS_STALE_AFTER
+	// environment variable.
+	StaleAfter duration `yaml:"staleAfter" toml:"staleAfter"`
+	// InfoEnabled indicates whether an info metric is exported for every user
+	// and service account. Since this produces a series per account, it's
+	// disabled by default. It can also be set using the ACCOUNTS_INFO_ENABLED
+	// environment variable.
+	InfoEnabled bool `yaml:"infoEnabled" toml:"infoEnabled"`
+}
+
+// options returns the collectors' options.
+func (c collectorsConfig) options() collectorOptions {
+	return collectorOptions{
+		eventsStatePath:    c.Events.StatePath,
+		staleAccountAge:    time.Duration(c.Accounts.StaleAfter),
+		accountInfoEnabled: c.Accounts.InfoEnabled,
+	}
+}
+
+// names returns the names of the enabled collectors in alphabetical order.
+func (c collectorsConfig) names() []string {
+	enabled := c.Enabled
+	if len(enabled) == 0 {
+		enabled = collectorNames()
+	}
+	names := []string{}
+	for _, name := range enabled {
+		var isDisabled bool
+		for _, disabledName := range c.Disabled {
+			if name == disabledName {
+				isDisabled = true
+				break
+			}
+		}
+		if !isDisabled {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// serverConfig is configuration for the HTTP/S server.
+type serverConfig struct {
+	// Port is the port the server listens on. It can also be set using the
+	// RECEIVER_PORT environment variable.
+	Port int       `yaml:"port" toml:"port"`
+	TLS  tlsConfig `yaml:"tls" toml:"tls"`
+}
+
+// tlsConfig is configuration for the HTTP/S server's TLS.
+type tlsConfig struct {
+	// Enabled indicates whether the server uses TLS. It can also be set using
+	// the TLS_ENABLED environment variable.
+	Enabled bool `yaml:"enabled" toml:"enabled"`
+	// CertPath is the path to the server's certificate. It can also be set
+	// using the TLS_CERT_PATH environment variable.
+	CertPath string `yaml:"certPath" toml:"certPath"`
+	// KeyPath is the path to the server's private key. It can also be set
+	// using the TLS_KEY_PATH environment variable.
+	KeyPath string `yaml:"keyPath" toml:"keyPath"`
+	// ClientAuth is whether the server requests and verifies client
+	// certificates. It must be "none", "optional", or "required". It can also be
+	// set using the TLS_CLIENT_AUTH environment variable.
+	ClientAuth string `yaml:"clientAuth" toml:"clientAuth"`
+	// ClientCAPath is the path to the CA bundle that client certificates are
+	// verified against. It is required unless ClientAuth is "none". It can also
+	// be set using the TLS_CLIENT_CA_PATH environment variable.
+	ClientCAPath string `yaml:"clientCAPath" toml:"clientCAPath"`
+	// CheckInterval is how often the certificate, key, and client CA bundle are
+	// checked for changes and reloaded. It can also be set using the
+	// TLS_CHECK_INTERVAL environment variable.
+	CheckInterval duration `yaml:"checkInterval" toml:"checkInterval"`
+}
+
+// httpConfig returns configuration for the HTTP/S server.
+func (s serverConfig) httpConfig() http.ServerConfig {
+	return http.ServerConfig{
+		Port:             s.Port,
+		TLSEnabled:       s.TLS.Enabled,
+		TLSCertPath:      s.TLS.CertPath,
+		TLSKeyPath:       s.TLS.KeyPath,
+		TLSClientAuth:    http.ClientAuthMode(s.TLS.ClientAuth),
+		TLSClientCAPath:  s.TLS.ClientCAPath,
+		TLSCheckInterval: time.Duration(s.TLS.CheckInterval),
+	}
+}
+
+// authConfig is configuration for authenticating requests to the exporter's
+// endpoints, other than /healthz. If neither path is set, requests are not
+// authenticated. Both files are read whenever the configuration is loaded, so
+// credentials can be rotated without a restart.
+type authConfig struct {
+	// BearerTokensPath is the path to a file containing the bearer tokens that
+	// are accepted, one per line. It can also be set using the
+	// AUTH_BEARER_TOKENS_PATH environment variable.
+	BearerTokensPath string `yaml:"bearerTokensPath" toml:"bearerTokensPath"`
+	// WebConfigPath is the path to a file in the format of Prometheus' web
+	// configuration file, of which only basic_auth_users is supported and the
+	// rest is ignored. It can also be set using the AUTH_WEB_CONFIG_PATH
+	// environment variable.
+	WebConfigPath string `yaml:"webConfigPath" toml:"webConfigPath"`
+}
+
+// httpConfig returns configuration for the server's authenticator.
+func (a authConfig) httpConfig() http.AuthConfig {
+	return http.AuthConfig{
+		BearerTokensPath: a.BearerTokensPath,
+		WebConfigPath:    a.WebConfigPath,
+	}
+}
+
+// healthConfig is configuration for the exporter's health checks.
+type healthConfig struct {
+	// APIUnreachableTimeout is how long the Brigade API may go without a
+	// successful call before the exporter is no longer considered ready. It can
+	// also be set using the HEALTH_API_UNREACHABLE_TIMEOUT environment variable.
+	APIUnreachableTimeout duration `yaml:"apiUnreachableTimeout" toml:"apiUnreachableTimeout"` // nolint: lll
+}
+
+// pushConfig is configuration for pushing metrics to other systems, in
+// addition to serving them for scraping.
+type pushConfig struct {
+	OTLP        otlpConfig        `yaml:"otlp" toml:"otlp"`
+	RemoteWrite remoteWriteConfig `yaml:"remoteWrite" toml:"remoteWrite"`
+	DogStatsD   dogStatsDConfig   `yaml:"dogstatsd" toml:"dogstatsd"`
+}
+
+// enabled returns whether pushing to any other system is enabled.
+func (p pushConfig) enabled() bool {
+	return p.OTLP.Enabled || p.RemoteWrite.Enabled || p.DogStatsD.Enabled
+}
+
+// otlpConfig is configuration for pushing metrics to an OpenTelemetry
+// collector, or any other OTLP receiver.
+type otlpConfig struct {
+	// Enabled indicates whether metrics are pushed using OTLP. It can also be
+	// set using the OTLP_ENABLED environment variable.
+	Enabled bool `yaml:"enabled" toml:"enabled"`
+	// Protocol is the OTLP transport; either "grpc" or "http". It can also be
+	// set using the OTLP_PROTOCOL environment variable.
+	Protocol string `yaml:"protocol" toml:"protocol"`
+	// Endpoint is the address of the OTLP receiver. For gRPC, this is a host and
+	// port, e.g. "otel-collector:4317". For HTTP, this is the full URL metrics
+	// are posted to, e.g. "https://otel-collector:4318/v1/metrics". It can also
+	// be set using the OTLP_ENDPOINT environment variable.
+	Endpoint string `yaml:"endpoint" toml:"endpoint"`
+	// Insecure indicates whether to connect to a gRPC receiver without TLS. For
+	// HTTP, the endpoint's scheme determines whether TLS is used. It can also be
+	// set using the OTLP_INSECURE environment variable.
+	Insecure bool `yaml:"insecure" toml:"insecure"`
+	// Headers are sent with every push, e.g. to authenticate to the receiver.
+	Headers map[string]string `yaml:"headers" toml:"headers"`
+	// Interval is the interval on which metrics are pushed. It can also be set
+	// using the OTLP_PUSH_INTERVAL environment variable.
+	Interval duration `yaml:"interval" toml:"interval"`
+	// Timeout bounds each push. It can also be set using the OTLP_TIMEOUT
+	// environment variable.
+	Timeout duration `yaml:"timeout" toml:"timeout"`
+}
+
+// options returns the options for the otlpPusher.
+func (o otlpConfig) options() otlpOptions {
+	return otlpOptions{
+		enabled:  o.Enabled,
+		protocol: o.Protocol,
+		endpoint: o.Endpoint,
+		insecure: o.Insecure,
+		headers:  o.Headers,
+		interval: time.Duration(o.Interval),
+		timeout:  time.Duration(o.Timeout),
+	}
+}
+
+// remoteWriteConfig is configuration for pushing metrics to Mimir, Thanos, or
+// any other endpoint that accepts the Prometheus remote write protocol.
+type remoteWriteConfig struct {
+	// Enabled indicates whether metrics are pushed using remote write. It can
+	// also be set using the REMOTE_WRITE_ENABLED environment variable.
+	Enabled bool `yaml:"enabled" toml:"enabled"`
+	// URL is where metrics are posted to, e.g.
+	// "http://mimir:8080/api/v1/push". It can also be set using the
+	// REMOTE_WRITE_URL environment variable.
+	URL string `yaml:"url" toml:"url"`
+	// Headers are sent with every push, e.g. to authenticate to the endpoint or
+	// to identify a tenant.
+	Headers map[string]string `yaml:"headers" toml:"headers"`
+	// ExternalLabels are added to every series pushed, e.g. to identify the
+	// cluster the metrics came from.
+	ExternalLabels map[string]string `yaml:"externalLabels" toml:"externalLabels"` // nolint: lll
+	// Interval is the interval on which metrics are collected for pushing. It
+	// can also be set using the REMOTE_WRITE_PUSH_INTERVAL environment variable.
+	Interval duration `yaml:"interval" toml:"interval"`
+	// Timeout bounds each attempt at pushing a batch of samples. It can also be
+	// set using the REMOTE_WRITE_TIMEOUT environment variable.
+	Timeout duration `yaml:"timeout" toml:"timeout"`
+	// MaxSamplesPerSend is the maximum number of samples pushed in a single
+	// request. It can also be set using the REMOTE_WRITE_MAX_SAMPLES_PER_SEND
+	// environment variable.
+	MaxSamplesPerSend int `yaml:"maxSamplesPerSend" toml:"maxSamplesPerSend"`
+	// QueueCapacity is the maximum number of samples awaiting pushing. When the
+	// queue is full, the oldest samples are dropped. It can also be set using
+	// the REMOTE_WRITE_QUEUE_CAPACITY environment variable.
+	QueueCapacity int `yaml:"queueCapacity" toml:"queueCapacity"`
+	// MaxRetries is the maximum number of times a push that failed with a 5xx
+	// or 429, or received no response, is retried. It can also be set using the
+	// REMOTE_WRITE_MAX_RETRIES environment variable.
+	MaxRetries int `yaml:"maxRetries" toml:"maxRetries"`
+	// RetryBackoff is the longest wait before the first retry of a push. It
+	// doubles for each subsequent retry. It can also be set using the
+	// REMOTE_WRITE_RETRY_BACKOFF environment variable.
+	RetryBackoff duration `yaml:"retryBackoff" toml:"retryBackoff"`
+}
+
+// options returns the options for the remoteWritePusher.
+func (r remoteWriteConfig) options() remoteWriteOptions {
+	return remoteWriteOptions{
+		enabled:           r.Enabled,
+		url:               r.URL,
+		headers:           r.Headers,
+		externalLabels:    r.ExternalLabels,
+		interval:          time.Duration(r.Interval),
+		timeout:           time.Duration(r.Timeout),
+		maxSamplesPerSend: r.MaxSamplesPerSend,
+		queueCapacity:     r.QueueCapacity,
+		retries: retryPolicy{
+			maxRetries: r.MaxRetries,
+			backoff:    time.Duration(r.RetryBackoff),
+		},
+	}
+}
+
+// dogStatsDConfig is configuration for pushing metrics to a Datadog agent
+// using the DogStatsD protocol.
+type dogStatsDConfig struct {
+	// Enabled indicates whether metrics are pushed using DogStatsD. It can also
+	// be set using the DOGSTATSD_ENABLED environment variable.
+	Enabled bool `yaml:"enabled" toml:"enabled"`
+	// Protocol is the DogStatsD transport; either "udp" or "uds" for a Unix
+	// domain socket. It can also be set using the DOGSTATSD_PROTOCOL
+	// environment variable.
+	Protocol string `yaml:"protocol" toml:"protocol"`
+	// Address is the address of the agent. For UDP, this is a host and port,
+	// e.g. "datadog-agent:8125". For UDS, this is the path of the socket, e.g.
+	// "/var/run/datadog/dsd.socket". It can also be set using the
+	// DOGSTATSD_ADDRESS environment variable.
+	Address string `yaml:"address" toml:"address"`
+	// Namespace is prepended to the name of every metric, e.g. "brigade.". It
+	// can also be set using the DOGSTATSD_NAMESPACE environment variable.
+	Namespace string `yaml:"namespace" toml:"namespace"`
+	// Tags are added to every metric pushed, e.g. to identify the cluster the
+	// metrics came from.
+	Tags map[string]string `yaml:"tags" toml:"tags"`
+	// Interval is the interval on which metrics are pushed. It can also be set
+	// using the DOGSTATSD_PUSH_INTERVAL environment variable.
+	Interval duration `yaml:"interval" toml:"interval"`
+}
+
+// options returns the options for the dogStatsDPusher.
+func (d dogStatsDConfig) options() dogStatsDOptions {
+	return dogStatsDOptions{
+		enabled:   d.Enabled,
+		protocol:  d.Protocol,
+		address:   d.Address,
+		namespace: d.Namespace,
+		tags:      d.Tags,
+		interval:  time.Duration(d.Interval),
+	}
+}
+
+// duration is a time.Duration that is represented in configuration files as a
+// string, e.g. "30s".
+type duration time.Duration
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (d *duration) UnmarshalText(text []byte) error {
+	val, err := time.ParseDuration(string(text))
+	if err != nil {
+		return errors.Errorf("%q is not a valid duration", string(text))
+	}
+	*d = duration(val)
+	return nil
+}
+
+// defaultConfig returns the configuration used for any values set by neither
+// a configuration file nor environment variables.
+func defaultConfig() config {
+	return config{
+		API: apiConfig{
+			RequestTimeout: duration(10 * time.Second),
+			MaxInFlight:    4,
+			MaxRetries:     2,
+			RetryBackoff:   duration(250 * time.Millisecond),
+			CircuitBreaker: circuitBreakerConfig{
+				FailureThreshold: 5,
+				Cooldown:         duration(30 * time.Second),
+			},
+		},
+		Scrape: scrapeConfig{
+			Interval:        duration(5 * time.Second),
+			MaxFailedCycles: 3,
+			MaxAge:          duration(10 * time.Minute),
+		},
+		Collectors: collectorsConfig{
+			Accounts: accountsCollectorConfig{
+				StaleAfter: duration(90 * 24 * time.Hour),
+			},
+		},
+		Server: serverConfig{
+			Port: 8080,
+			TLS: tlsConfig{
+				ClientAuth:    string(http.ClientAuthNone),
+				CheckInterval: duration(time.Minute),
+			},
+		},
+		Health: healthConfig{
+			APIUnreachableTimeout: duration(2 * time.Minute),
+		},
+		Push: pushConfig{
+			OTLP: otlpConfig{
+				Protocol: otlpProtocolGRPC,
+				Interval: duration(30 * time.Second),
+				Timeout:  duration(10 * time.Second),
+			},
+			RemoteWrite: remoteWriteConfig{
+				Interval:          duration(30 * time.Second),
+				Timeout:           duration(10 * time.Second),
+				MaxSamplesPerSend: 500,
+				QueueCapacity:     10000,
+				MaxRetries:        3,
+				RetryBackoff:      duration(500 * time.Millisecond),
+			},
+			DogStatsD: dogStatsDConfig{
+				Protocol: dogStatsDProtocolUDP,
+				// The agent aggregates over 10 second intervals
+				Interval: duration(10 * time.Second),
+			},
+		},
+	}
+}
+
+// loadConfig returns the exporter's configuration. If a path is specified, the
+// YAML or TOML file at that path, as determined by its extension, is loaded
+// over the defaults. Values set using environment variables then take
+// precedence. Finally, the API token is read from a file if a path to one is
+// configured. An error is returned if the file contains any unrecognized keys
+// or undecodable values, or if the resulting configuration is invalid.
+func loadConfig(path string) (config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return cfg, errors.Wrapf(err, "error loading configuration file %s", path)
+		}
+	}
+	if err := cfg.loadEnvVars(); err != nil {
+		return cfg, err
+	}
+	if cfg.API.TokenPath != "" {
+		token, err := ioutil.ReadFile(cfg.API.TokenPath)
+		if err != nil {
+			return cfg, errors.Wrap(err, "error reading API token file")
+		}
+		cfg.API.Token = strings.TrimSpace(string(token))
+	}
+	return cfg, cfg.validate()
+}
+
+// loadFile loads the YAML or TOML file at the specified path over the
+// existing configuration.
+func (c *config) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		return address, "", opts, err
+		return err
+	}
+	var tagKey string
+	var entries map[string]configValue
+	var unmarshal func([]byte, interface{}) error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		tagKey = "yaml"
+		entries, err = yamlEntries(data)
+		unmarshal = yaml.Unmarshal
+	case ".toml":
+		tagKey = "toml"
+		entries, err = tomlEntries(data)
+		unmarshal = toml.Unmarshal
+	default:
+		return errors.Errorf(
+			"unsupported extension %q; expected .yaml, .yml, or .toml",
+			filepath.Ext(path),
+		)
 	}
-	token, err := os.GetRequiredEnvVar("API_TOKEN")
 	if err != nil {
-		return address, token, opts, err
+		return err
+	}
+	if err = checkKeys(entries, reflect.TypeOf(*c), tagKey, ""); err != nil {
+		return err
 	}
-	opts.AllowInsecureConnections, err =
-		os.GetBoolFromEnvVar("API_IGNORE_CERT_WARNINGS", false)
-	return address, token, opts, err
+	return unmarshal(data, c)
 }
 
-func scrapeDuration() (time.Duration, error) {
-	return os.GetDurationFromEnvVar("PROM_SCRAPE_INTERVAL", 5*time.Second)
+// configValue is a value from a configuration file that hasn't yet been
+// decoded, so that any errors decoding it can name its key.
+type configValue interface {
+	// entries returns the entries of the value, keyed by their keys, if it's a
+	// table or mapping.
+	entries() (map[string]configValue, bool)
+	// decode decodes the value into the value pointed to by v.
+	decode(v interface{}) error
 }
 
-// serverConfig populates configuration for the HTTP/S server from environment
-// variables.
-func serverConfig() (http.ServerConfig, error) {
-	config := http.ServerConfig{}
-	var err error
-	config.Port, err = os.GetIntFromEnvVar("RECEIVER_PORT", 8080)
+// yamlValue is a configValue from a YAML file.
+type yamlValue struct {
+	node *yaml.Node
+}
+
+// yamlEntries returns the entries of the YAML document in the provided data.
+func yamlEntries(data []byte) (map[string]configValue, error) {
+	doc := yaml.Node{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	// An empty document has no content
+	if len(doc.Content) == 0 {
+		return map[string]configValue{}, nil
+	}
+	entries, ok := yamlValue{node: doc.Content[0]}.entries()
+	if !ok {
+		return nil, errors.New("configuration must be a mapping")
+	}
+	return entries, nil
+}
+
+func (y yamlValue) entries() (map[string]configValue, bool) {
+	node := y.node
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Kind != yaml.MappingNode {
+		return nil, false
+	}
+	entries := map[string]configValue{}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		entries[node.Content[i].Value] = yamlValue{node: node.Content[i+1]}
+	}
+	return entries, true
+}
+
+func (y yamlValue) decode(v interface{}) error {
+	return y.node.Decode(v)
+}
+
+// tomlValue is a configValue from a TOML file.
+type tomlValue struct {
+	metadata  toml.MetaData
+	primitive toml.Primitive
+}
+
+// tomlEntries returns the entries of the TOML document in the provided data.
+func tomlEntries(data []byte) (map[string]configValue, error) {
+	primitives := map[string]toml.Primitive{}
+	metadata, err := toml.Decode(string(data), &primitives)
 	if err != nil {
-		return config, err
+		return nil, err
+	}
+	entries := map[string]configValue{}
+	for key, primitive := range primitives {
+		entries[key] = tomlValue{metadata: metadata, primitive: primitive}
+	}
+	return entries, nil
+}
+
+func (t tomlValue) entries() (map[string]configValue, bool) {
+	primitives := map[string]toml.Primitive{}
+	if err := t.metadata.PrimitiveDecode(t.primitive, &primitives); err != nil {
+		return nil, false
+	}
+	entries := map[string]configValue{}
+	for key, primitive := range primitives {
+		entries[key] = tomlValue{metadata: t.metadata, primitive: primitive}
+	}
+	return entries, true
+}
+
+func (t tomlValue) decode(v interface{}) error {
+	return t.metadata.PrimitiveDecode(t.primitive, v)
+}
+
+// checkKeys returns an error naming the first key in the provided entries, in
+// alphabetical order, that does not correspond to a field of the specified
+// struct type, as identified by the specified struct tag, or whose value
+// can't be decoded into that field. Entries nested under keys for struct
+// fields are checked recursively. The prefix is prepended to the keys named in
+// errors.
+func checkKeys(
+	entries map[string]configValue,
+	structType reflect.Type,
+	tagKey string,
+	prefix string,
+) error {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		fields[field.Tag.Get(tagKey)] = field.Type
+	}
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fieldType, ok := fields[key]
+		if !ok {
+			return errors.Errorf("unrecognized key %q", prefix+key)
+		}
+		if fieldType.Kind() != reflect.Struct {
+			// Each value is decoded by itself first, since errors decoding the
+			// whole file don't say which key they're for
+			if err := entries[key].decode(
+				reflect.New(fieldType).Interface(),
+			); err != nil {
+				return errors.Wrapf(err, "invalid value for key %q", prefix+key)
+			}
+			continue
+		}
+		nested, ok := entries[key].entries()
+		if !ok {
+			return errors.Errorf("key %q must be a table or mapping", prefix+key)
+		}
+		if err := checkKeys(nested, fieldType, tagKey, prefix+key+"."); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadEnvVars overrides the existing configuration with values from any
+// environment variables that are set.
+func (c *config) loadEnvVars() error {
+	var err error
+	c.API.Address = os.GetEnvVar("API_ADDRESS", c.API.Address)
+	c.API.Token = os.GetEnvVar("API_TOKEN", c.API.Token)
+	c.API.TokenPath = os.GetEnvVar("API_TOKEN_PATH", c.API.TokenPath)
+	if c.API.IgnoreCertWarnings, err = os.GetBoolFromEnvVar(
+		"API_IGNORE_CERT_WARNINGS",
+		c.API.IgnoreCertWarnings,
+	); err != nil {
+		return err
+	}
+	if err = durationFromEnvVar(
+		"API_REQUEST_TIMEOUT",
+		&c.API.RequestTimeout,
+	); err != nil {
+		return err
+	}
+	if c.API.MaxInFlight, err = os.GetIntFromEnvVar(
+		"API_MAX_IN_FLIGHT_REQUESTS",
+		c.API.MaxInFlight,
+	); err != nil {
+		return err
+	}
+	if c.API.MaxRetries, err = os.GetIntFromEnvVar(
+		"API_MAX_RETRIES",
+		c.API.MaxRetries,
+	); err != nil {
+		return err
+	}
+	if err = durationFromEnvVar(
+		"API_RETRY_BACKOFF",
+		&c.API.RetryBackoff,
+	); err != nil {
+		return err
+	}
+	if c.API.CircuitBreaker.FailureThreshold, err = os.GetIntFromEnvVar(
+		"API_CIRCUIT_BREAKER_FAILURE_THRESHOLD",
+		c.API.CircuitBreaker.FailureThreshold,
+	); err != nil {
+		return err
 	}
-	config.TLSEnabled, err = os.GetBoolFromEnvVar("TLS_ENABLED", false)
+	if err = durationFromEnvVar(
+		"API_CIRCUIT_BREAKER_COOLDOWN",
+		&c.API.CircuitBreaker.Cooldown,
+	); err != nil {
+		return err
+	}
+	if err = durationFromEnvVar(
+		"PROM_SCRAPE_INTERVAL",
+		&c.Scrape.Interval,
+	); err != nil {
+		return err
+	}
+	if c.Scrape.BackgroundRefresh, err = os.GetBoolFromEnvVar(
+		"BACKGROUND_REFRESH_ENABLED",
+		c.Scrape.BackgroundRefresh,
+	); err != nil {
+		return err
+	}
+	if c.Scrape.MaxFailedCycles, err = os.GetIntFromEnvVar(
+		"SCRAPE_MAX_FAILED_CYCLES",
+		c.Scrape.MaxFailedCycles,
+	); err != nil {
+		return err
+	}
+	if err = durationFromEnvVar("SCRAPE_MAX_AGE", &c.Scrape.MaxAge); err != nil {
+		return err
+	}
+	c.Collectors.Enabled =
+		collectorNamesFromEnvVar("ENABLED_COLLECTORS", c.Collectors.Enabled)
+	c.Collectors.Disabled =
+		collectorNamesFromEnvVar("DISABLED_COLLECTORS", c.Collectors.Disabled)
+	c.Collectors.Events.StatePath =
+		os.GetEnvVar("EVENTS_STATE_PATH", c.Collectors.Events.StatePath)
+	if err = durationFromEnvVar(
+		"ACCOUNTS_STALE_AFTER",
+		&c.Collectors.Accounts.StaleAfter,
+	); err != nil {
+		return err
+	}
+	if c.Collectors.Accounts.InfoEnabled, err = os.GetBoolFromEnvVar(
+		"ACCOUNTS_INFO_ENABLED",
+		c.Collectors.Accounts.InfoEnabled,
+	); err != nil {
+		return err
+	}
+	if c.Server.Port, err =
+		os.GetIntFromEnvVar("RECEIVER_PORT", c.Server.Port); err != nil {
+		return err
+	}
+	if c.Server.TLS.Enabled, err =
+		os.GetBoolFromEnvVar("TLS_ENABLED", c.Server.TLS.Enabled); err != nil {
+		return err
+	}
+	c.Server.TLS.CertPath = os.GetEnvVar("TLS_CERT_PATH", c.Server.TLS.CertPath)
+	c.Server.TLS.KeyPath = os.GetEnvVar("TLS_KEY_PATH", c.Server.TLS.KeyPath)
+	c.Server.TLS.ClientAuth =
+		os.GetEnvVar("TLS_CLIENT_AUTH", c.Server.TLS.ClientAuth)
+	c.Server.TLS.ClientCAPath =
+		os.GetEnvVar("TLS_CLIENT_CA_PATH", c.Server.TLS.ClientCAPath)
+	if err = durationFromEnvVar(
+		"TLS_CHECK_INTERVAL",
+		&c.Server.TLS.CheckInterval,
+	); err != nil {
+		return err
+	}
+	c.Auth.BearerTokensPath =
+		os.GetEnvVar("AUTH_BEARER_TOKENS_PATH", c.Auth.BearerTokensPath)
+	c.Auth.WebConfigPath =
+		os.GetEnvVar("AUTH_WEB_CONFIG_PATH", c.Auth.WebConfigPath)
+	if err = durationFromEnvVar(
+		"HEALTH_API_UNREACHABLE_TIMEOUT",
+		&c.Health.APIUnreachableTimeout,
+	); err != nil {
+		return err
+	}
+	if c.Push.OTLP.Enabled, err =
+		os.GetBoolFromEnvVar("OTLP_ENABLED", c.Push.OTLP.Enabled); err != nil {
+		return err
+	}
+	c.Push.OTLP.Protocol = os.GetEnvVar("OTLP_PROTOCOL", c.Push.OTLP.Protocol)
+	c.Push.OTLP.Endpoint = os.GetEnvVar("OTLP_ENDPOINT", c.Push.OTLP.Endpoint)
+	if c.Push.OTLP.Insecure, err =
+		os.GetBoolFromEnvVar("OTLP_INSECURE", c.Push.OTLP.Insecure); err != nil {
+		return err
+	}
+	if err = durationFromEnvVar(
+		"OTLP_PUSH_INTERVAL",
+		&c.Push.OTLP.Interval,
+	); err != nil {
+		return err
+	}
+	if err = durationFromEnvVar(
+		"OTLP_TIMEOUT",
+		&c.Push.OTLP.Timeout,
+	); err != nil {
+		return err
+	}
+	if c.Push.RemoteWrite.Enabled, err = os.GetBoolFromEnvVar(
+		"REMOTE_WRITE_ENABLED",
+		c.Push.RemoteWrite.Enabled,
+	); err != nil {
+		return err
+	}
+	c.Push.RemoteWrite.URL =
+		os.GetEnvVar("REMOTE_WRITE_URL", c.Push.RemoteWrite.URL)
+	if err = durationFromEnvVar(
+		"REMOTE_WRITE_PUSH_INTERVAL",
+		&c.Push.RemoteWrite.Interval,
+	); err != nil {
+		return err
+	}
+	if err = durationFromEnvVar(
+		"REMOTE_WRITE_TIMEOUT",
+		&c.Push.RemoteWrite.Timeout,
+	); err != nil {
+		return err
+	}
+	if c.Push.RemoteWrite.MaxSamplesPerSend, err = os.GetIntFromEnvVar(
+		"REMOTE_WRITE_MAX_SAMPLES_PER_SEND",
+		c.Push.RemoteWrite.MaxSamplesPerSend,
+	); err != nil {
+		return err
+	}
+	if c.Push.RemoteWrite.QueueCapacity, err = os.GetIntFromEnvVar(
+		"REMOTE_WRITE_QUEUE_CAPACITY",
+		c.Push.RemoteWrite.QueueCapacity,
+	); err != nil {
+		return err
+	}
+	if c.Push.RemoteWrite.MaxRetries, err = os.GetIntFromEnvVar(
+		"REMOTE_WRITE_MAX_RETRIES",
+		c.Push.RemoteWrite.MaxRetries,
+	); err != nil {
+		return err
+	}
+	if err = durationFromEnvVar(
+		"REMOTE_WRITE_RETRY_BACKOFF",
+		&c.Push.RemoteWrite.RetryBackoff,
+	); err != nil {
+		return err
+	}
+	if c.Push.DogStatsD.Enabled, err = os.GetBoolFromEnvVar(
+		"DOGSTATSD_ENABLED",
+		c.Push.DogStatsD.Enabled,
+	); err != nil {
+		return err
+	}
+	c.Push.DogStatsD.Protocol =
+		os.GetEnvVar("DOGSTATSD_PROTOCOL", c.Push.DogStatsD.Protocol)
+	c.Push.DogStatsD.Address =
+		os.GetEnvVar("DOGSTATSD_ADDRESS", c.Push.DogStatsD.Address)
+	c.Push.DogStatsD.Namespace =
+		os.GetEnvVar("DOGSTATSD_NAMESPACE", c.Push.DogStatsD.Namespace)
+	return durationFromEnvVar(
+		"DOGSTATSD_PUSH_INTERVAL",
+		&c.Push.DogStatsD.Interval,
+	)
+}
+
+// durationFromEnvVar overrides the provided duration with the value of the
+// specified environment variable, if it is set.
+func durationFromEnvVar(name string, d *duration) error {
+	val, err := os.GetDurationFromEnvVar(name, time.Duration(*d))
 	if err != nil {
-		return config, err
+		return err
 	}
-	if config.TLSEnabled {
-		config.TLSCertPath, err = os.GetRequiredEnvVar("TLS_CERT_PATH")
-		if err != nil {
-			return config, err
+	*d = duration(val)
+	return nil
+}
+
+// collectorNamesFromEnvVar returns the comma-delimited collector names from
+// the specified environment variable, or the provided default if it is not
+// set.
+func collectorNamesFromEnvVar(name string, defaultValue []string) []string {
+	names := os.GetStringSliceFromEnvVar(name, defaultValue)
+	for i := range names {
+		names[i] = strings.TrimSpace(names[i])
+	}
+	return names
+}
+
+// validate returns an error naming the first configuration key found to have
+// an invalid value, along with the environment variable that can also be used
+// to set it.
+func (c config) validate() error {
+	if c.API.Address == "" {
+		return requiredKeyError("api.address", "API_ADDRESS")
+	}
+	if c.API.Token == "" {
+		return requiredKeyError("api.token", "API_TOKEN")
+	}
+	if c.API.RequestTimeout <= 0 {
+		return invalidKeyError(
+			"api.requestTimeout",
+			"API_REQUEST_TIMEOUT",
+			"must be positive",
+		)
+	}
+	if c.API.MaxInFlight < 1 {
+		return invalidKeyError(
+			"api.maxInFlight",
+			"API_MAX_IN_FLIGHT_REQUESTS",
+			"must be at least 1",
+		)
+	}
+	if c.API.MaxRetries < 0 {
+		return invalidKeyError(
+			"api.maxRetries",
+			"API_MAX_RETRIES",
+			"must not be negative",
+		)
+	}
+	if c.API.RetryBackoff < 0 {
+		return invalidKeyError(
+			"api.retryBackoff",
+			"API_RETRY_BACKOFF",
+			"must not be negative",
+		)
+	}
+	if c.API.CircuitBreaker.FailureThreshold < 0 {
+		return invalidKeyError(
+			"api.circuitBreaker.failureThreshold",
+			"API_CIRCUIT_BREAKER_FAILURE_THRESHOLD",
+			"must not be negative",
+		)
+	}
+	if c.API.CircuitBreaker.Cooldown <= 0 {
+		return invalidKeyError(
+			"api.circuitBreaker.cooldown",
+			"API_CIRCUIT_BREAKER_COOLDOWN",
+			"must be positive",
+		)
+	}
+	if c.Scrape.Interval <= 0 {
+		return invalidKeyError(
+			"scrape.interval",
+			"PROM_SCRAPE_INTERVAL",
+			"must be positive",
+		)
+	}
+	if c.Scrape.MaxFailedCycles < 0 {
+		return invalidKeyError(
+			"scrape.maxFailedCycles",
+			"SCRAPE_MAX_FAILED_CYCLES",
+			"must not be negative",
+		)
+	}
+	if c.Scrape.MaxAge < 0 {
+		return invalidKeyError(
+			"scrape.maxAge",
+			"SCRAPE_MAX_AGE",
+			"must not be negative",
+		)
+	}
+	if err := validateCollectorNames(
+		"collectors.enabled",
+		"ENABLED_COLLECTORS",
+		c.Collectors.Enabled,
+	); err != nil {
+		return err
+	}
+	if err := validateCollectorNames(
+		"collectors.disabled",
+		"DISABLED_COLLECTORS",
+		c.Collectors.Disabled,
+	); err != nil {
+		return err
+	}
+	if c.Collectors.Accounts.StaleAfter <= 0 {
+		return invalidKeyError(
+			"collectors.accounts.staleAfter",
+			"ACCOUNTS_STALE_AFTER",
+			"must be positive",
+		)
+	}
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		return invalidKeyError(
+			"server.port",
+			"RECEIVER_PORT",
+			"must be between 1 and 65535",
+		)
+	}
+	if c.Server.TLS.Enabled {
+		if c.Server.TLS.CertPath == "" {
+			return requiredKeyError("server.tls.certPath", "TLS_CERT_PATH")
 		}
-		config.TLSKeyPath, err = os.GetRequiredEnvVar("TLS_KEY_PATH")
-		if err != nil {
-			return config, err
+		if c.Server.TLS.KeyPath == "" {
+			return requiredKeyError("server.tls.keyPath", "TLS_KEY_PATH")
+		}
+		switch http.ClientAuthMode(c.Server.TLS.ClientAuth) {
+		case http.ClientAuthNone:
+		case http.ClientAuthOptional, http.ClientAuthRequired:
+			if c.Server.TLS.ClientCAPath == "" {
+				return requiredKeyError(
+					"server.tls.clientCAPath",
+					"TLS_CLIENT_CA_PATH",
+				)
+			}
+		default:
+			return invalidKeyError(
+				"server.tls.clientAuth",
+				"TLS_CLIENT_AUTH",
+				fmt.Sprintf(
+					"must be %q, %q, or %q",
+					http.ClientAuthNone,
+					http.ClientAuthOptional,
+					http.ClientAuthRequired,
+				),
+			)
+		}
+		if c.Server.TLS.CheckInterval <= 0 {
+			return invalidKeyError(
+				"server.tls.checkInterval",
+				"TLS_CHECK_INTERVAL",
+				"must be positive",
+			)
+		}
+	}
+	if c.Health.APIUnreachableTimeout <= 0 {
+		return invalidKeyError(
+			"health.apiUnreachableTimeout",
+			"HEALTH_API_UNREACHABLE_TIMEOUT",
+			"must be positive",
+		)
+	}
+	if c.Push.OTLP.Enabled {
+		if c.Push.OTLP.Endpoint == "" {
+			return requiredKeyError("push.otlp.endpoint", "OTLP_ENDPOINT")
 		}
+		if c.Push.OTLP.Protocol != otlpProtocolGRPC &&
+			c.Push.OTLP.Protocol != otlpProtocolHTTP {
+			return invalidKeyError(
+				"push.otlp.protocol",
+				"OTLP_PROTOCOL",
+				fmt.Sprintf("must be %q or %q", otlpProtocolGRPC, otlpProtocolHTTP),
+			)
+		}
+		if c.Push.OTLP.Interval <= 0 {
+			return invalidKeyError(
+				"push.otlp.interval",
+				"OTLP_PUSH_INTERVAL",
+				"must be positive",
+			)
+		}
+		if c.Push.OTLP.Timeout <= 0 {
+			return invalidKeyError(
+				"push.otlp.timeout",
+				"OTLP_TIMEOUT",
+				"must be positive",
+			)
+		}
+	}
+	if c.Push.RemoteWrite.Enabled {
+		if err := c.Push.RemoteWrite.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Push.DogStatsD.Enabled {
+		if c.Push.DogStatsD.Address == "" {
+			return requiredKeyError("push.dogstatsd.address", "DOGSTATSD_ADDRESS")
+		}
+		if c.Push.DogStatsD.Protocol != dogStatsDProtocolUDP &&
+			c.Push.DogStatsD.Protocol != dogStatsDProtocolUDS {
+			return invalidKeyError(
+				"push.dogstatsd.protocol",
+				"DOGSTATSD_PROTOCOL",
+				fmt.Sprintf(
+					"must be %q or %q",
+					dogStatsDProtocolUDP,
+					dogStatsDProtocolUDS,
+				),
+			)
+		}
+		if c.Push.DogStatsD.Interval <= 0 {
+			return invalidKeyError(
+				"push.dogstatsd.interval",
+				"DOGSTATSD_PUSH_INTERVAL",
+				"must be positive",
+			)
+		}
+	}
+	return nil
+}
+
+// validate returns an error if the remote write configuration is invalid. It's
+// only called if pushing using remote write is enabled.
+func (r remoteWriteConfig) validate() error {
+	if r.URL == "" {
+		return requiredKeyError("push.remoteWrite.url", "REMOTE_WRITE_URL")
+	}
+	if r.Interval <= 0 {
+		return invalidKeyError(
+			"push.remoteWrite.interval",
+			"REMOTE_WRITE_PUSH_INTERVAL",
+			"must be positive",
+		)
 	}
-	return config, nil
+	if r.Timeout <= 0 {
+		return invalidKeyError(
+			"push.remoteWrite.timeout",
+			"REMOTE_WRITE_TIMEOUT",
+			"must be positive",
+		)
+	}
+	if r.MaxSamplesPerSend < 1 {
+		return invalidKeyError(
+			"push.remoteWrite.maxSamplesPerSend",
+			"REMOTE_WRITE_MAX_SAMPLES_PER_SEND",
+			"must be at least 1",
+		)
+	}
+	if r.QueueCapacity < r.MaxSamplesPerSend {
+		return invalidKeyError(
+			"push.remoteWrite.queueCapacity",
+			"REMOTE_WRITE_QUEUE_CAPACITY",
+			"must be at least push.remoteWrite.maxSamplesPerSend",
+		)
+	}
+	if r.MaxRetries < 0 {
+		return invalidKeyError(
+			"push.remoteWrite.maxRetries",
+			"REMOTE_WRITE_MAX_RETRIES",
+			"must not be negative",
+		)
+	}
+	if r.RetryBackoff < 0 {
+		return invalidKeyError(
+			"push.remoteWrite.retryBackoff",
+			"REMOTE_WRITE_RETRY_BACKOFF",
+			"must not be negative",
+		)
+	}
+	return nil
+}
+
+// validateCollectorNames returns an error if any of the provided names does
+// not match an available collector.
+func validateCollectorNames(key, envVar string, names []string) error {
+	for _, name := range names {
+		if _, ok := collectorFactories[name]; !ok {
+			return invalidKeyError(
+				key,
+				envVar,
+				fmt.Sprintf("unknown collector %q", name),
+			)
+		}
+	}
+	return nil
+}
+
+// requiredKeyError returns an error indicating that no value was found for
+// the specified required configuration key.
+func requiredKeyError(key, envVar string) error {
+	return errors.Errorf(
+		"value not found for required configuration key %s (environment "+
+			"variable %s)",
+		key,
+		envVar,
+	)
+}
+
+// invalidKeyError returns an error indicating that the value of the specified
+// configuration key is invalid for the specified reason.
+func invalidKeyError(key, envVar, reason string) error {
+	return errors.Errorf(
+		"invalid value for configuration key %s (environment variable %s): %s",
+		key,
+		envVar,
+		reason,
+	)
 }
@@ -1,164 +1,776 @@
 package main
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
-	"github.com/brigadecore/brigade/sdk/v2/restmachinery"
 	"github.com/stretchr/testify/require"
 	"github.com/willie-yao/brigade-metrics/exporter/internal/http"
 )
 
-// Note that unit testing in Go does NOT clear environment variables between
-// tests, which can sometimes be a pain, but it's fine here-- so each of these
-// test functions uses a series of test cases that cumulatively build upon one
-// another.
-
-func TestAPIClientConfig(t *testing.T) {
+func TestLoadConfig(t *testing.T) {
 	testCases := []struct {
-		name       string
-		setup      func()
-		assertions func(
-			address string,
-			token string,
-			opts restmachinery.APIClientOptions,
-			err error,
-		)
+		name string
+		// file, if non-empty, maps the name of a configuration file to its
+		// contents
+		file map[string]string
+		// tokenFile, if non-empty, is the contents of an API token file whose
+		// path is set using the API_TOKEN_PATH environment variable
+		tokenFile  string
+		envVars    map[string]string
+		assertions func(config, error)
 	}{
 		{
-			name:  "API_ADDRESS not set",
-			setup: func() {},
-			assertions: func(
-				_ string,
-				_ string,
-				_ restmachinery.APIClientOptions,
-				err error,
-			) {
+			name:    "API_ADDRESS not set",
+			envVars: map[string]string{},
+			assertions: func(_ config, err error) {
 				require.Error(t, err)
 				require.Contains(t, err.Error(), "value not found for")
+				require.Contains(t, err.Error(), "api.address")
 				require.Contains(t, err.Error(), "API_ADDRESS")
 			},
 		},
 		{
 			name: "API_TOKEN not set",
-			setup: func() {
-				os.Setenv("API_ADDRESS", "foo")
+			envVars: map[string]string{
+				"API_ADDRESS": "foo",
 			},
-			assertions: func(
-				_ string,
-				_ string,
-				_ restmachinery.APIClientOptions,
-				err error,
-			) {
+			assertions: func(_ config, err error) {
 				require.Error(t, err)
 				require.Contains(t, err.Error(), "value not found for")
 				require.Contains(t, err.Error(), "API_TOKEN")
 			},
 		},
 		{
-			name: "success",
-			setup: func() {
-				os.Setenv("API_TOKEN", "bar")
-				os.Setenv("API_IGNORE_CERT_WARNINGS", "true")
+			name: "defaults",
+			envVars: map[string]string{
+				"API_ADDRESS": "foo",
+				"API_TOKEN":   "bar",
 			},
-			assertions: func(
-				address string,
-				token string,
-				opts restmachinery.APIClientOptions,
-				err error,
-			) {
+			assertions: func(cfg config, err error) {
 				require.NoError(t, err)
-				require.Equal(t, "foo", address)
-				require.Equal(t, "bar", token)
-				require.True(t, opts.AllowInsecureConnections)
+				require.Equal(t, "foo", cfg.API.Address)
+				require.Equal(t, "bar", cfg.API.Token)
+				require.False(t, cfg.API.clientOptions().AllowInsecureConnections)
+				require.Equal(t, duration(10*time.Second), cfg.API.RequestTimeout)
+				require.Equal(t, 4, cfg.API.MaxInFlight)
+				require.Equal(t, duration(5*time.Second), cfg.Scrape.Interval)
+				require.Equal(
+					t,
+					retryPolicy{maxRetries: 2, backoff: 250 * time.Millisecond},
+					cfg.API.retryPolicy(),
+				)
+				require.Equal(
+					t,
+					circuitBreakerPolicy{
+						failureThreshold: 5,
+						cooldown:         30 * time.Second,
+					},
+					cfg.API.circuitBreakerPolicy(),
+				)
+				require.False(t, cfg.Scrape.BackgroundRefresh)
+				require.False(t, cfg.backgroundRefresh())
+				require.Equal(
+					t,
+					stalenessPolicy{maxFailedCycles: 3, maxAge: 10 * time.Minute},
+					cfg.Scrape.stalenessPolicy(),
+				)
+				require.Equal(t, collectorNames(), cfg.Collectors.names())
+				require.Equal(
+					t,
+					collectorOptions{staleAccountAge: 90 * 24 * time.Hour},
+					cfg.Collectors.options(),
+				)
+				require.Equal(
+					t,
+					http.ServerConfig{
+						Port:             8080,
+						TLSClientAuth:    http.ClientAuthNone,
+						TLSCheckInterval: time.Minute,
+					},
+					cfg.Server.httpConfig(),
+				)
+				require.Equal(t, http.AuthConfig{}, cfg.Auth.httpConfig())
+				require.Equal(
+					t,
+					duration(2*time.Minute),
+					cfg.Health.APIUnreachableTimeout,
+				)
+				require.Equal(
+					t,
+					otlpOptions{
+						protocol: otlpProtocolGRPC,
+						interval: 30 * time.Second,
+						timeout:  10 * time.Second,
+					},
+					cfg.Push.OTLP.options(),
+				)
+				require.Equal(
+					t,
+					remoteWriteOptions{
+						interval:          30 * time.Second,
+						timeout:           10 * time.Second,
+						maxSamplesPerSend: 500,
+						queueCapacity:     10000,
+						retries: retryPolicy{
+							maxRetries: 3,
+							backoff:    500 * time.Millisecond,
+						},
+					},
+					cfg.Push.RemoteWrite.options(),
+				)
+				require.Equal(
+					t,
+					dogStatsDOptions{
+						protocol: dogStatsDProtocolUDP,
+						interval: 10 * time.Second,
+					},
+					cfg.Push.DogStatsD.options(),
+				)
+			},
+		},
+		{
+			name: "environment variables",
+			envVars: map[string]string{
+				"API_ADDRESS":                           "foo",
+				"API_TOKEN":                             "bar",
+				"API_IGNORE_CERT_WARNINGS":              "true",
+				"API_REQUEST_TIMEOUT":                   "30s",
+				"API_MAX_IN_FLIGHT_REQUESTS":            "8",
+				"API_MAX_RETRIES":                       "0",
+				"API_RETRY_BACKOFF":                     "1s",
+				"API_CIRCUIT_BREAKER_FAILURE_THRESHOLD": "10",
+				"API_CIRCUIT_BREAKER_COOLDOWN":          "1m",
+				"PROM_SCRAPE_INTERVAL":                  "1m",
+				"BACKGROUND_REFRESH_ENABLED":            "true",
+				"SCRAPE_MAX_FAILED_CYCLES":              "0",
+				"SCRAPE_MAX_AGE":                        "1h",
+				"ENABLED_COLLECTORS":                    "users, projects,durations",
+				"DISABLED_COLLECTORS":                   "durations",
+				"EVENTS_STATE_PATH":                     "/var/lib/events.json",
+				"ACCOUNTS_STALE_AFTER":                  "720h",
+				"ACCOUNTS_INFO_ENABLED":                 "true",
+				"RECEIVER_PORT":                         "9090",
+				"TLS_ENABLED":                           "true",
+				"TLS_CERT_PATH":                         "/var/ssl/cert",
+				"TLS_KEY_PATH":                          "/var/ssl/key",
+				"TLS_CLIENT_AUTH":                       "required",
+				"TLS_CLIENT_CA_PATH":                    "/var/ssl/ca",
+				"TLS_CHECK_INTERVAL":                    "10s",
+				"AUTH_BEARER_TOKENS_PATH":               "/var/auth/tokens",
+				"AUTH_WEB_CONFIG_PATH":                  "/var/auth/web.yml",
+				"HEALTH_API_UNREACHABLE_TIMEOUT":        "5m",
+				"OTLP_ENABLED":                          "true",
+				"OTLP_PROTOCOL":                         "http",
+				"OTLP_ENDPOINT":                         "http://otel:4318/v1/metrics",
+				"OTLP_INSECURE":                         "true",
+				"OTLP_PUSH_INTERVAL":                    "1m",
+				"OTLP_TIMEOUT":                          "5s",
+				"REMOTE_WRITE_ENABLED":                  "true",
+				"REMOTE_WRITE_URL":                      "http://mimir/api/v1/push",
+				"REMOTE_WRITE_PUSH_INTERVAL":            "15s",
+				"REMOTE_WRITE_TIMEOUT":                  "3s",
+				"REMOTE_WRITE_MAX_SAMPLES_PER_SEND":     "100",
+				"REMOTE_WRITE_QUEUE_CAPACITY":           "2000",
+				"REMOTE_WRITE_MAX_RETRIES":              "5",
+				"REMOTE_WRITE_RETRY_BACKOFF":            "2s",
+				"DOGSTATSD_ENABLED":                     "true",
+				"DOGSTATSD_PROTOCOL":                    "uds",
+				"DOGSTATSD_ADDRESS":                     "/var/run/datadog/dsd.socket",
+				"DOGSTATSD_NAMESPACE":                   "brigade.",
+				"DOGSTATSD_PUSH_INTERVAL":               "20s",
+			},
+			assertions: func(cfg config, err error) {
+				require.NoError(t, err)
+				require.True(t, cfg.API.clientOptions().AllowInsecureConnections)
+				require.Equal(t, duration(30*time.Second), cfg.API.RequestTimeout)
+				require.Equal(t, 8, cfg.API.MaxInFlight)
+				require.Equal(
+					t,
+					retryPolicy{backoff: time.Second},
+					cfg.API.retryPolicy(),
+				)
+				require.Equal(
+					t,
+					circuitBreakerPolicy{failureThreshold: 10, cooldown: time.Minute},
+					cfg.API.circuitBreakerPolicy(),
+				)
+				require.Equal(t, duration(time.Minute), cfg.Scrape.Interval)
+				require.True(t, cfg.Scrape.BackgroundRefresh)
+				require.Equal(
+					t,
+					stalenessPolicy{maxAge: time.Hour},
+					cfg.Scrape.stalenessPolicy(),
+				)
+				require.Equal(
+					t,
+					[]string{"projects", "users"},
+					cfg.Collectors.names(),
+				)
+				require.Equal(
+					t,
+					collectorOptions{
+						eventsStatePath:    "/var/lib/events.json",
+						staleAccountAge:    720 * time.Hour,
+						accountInfoEnabled: true,
+					},
+					cfg.Collectors.options(),
+				)
+				require.Equal(
+					t,
+					http.ServerConfig{
+						Port:             9090,
+						TLSEnabled:       true,
+						TLSCertPath:      "/var/ssl/cert",
+						TLSKeyPath:       "/var/ssl/key",
+						TLSClientAuth:    http.ClientAuthRequired,
+						TLSClientCAPath:  "/var/ssl/ca",
+						TLSCheckInterval: 10 * time.Second,
+					},
+					cfg.Server.httpConfig(),
+				)
+				require.Equal(
+					t,
+					http.AuthConfig{
+						BearerTokensPath: "/var/auth/tokens",
+						WebConfigPath:    "/var/auth/web.yml",
+					},
+					cfg.Auth.httpConfig(),
+				)
+				require.Equal(
+					t,
+					duration(5*time.Minute),
+					cfg.Health.APIUnreachableTimeout,
+				)
+				require.Equal(
+					t,
+					otlpOptions{
+						enabled:  true,
+						protocol: otlpProtocolHTTP,
+						endpoint: "http://otel:4318/v1/metrics",
+						insecure: true,
+						interval: time.Minute,
+						timeout:  5 * time.Second,
+					},
+					cfg.Push.OTLP.options(),
+				)
+				require.Equal(
+					t,
+					remoteWriteOptions{
+						enabled:           true,
+						url:               "http://mimir/api/v1/push",
+						interval:          15 * time.Second,
+						timeout:           3 * time.Second,
+						maxSamplesPerSend: 100,
+						queueCapacity:     2000,
+						retries: retryPolicy{
+							maxRetries: 5,
+							backoff:    2 * time.Second,
+						},
+					},
+					cfg.Push.RemoteWrite.options(),
+				)
+				require.Equal(
+					t,
+					dogStatsDOptions{
+						enabled:   true,
+						protocol:  dogStatsDProtocolUDS,
+						address:   "/var/run/datadog/dsd.socket",
+						namespace: "brigade.",
+						interval:  20 * time.Second,
+					},
+					cfg.Push.DogStatsD.options(),
+				)
 			},
 		},
-	}
-	for _, testCase := range testCases {
-		t.Run(testCase.name, func(t *testing.T) {
-			testCase.setup()
-			address, token, opts, err := apiClientConfig()
-			testCase.assertions(address, token, opts, err)
-		})
-	}
-}
-
-func TestServerConfig(t *testing.T) {
-	testCases := []struct {
-		name       string
-		setup      func()
-		assertions func(http.ServerConfig, error)
-	}{
 		{
-			name: "RECEIVER_PORT not an int",
-			setup: func() {
-				os.Setenv("RECEIVER_PORT", "foo")
+			name: "API_MAX_IN_FLIGHT_REQUESTS not parsable as int",
+			envVars: map[string]string{
+				"API_ADDRESS":                "foo",
+				"API_TOKEN":                  "bar",
+				"API_MAX_IN_FLIGHT_REQUESTS": "many",
 			},
-			assertions: func(_ http.ServerConfig, err error) {
+			assertions: func(_ config, err error) {
 				require.Error(t, err)
 				require.Contains(t, err.Error(), "was not parsable as an int")
-				require.Contains(t, err.Error(), "RECEIVER_PORT")
+				require.Contains(t, err.Error(), "API_MAX_IN_FLIGHT_REQUESTS")
+			},
+		},
+		{
+			name: "API_MAX_IN_FLIGHT_REQUESTS less than 1",
+			envVars: map[string]string{
+				"API_ADDRESS":                "foo",
+				"API_TOKEN":                  "bar",
+				"API_MAX_IN_FLIGHT_REQUESTS": "0",
+			},
+			assertions: func(_ config, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "api.maxInFlight")
+				require.Contains(t, err.Error(), "must be at least 1")
+			},
+		},
+		{
+			name: "API_CIRCUIT_BREAKER_COOLDOWN not positive",
+			envVars: map[string]string{
+				"API_ADDRESS":                  "foo",
+				"API_TOKEN":                    "bar",
+				"API_CIRCUIT_BREAKER_COOLDOWN": "0s",
+			},
+			assertions: func(_ config, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "api.circuitBreaker.cooldown")
+				require.Contains(t, err.Error(), "must be positive")
+			},
+		},
+		{
+			name: "SCRAPE_MAX_FAILED_CYCLES negative",
+			envVars: map[string]string{
+				"API_ADDRESS":              "foo",
+				"API_TOKEN":                "bar",
+				"SCRAPE_MAX_FAILED_CYCLES": "-1",
+			},
+			assertions: func(_ config, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "scrape.maxFailedCycles")
+				require.Contains(t, err.Error(), "must not be negative")
+			},
+		},
+		{
+			name: "ACCOUNTS_STALE_AFTER not positive",
+			envVars: map[string]string{
+				"API_ADDRESS":          "foo",
+				"API_TOKEN":            "bar",
+				"ACCOUNTS_STALE_AFTER": "0s",
+			},
+			assertions: func(_ config, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "collectors.accounts.staleAfter")
+				require.Contains(t, err.Error(), "must be positive")
+			},
+		},
+		{
+			name: "OTLP_ENDPOINT required but not set",
+			envVars: map[string]string{
+				"API_ADDRESS":  "foo",
+				"API_TOKEN":    "bar",
+				"OTLP_ENABLED": "true",
+			},
+			assertions: func(_ config, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "push.otlp.endpoint")
+			},
+		},
+		{
+			name: "OTLP_PROTOCOL invalid",
+			envVars: map[string]string{
+				"API_ADDRESS":   "foo",
+				"API_TOKEN":     "bar",
+				"OTLP_ENABLED":  "true",
+				"OTLP_ENDPOINT": "otel:4317",
+				"OTLP_PROTOCOL": "carrier-pigeon",
+			},
+			assertions: func(_ config, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "push.otlp.protocol")
+			},
+		},
+		{
+			name: "REMOTE_WRITE_URL required but not set",
+			envVars: map[string]string{
+				"API_ADDRESS":          "foo",
+				"API_TOKEN":            "bar",
+				"REMOTE_WRITE_ENABLED": "true",
+			},
+			assertions: func(_ config, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "push.remoteWrite.url")
+			},
+		},
+		{
+			name: "REMOTE_WRITE_QUEUE_CAPACITY smaller than a batch",
+			envVars: map[string]string{
+				"API_ADDRESS":                       "foo",
+				"API_TOKEN":                         "bar",
+				"REMOTE_WRITE_ENABLED":              "true",
+				"REMOTE_WRITE_URL":                  "http://mimir/api/v1/push",
+				"REMOTE_WRITE_MAX_SAMPLES_PER_SEND": "100",
+				"REMOTE_WRITE_QUEUE_CAPACITY":       "10",
+			},
+			assertions: func(_ config, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "push.remoteWrite.queueCapacity")
+			},
+		},
+		{
+			name: "pushing implies background refresh",
+			envVars: map[string]string{
+				"API_ADDRESS":       "foo",
+				"API_TOKEN":         "bar",
+				"DOGSTATSD_ENABLED": "true",
+				"DOGSTATSD_ADDRESS": "localhost:8125",
+			},
+			assertions: func(cfg config, err error) {
+				require.NoError(t, err)
+				require.False(t, cfg.Scrape.BackgroundRefresh)
+				require.True(t, cfg.backgroundRefresh())
+			},
+		},
+		{
+			name: "DOGSTATSD_ADDRESS required but not set",
+			envVars: map[string]string{
+				"API_ADDRESS":       "foo",
+				"API_TOKEN":         "bar",
+				"DOGSTATSD_ENABLED": "true",
+			},
+			assertions: func(_ config, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "push.dogstatsd.address")
+			},
+		},
+		{
+			name: "DOGSTATSD_PROTOCOL invalid",
+			envVars: map[string]string{
+				"API_ADDRESS":        "foo",
+				"API_TOKEN":          "bar",
+				"DOGSTATSD_ENABLED":  "true",
+				"DOGSTATSD_ADDRESS":  "localhost:8125",
+				"DOGSTATSD_PROTOCOL": "tcp",
+			},
+			assertions: func(_ config, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "push.dogstatsd.protocol")
 			},
 		},
 		{
-			name: "TLS_ENABLED not a bool",
-			setup: func() {
-				os.Setenv("RECEIVER_PORT", "8080")
-				os.Setenv("TLS_ENABLED", "nope")
+			name: "unknown collector",
+			envVars: map[string]string{
+				"API_ADDRESS":         "foo",
+				"API_TOKEN":           "bar",
+				"DISABLED_COLLECTORS": "users,bogus",
 			},
-			assertions: func(_ http.ServerConfig, err error) {
+			assertions: func(_ config, err error) {
 				require.Error(t, err)
-				require.Contains(t, err.Error(), "was not parsable as a bool")
-				require.Contains(t, err.Error(), "TLS_ENABLED")
+				require.Contains(t, err.Error(), "collectors.disabled")
+				require.Contains(t, err.Error(), `unknown collector "bogus"`)
 			},
 		},
 		{
 			name: "TLS_CERT_PATH required but not set",
-			setup: func() {
-				os.Setenv("TLS_ENABLED", "true")
+			envVars: map[string]string{
+				"API_ADDRESS": "foo",
+				"API_TOKEN":   "bar",
+				"TLS_ENABLED": "true",
 			},
-			assertions: func(_ http.ServerConfig, err error) {
+			assertions: func(_ config, err error) {
 				require.Error(t, err)
 				require.Contains(t, err.Error(), "value not found for")
-				require.Contains(t, err.Error(), "TLS_CERT_PATH")
+				require.Contains(t, err.Error(), "server.tls.certPath")
 			},
 		},
 		{
 			name: "TLS_KEY_PATH required but not set",
-			setup: func() {
-				os.Setenv("TLS_CERT_PATH", "/var/ssl/cert")
+			envVars: map[string]string{
+				"API_ADDRESS":   "foo",
+				"API_TOKEN":     "bar",
+				"TLS_ENABLED":   "true",
+				"TLS_CERT_PATH": "/var/ssl/cert",
+			},
+			assertions: func(_ config, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "value not found for")
+				require.Contains(t, err.Error(), "server.tls.keyPath")
+			},
+		},
+		{
+			name: "TLS_CLIENT_AUTH invalid",
+			envVars: map[string]string{
+				"API_ADDRESS":     "foo",
+				"API_TOKEN":       "bar",
+				"TLS_ENABLED":     "true",
+				"TLS_CERT_PATH":   "/var/ssl/cert",
+				"TLS_KEY_PATH":    "/var/ssl/key",
+				"TLS_CLIENT_AUTH": "sometimes",
+			},
+			assertions: func(_ config, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "server.tls.clientAuth")
+				require.Contains(t, err.Error(), `must be "none", "optional", or`)
+			},
+		},
+		{
+			name: "HEALTH_API_UNREACHABLE_TIMEOUT not positive",
+			envVars: map[string]string{
+				"API_ADDRESS":                    "foo",
+				"API_TOKEN":                      "bar",
+				"HEALTH_API_UNREACHABLE_TIMEOUT": "0s",
 			},
-			assertions: func(_ http.ServerConfig, err error) {
+			assertions: func(_ config, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "health.apiUnreachableTimeout")
+				require.Contains(t, err.Error(), "must be positive")
+			},
+		},
+		{
+			name: "TLS_CLIENT_CA_PATH required but not set",
+			envVars: map[string]string{
+				"API_ADDRESS":     "foo",
+				"API_TOKEN":       "bar",
+				"TLS_ENABLED":     "true",
+				"TLS_CERT_PATH":   "/var/ssl/cert",
+				"TLS_KEY_PATH":    "/var/ssl/key",
+				"TLS_CLIENT_AUTH": "optional",
+			},
+			assertions: func(_ config, err error) {
 				require.Error(t, err)
 				require.Contains(t, err.Error(), "value not found for")
-				require.Contains(t, err.Error(), "TLS_KEY_PATH")
+				require.Contains(t, err.Error(), "server.tls.clientCAPath")
 			},
 		},
 		{
-			name: "success",
-			setup: func() {
-				os.Setenv("TLS_KEY_PATH", "/var/ssl/key")
+			name: "YAML file",
+			file: map[string]string{
+				"config.yaml": `
+api:
+  address: foo
+  token: bar
+  requestTimeout: 20s
+scrape:
+  backgroundRefresh: true
+collectors:
+  enabled:
+  - users
+server:
+  port: 9090
+auth:
+  webConfigPath: /var/auth/web.yml
+`,
 			},
-			assertions: func(config http.ServerConfig, err error) {
+			envVars: map[string]string{},
+			assertions: func(cfg config, err error) {
 				require.NoError(t, err)
-				require.Equal(
+				require.Equal(t, "foo", cfg.API.Address)
+				require.Equal(t, "bar", cfg.API.Token)
+				require.Equal(t, duration(20*time.Second), cfg.API.RequestTimeout)
+				// Defaults are retained for values not set in the file
+				require.Equal(t, 4, cfg.API.MaxInFlight)
+				require.True(t, cfg.Scrape.BackgroundRefresh)
+				require.Equal(t, []string{"users"}, cfg.Collectors.names())
+				require.Equal(t, 9090, cfg.Server.Port)
+				require.Equal(t, "/var/auth/web.yml", cfg.Auth.WebConfigPath)
+			},
+		},
+		{
+			name: "TOML file",
+			file: map[string]string{
+				"config.toml": `
+[api]
+address = "foo"
+token = "bar"
+maxInFlight = 2
+
+[scrape]
+interval = "30s"
+
+[server.tls]
+enabled = true
+certPath = "/var/ssl/cert"
+keyPath = "/var/ssl/key"
+`,
+			},
+			envVars: map[string]string{},
+			assertions: func(cfg config, err error) {
+				require.NoError(t, err)
+				require.Equal(t, "foo", cfg.API.Address)
+				require.Equal(t, 2, cfg.API.MaxInFlight)
+				require.Equal(t, duration(30*time.Second), cfg.Scrape.Interval)
+				require.True(t, cfg.Server.TLS.Enabled)
+				require.Equal(t, "/var/ssl/cert", cfg.Server.TLS.CertPath)
+			},
+		},
+		{
+			name: "environment variables override file",
+			file: map[string]string{
+				"config.yaml": `
+api:
+  address: foo
+  token: bar
+server:
+  port: 9090
+`,
+			},
+			envVars: map[string]string{
+				"API_TOKEN":     "baz",
+				"RECEIVER_PORT": "9091",
+			},
+			assertions: func(cfg config, err error) {
+				require.NoError(t, err)
+				require.Equal(t, "foo", cfg.API.Address)
+				require.Equal(t, "baz", cfg.API.Token)
+				require.Equal(t, 9091, cfg.Server.Port)
+			},
+		},
+		{
+			name:      "API token file",
+			tokenFile: "baz\n",
+			envVars: map[string]string{
+				"API_ADDRESS": "foo",
+				"API_TOKEN":   "bar",
+			},
+			assertions: func(cfg config, err error) {
+				require.NoError(t, err)
+				require.Equal(t, "baz", cfg.API.Token)
+			},
+		},
+		{
+			name: "unrecognized key in YAML file",
+			file: map[string]string{
+				"config.yaml": `
+api:
+  address: foo
+  tokne: bar
+`,
+			},
+			envVars: map[string]string{},
+			assertions: func(_ config, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), `unrecognized key "api.tokne"`)
+			},
+		},
+		{
+			name: "unrecognized key in TOML file",
+			file: map[string]string{
+				"config.toml": `
+[server.tls]
+enabeld = true
+`,
+			},
+			envVars: map[string]string{},
+			assertions: func(_ config, err error) {
+				require.Error(t, err)
+				require.Contains(
 					t,
-					http.ServerConfig{
-						Port:        8080,
-						TLSEnabled:  true,
-						TLSCertPath: "/var/ssl/cert",
-						TLSKeyPath:  "/var/ssl/key",
-					},
-					config,
+					err.Error(),
+					`unrecognized key "server.tls.enabeld"`,
 				)
 			},
 		},
+		{
+			name: "invalid duration in file",
+			file: map[string]string{
+				"config.yaml": `
+scrape:
+  interval: soon
+`,
+			},
+			envVars: map[string]string{},
+			assertions: func(_ config, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "scrape.interval")
+				require.Contains(t, err.Error(), `"soon" is not a valid duration`)
+			},
+		},
+		{
+			name: "invalid duration in TOML file",
+			file: map[string]string{
+				"config.toml": `
+[scrape]
+interval = "soon"
+`,
+			},
+			envVars: map[string]string{},
+			assertions: func(_ config, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "scrape.interval")
+				require.Contains(t, err.Error(), `"soon" is not a valid duration`)
+			},
+		},
+		{
+			name: "mismatched type in YAML file",
+			file: map[string]string{
+				"config.yaml": `
+server:
+  port: abc
+`,
+			},
+			envVars: map[string]string{},
+			assertions: func(_ config, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "server.port")
+			},
+		},
+		{
+			name: "mismatched type in TOML file",
+			file: map[string]string{
+				"config.toml": `
+[server]
+port = "abc"
+`,
+			},
+			envVars: map[string]string{},
+			assertions: func(_ config, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "server.port")
+			},
+		},
+		{
+			name: "invalid value in file",
+			file: map[string]string{
+				"config.yaml": `
+api:
+  address: foo
+  token: bar
+server:
+  port: 0
+`,
+			},
+			envVars: map[string]string{},
+			assertions: func(_ config, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "server.port")
+			},
+		},
+		{
+			name: "unsupported file extension",
+			file: map[string]string{
+				"config.json": "{}",
+			},
+			envVars: map[string]string{},
+			assertions: func(_ config, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "unsupported extension")
+			},
+		},
 	}
 	for _, testCase := range testCases {
 		t.Run(testCase.name, func(t *testing.T) {
-			testCase.setup()
-			config, err := serverConfig()
-			testCase.assertions(config, err)
+			var path string
+			for name, contents := range testCase.file {
+				dir, err := ioutil.TempDir("", "")
+				require.NoError(t, err)
+				defer os.RemoveAll(dir)
+				path = filepath.Join(dir, name)
+				err = ioutil.WriteFile(path, []byte(contents), 0600)
+				require.NoError(t, err)
+			}
+			for name, value := range testCase.envVars {
+				os.Setenv(name, value)
+				defer os.Unsetenv(name)
+			}
+			if testCase.tokenFile != "" {
+				tokenFile, err := ioutil.TempFile("", "token-*")
+				require.NoError(t, err)
+				defer os.Remove(tokenFile.Name())
+				_, err = tokenFile.WriteString(testCase.tokenFile)
+				require.NoError(t, err)
+				require.NoError(t, tokenFile.Close())
+				os.Setenv("API_TOKEN_PATH", tokenFile.Name())
+				defer os.Unsetenv("API_TOKEN_PATH")
+			}
+			cfg, err := loadConfig(path)
+			testCase.assertions(cfg, err)
 		})
 	}
 }
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	dogStatsDProtocolUDP = "udp"
+	dogStatsDProtocolUDS = "uds"
+)
+
+// dogStatsDMaxPacketSizes are the largest packets sent using each protocol.
+// These match the defaults of the official DogStatsD clients, which avoid
+// fragmentation over UDP and fit the agent's buffer over UDS.
+var dogStatsDMaxPacketSizes = map[string]int{
+	dogStatsDProtocolUDP: 1432,
+	dogStatsDProtocolUDS: 8192,
+}
+
+// dogStatsDOptions determine whether, where, and how often a dogStatsDPusher
+// pushes metrics.
+type dogStatsDOptions struct {
+	enabled  bool
+	protocol string
+	// address is a host and port for UDP or the path of a socket for UDS.
+	address string
+	// namespace is prepended to the name of every metric, e.g. "brigade.".
+	namespace string
+	// tags are added to every metric, e.g. to identify the cluster the
+	// metrics came from. They never override tags derived from labels.
+	tags     map[string]string
+	interval time.Duration
+}
+
+// dogStatsDPusher periodically pushes the metrics from a prometheus.Gatherer
+// to a Datadog agent using the DogStatsD protocol, with each metric's labels
+// as tags. Gauges are sent as gauges. Counters are sent as counts of their
+// increase since the previous push, so a counter is only sent once it has
+// been seen before. Histograms and summaries are sent as counts of the
+// increase in their count and sum. The same metrics remain available for
+// scraping.
+type dogStatsDPusher struct {
+	gatherer prometheus.Gatherer
+
+	// mu guards options and counters. It's held for the duration of each push.
+	mu      sync.Mutex
+	options dogStatsDOptions
+	// counters holds the value of every counter series as of the previous
+	// push, keyed by the series' name and tags.
+	counters map[string]float64
+
+	loop   pushLoop
+	pushes *prometheus.CounterVec
+}
+
+// newDogStatsDPusher returns a dogStatsDPusher that pushes the metrics from
+// the provided gatherer according to the provided options and counts its
+// pushes using the provided counter. Nothing is pushed until run is called.
+func newDogStatsDPusher(
+	gatherer prometheus.Gatherer,
+	pushes *prometheus.CounterVec,
+	options dogStatsDOptions,
+) (*dogStatsDPusher, error) {
+	if err := validateDogStatsDProtocol(options); err != nil {
+		return nil, err
+	}
+	return &dogStatsDPusher{
+		gatherer: gatherer,
+		options:  options,
+		counters: map[string]float64{},
+		loop:     newPushLoop(),
+		pushes:   pushes,
+	}, nil
+}
+
+// reconfigure replaces the dogStatsDPusher's options. If the new options
+// can't be applied, the current ones are kept. Any push in progress completes
+// using the current options first.
+func (d *dogStatsDPusher) reconfigure(options dogStatsDOptions) error {
+	if err := validateDogStatsDProtocol(options); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.options = options
+	d.mu.Unlock()
+	d.loop.restart()
+	return nil
+}
+
+// run pushes metrics at the configured interval, for as long as pushing is
+// enabled, until the provided context is canceled. Whenever the
+// dogStatsDPusher is reconfigured, the interval restarts using the new
+// configuration.
+func (d *dogStatsDPusher) run(ctx context.Context) {
+	d.loop.run(
+		ctx,
+		func() (time.Duration, bool) {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			return d.options.interval, d.options.enabled
+		},
+		func(context.Context) {
+			if err := d.push(); err != nil {
+				log.Println(err)
+			}
+		},
+	)
+}
+
+// push gathers metrics and pushes them once, unless pushing is disabled. A
+// new connection is used for every push, so pushing recovers by itself once
+// an agent that was unavailable becomes available.
+func (d *dogStatsDPusher) push() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.options.enabled {
+		return nil
+	}
+	lines, counters := dogStatsDLines(
+		gatherToPush(d.gatherer),
+		d.options,
+		d.counters,
+	)
+	if err := d.send(lines); err != nil {
+		d.pushes.With(
+			prometheus.Labels{"target": "dogstatsd", "result": "failure"},
+		).Inc()
+		return errors.Wrapf(
+			err,
+			"error pushing metrics to DogStatsD address %s",
+			d.options.address,
+		)
+	}
+	// Counters are only updated once their increase has been sent
+	d.counters = counters
+	d.pushes.With(
+		prometheus.Labels{"target": "dogstatsd", "result": "success"},
+	).Inc()
+	return nil
+}
+
+// send sends the provided lines, as many to a packet as fit.
+func (d *dogStatsDPusher) send(lines []string) error {
+	network := "udp"
+	if d.options.protocol == dogStatsDProtocolUDS {
+		network = "unixgram"
+	}
+	conn, err := net.Dial(network, d.options.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	maxPacketSize := dogStatsDMaxPacketSizes[d.options.protocol]
+	var packet bytes.Buffer
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > maxPacketSize {
+			if _, err = conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		_, err = conn.Write(packet.Bytes())
+	}
+	return err
+}
+
+// validateDogStatsDProtocol returns an error if pushing is enabled by the
+// provided options but their protocol is unknown.
+func validateDogStatsDProtocol(options dogStatsDOptions) error {
+	if !options.enabled {
+		return nil
+	}
+	if _, ok := dogStatsDMaxPacketSizes[options.protocol]; !ok {
+		return errors.Errorf("unknown DogStatsD protocol %q", options.protocol)
+	}
+	return nil
+}
+
+// dogStatsDLines converts the provided metric families to DogStatsD lines,
+// e.g. "brigade.projects:3|g|#cluster:foo". The increase in each counter is
+// relative to the provided values of counters as of the previous push. The
+// values of counters as of now are returned alongside the lines. Values that
+// are NaN or infinite are skipped, since DogStatsD can't represent them.
+func dogStatsDLines(
+	families []*dto.MetricFamily,
+	options dogStatsDOptions,
+	previous map[string]float64,
+) ([]string, map[string]float64) {
+	var lines []string
+	counters := map[string]float64{}
+	// gauge adds a line for the specified gauge.
+	gauge := func(name, tags string, value float64) {
+		if !math.IsNaN(value) && !math.IsInf(value, 0) {
+			lines = append(lines, name+":"+formatFloat(value)+"|g"+tags)
+		}
+	}
+	// count adds a line for the increase in the specified counter, if it was
+	// seen during the previous push. A decrease means the counter was reset,
+	// so its entire value is the increase.
+	count := func(name, tags string, value float64) {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return
+		}
+		// Names and tags together identify a series
+		key := name + tags
+		counters[key] = value
+		last, ok := previous[key]
+		if !ok {
+			return
+		}
+		increase := value - last
+		if increase < 0 {
+			increase = value
+		}
+		lines = append(lines, name+":"+formatFloat(increase)+"|c"+tags)
+	}
+	for _, family := range families {
+		name := options.namespace + family.GetName()
+		for _, m := range family.Metric {
+			tags := dogStatsDTags(m.Label, options.tags)
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				count(name, tags, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				gauge(name, tags, m.GetGauge().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				count(name+"_count", tags, float64(h.GetSampleCount()))
+				count(name+"_sum", tags, h.GetSampleSum())
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				count(name+"_count", tags, float64(s.GetSampleCount()))
+				count(name+"_sum", tags, s.GetSampleSum())
+			default:
+				gauge(name, tags, m.GetUntyped().GetValue())
+			}
+		}
+	}
+	return lines, counters
+}
+
+// dogStatsDTags returns the tags section of a DogStatsD line, e.g.
+// "|#project:foo,phase:running", for the provided labels and tags, or an
+// empty string if there are none. Characters that would break the line
+// format are replaced with underscores.
+func dogStatsDTags(labels []*dto.LabelPair, tags map[string]string) string {
+	names := map[string]struct{}{}
+	pairs := make([]string, 0, len(labels)+len(tags))
+	for _, label := range labels {
+		names[label.GetName()] = struct{}{}
+		pairs = append(pairs, dogStatsDTag(label.GetName(), label.GetValue()))
+	}
+	extra := make([]string, 0, len(tags))
+	for name, value := range tags {
+		if _, ok := names[name]; !ok {
+			extra = append(extra, dogStatsDTag(name, value))
+		}
+	}
+	sort.Strings(extra)
+	pairs = append(pairs, extra...)
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "|#" + strings.Join(pairs, ",")
+}
+
+// dogStatsDTagReplacer replaces characters that delimit parts of a DogStatsD
+// line.
+var dogStatsDTagReplacer = strings.NewReplacer(
+	",", "_",
+	"|", "_",
+	"#", "_",
+	"\n", "_",
+)
+
+// dogStatsDTag returns a DogStatsD tag with the specified name and value.
+func dogStatsDTag(name, value string) string {
+	return dogStatsDTagReplacer.Replace(name) + ":" +
+		dogStatsDTagReplacer.Replace(value)
+}
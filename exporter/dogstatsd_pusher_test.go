@@ -0,0 +1,254 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestDogStatsDPusherPush(t *testing.T) {
+	testCases := []struct {
+		name string
+		// options returns options for pushing to an agent listening on the
+		// provided connection, if any.
+		options func(*testing.T) (dogStatsDOptions, net.PacketConn)
+		// assertions are made after metrics are pushed twice.
+		assertions func(*testing.T, *dogStatsDPusher, []string, error)
+	}{
+		{
+			name: "disabled",
+			options: func(*testing.T) (dogStatsDOptions, net.PacketConn) {
+				return dogStatsDOptions{}, nil
+			},
+			assertions: func(
+				t *testing.T,
+				dogStatsD *dogStatsDPusher,
+				lines []string,
+				err error,
+			) {
+				require.NoError(t, err)
+				require.Empty(t, lines)
+				require.Equal(t, 0, testutil.CollectAndCount(dogStatsD.pushes))
+			},
+		},
+		{
+			name: "UDP",
+			options: func(t *testing.T) (dogStatsDOptions, net.PacketConn) {
+				conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+				require.NoError(t, err)
+				return dogStatsDOptions{
+					enabled:   true,
+					protocol:  dogStatsDProtocolUDP,
+					address:   conn.LocalAddr().String(),
+					namespace: "brigade.",
+					tags:      map[string]string{"cluster": "foo"},
+				}, conn
+			},
+			assertions: requireDogStatsDPushed,
+		},
+		{
+			name: "UDS",
+			options: func(t *testing.T) (dogStatsDOptions, net.PacketConn) {
+				dir, err := ioutil.TempDir("", "")
+				require.NoError(t, err)
+				t.Cleanup(func() {
+					os.RemoveAll(dir)
+				})
+				socketPath := filepath.Join(dir, "dsd.socket")
+				conn, err := net.ListenPacket("unixgram", socketPath)
+				require.NoError(t, err)
+				return dogStatsDOptions{
+					enabled:   true,
+					protocol:  dogStatsDProtocolUDS,
+					address:   socketPath,
+					namespace: "brigade.",
+					tags:      map[string]string{"cluster": "foo"},
+				}, conn
+			},
+			assertions: requireDogStatsDPushed,
+		},
+		{
+			name: "agent unavailable",
+			options: func(*testing.T) (dogStatsDOptions, net.PacketConn) {
+				return dogStatsDOptions{
+					enabled:  true,
+					protocol: dogStatsDProtocolUDS,
+					address:  "/nonexistent/dsd.socket",
+				}, nil
+			},
+			assertions: func(
+				t *testing.T,
+				dogStatsD *dogStatsDPusher,
+				_ []string,
+				err error,
+			) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "/nonexistent/dsd.socket")
+				require.Equal(
+					t,
+					2.0,
+					testutil.ToFloat64(
+						dogStatsD.pushes.With(
+							prometheus.Labels{"target": "dogstatsd", "result": "failure"},
+						),
+					),
+				)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			options, conn := testCase.options(t)
+			if conn != nil {
+				defer conn.Close()
+			}
+			dogStatsD, err := newDogStatsDPusher(
+				newTestOTLPRegistry(),
+				newPushesCounter(),
+				options,
+			)
+			require.NoError(t, err)
+			// Counters are only sent once they've been seen before, so push twice
+			_ = dogStatsD.push()
+			err = dogStatsD.push()
+			testCase.assertions(t, dogStatsD, receiveDogStatsDLines(t, conn), err)
+		})
+	}
+}
+
+// requireDogStatsDPushed asserts that the metrics from newTestOTLPRegistry
+// were pushed successfully twice and converted correctly.
+func requireDogStatsDPushed(
+	t *testing.T,
+	dogStatsD *dogStatsDPusher,
+	lines []string,
+	err error,
+) {
+	require.NoError(t, err)
+	require.Equal(
+		t,
+		2.0,
+		testutil.ToFloat64(
+			dogStatsD.pushes.With(
+				prometheus.Labels{"target": "dogstatsd", "result": "success"},
+			),
+		),
+	)
+	require.Equal(
+		t,
+		[]string{
+			// First push
+			"brigade.test_temperature:21.5|g|#cluster:foo",
+			// Second push
+			"brigade.test_latency_seconds_count:0|c|#cluster:foo",
+			"brigade.test_latency_seconds_sum:0|c|#cluster:foo",
+			"brigade.test_requests_total:0|c|#code:200,cluster:foo",
+			"brigade.test_temperature:21.5|g|#cluster:foo",
+		},
+		lines,
+	)
+}
+
+// receiveDogStatsDLines returns the lines of every packet received on the
+// provided connection, if any, until no more arrive.
+func receiveDogStatsDLines(t *testing.T, conn net.PacketConn) []string {
+	if conn == nil {
+		return nil
+	}
+	var lines []string
+	buf := make([]byte, 65536)
+	for {
+		err := conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		require.NoError(t, err)
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return lines
+		}
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+}
+
+func TestDogStatsDLines(t *testing.T) {
+	families := []*dto.MetricFamily{
+		{
+			Name: proto.String("brigade_workers"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label: []*dto.LabelPair{
+						{Name: proto.String("phase"), Value: proto.String("running")},
+						{Name: proto.String("project"), Value: proto.String("a|b,c#d")},
+					},
+					Gauge: &dto.Gauge{Value: proto.Float64(2)},
+				},
+				{
+					Gauge: &dto.Gauge{Value: proto.Float64(math.NaN())},
+				},
+			},
+		},
+		{
+			Name: proto.String("brigade_events_total"),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label: []*dto.LabelPair{
+						{Name: proto.String("project"), Value: proto.String("foo")},
+					},
+					Counter: &dto.Counter{Value: proto.Float64(10)},
+				},
+				{
+					Label: []*dto.LabelPair{
+						{Name: proto.String("project"), Value: proto.String("bar")},
+					},
+					Counter: &dto.Counter{Value: proto.Float64(2)},
+				},
+				{
+					Label: []*dto.LabelPair{
+						{Name: proto.String("project"), Value: proto.String("bat")},
+					},
+					Counter: &dto.Counter{Value: proto.Float64(1)},
+				},
+			},
+		},
+	}
+	lines, counters := dogStatsDLines(
+		families,
+		dogStatsDOptions{tags: map[string]string{"project": "x", "env": "y"}},
+		map[string]float64{
+			"brigade_events_total|#project:foo,env:y": 4,
+			// The counter was reset since
+			"brigade_events_total|#project:bar,env:y": 5,
+		},
+	)
+	require.Equal(
+		t,
+		[]string{
+			// Labels take precedence over tags and delimiters are replaced
+			"brigade_workers:2|g|#phase:running,project:a_b_c_d,env:y",
+			"brigade_events_total:6|c|#project:foo,env:y",
+			"brigade_events_total:2|c|#project:bar,env:y",
+			// The bat counter wasn't seen before, so it isn't sent yet
+		},
+		lines,
+	)
+	require.Equal(
+		t,
+		map[string]float64{
+			"brigade_events_total|#project:foo,env:y": 10,
+			"brigade_events_total|#project:bar,env:y": 2,
+			"brigade_events_total|#project:bat,env:y": 1,
+		},
+		counters,
+	)
+}
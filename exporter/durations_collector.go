@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/brigadecore/brigade/sdk/v2"
+	"github.com/brigadecore/brigade/sdk/v2/core"
+	"github.com/brigadecore/brigade/sdk/v2/meta"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// durationBuckets are the histogram buckets used for worker and job durations
+// and for queue waits. They range from one second to a little over two hours.
+var durationBuckets = prometheus.ExponentialBuckets(1, 2, 14)
+
+// durationsLookback is how far before the watermark the durations collector
+// looks for finished workers it hasn't yet observed. Workers whose events only
+// become visible longer than this after they were created, and that finish
+// before they're first listed, are never observed.
+const durationsLookback = time.Minute
+
+// durationsCollector produces the worker duration, job duration, and queue
+// wait histograms. It iterates over all unfinished workers to observe how
+// long each newly started worker waited in the queue and to track those
+// workers so that the durations of those workers and their jobs can be
+// observed once they finish.
+//
+// Workers can also finish between cycles without ever being seen unfinished,
+// so like the events collector, it also lists finished workers, newest event
+// first, until events are older than the watermark, which is the creation time
+// of the newest such event seen so far, less durationsLookback, and observes
+// any not already observed. Finished workers that already existed when the
+// exporter first ran are not observed.
+type durationsCollector struct {
+	api             *apiCaller
+	workerDurations *prometheus.HistogramVec
+	jobDurations    *prometheus.HistogramVec
+	queueWaits      *prometheus.HistogramVec
+	// trackedWorkers maps the IDs of events whose workers have been seen
+	// unfinished but have not yet been seen finishing to what has already been
+	// observed about each. This ensures each finished worker and job is
+	// observed exactly once.
+	trackedWorkers map[string]*trackedWorker
+	// watermark is the creation time of the newest event with a finished worker
+	// seen so far. It is the zero time until the first successful cycle.
+	watermark time.Time
+	// observedWorkers maps the IDs of events created since durationsLookback
+	// before the watermark whose finished workers have already been observed
+	// to their creation times.
+	observedWorkers map[string]time.Time
+}
+
+// trackedWorker records what has already been observed about an unfinished
+// worker.
+type trackedWorker struct {
+	queueWaitObserved bool
+	// observedJobs holds the names of the worker's jobs whose durations have
+	// already been observed.
+	observedJobs map[string]struct{}
+}
+
+func newDurationsCollector(api *apiCaller) collector {
+	return &durationsCollector{
+		api: api,
+		workerDurations: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "brigade_worker_duration_seconds",
+				Help:    "Run duration of finished workers",
+				Buckets: durationBuckets,
+			},
+			[]string{"project", "workerPhase"},
+		),
+		jobDurations: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "brigade_job_duration_seconds",
+				Help:    "Run duration of finished jobs",
+				Buckets: durationBuckets,
+			},
+			[]string{"project", "jobPhase"},
+		),
+		queueWaits: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "brigade_worker_queue_wait_seconds",
+				Help:    "Time between an event's creation and its worker starting",
+				Buckets: durationBuckets,
+			},
+			[]string{"project"},
+		),
+		trackedWorkers:  map[string]*trackedWorker{},
+		observedWorkers: map[string]time.Time{},
+	}
+}
+
+func (d *durationsCollector) describe(ch chan<- *prometheus.Desc) {
+	d.workerDurations.Describe(ch)
+	d.jobDurations.Describe(ch)
+	d.queueWaits.Describe(ch)
+}
+
+func (d *durationsCollector) collect(
+	ctx context.Context,
+) ([]prometheus.Metric, error) {
+	unfinishedWorkers := map[string]struct{}{}
+	if err := forEachEvent(
+		ctx,
+		d.api,
+		core.EventsSelector{WorkerPhases: unfinishedWorkerPhases},
+		func(event core.Event) {
+			unfinishedWorkers[event.ID] = struct{}{}
+			worker := d.track(event.ID)
+			d.observeQueueWait(event, worker)
+			d.observeFinishedJobs(event, worker)
+		},
+	); err != nil {
+		return nil, err
+	}
+	if err := d.observeRecentlyFinishedWorkers(ctx); err != nil {
+		return nil, err
+	}
+	d.observeFinishedWorkers(ctx, unfinishedWorkers)
+	return freeze(d.workerDurations, d.jobDurations, d.queueWaits)
+}
+
+// track returns what has already been observed about the worker of the event
+// with the specified ID, tracking that worker if it isn't already.
+func (d *durationsCollector) track(eventID string) *trackedWorker {
+	worker, ok := d.trackedWorkers[eventID]
+	if !ok {
+		worker = &trackedWorker{observedJobs: map[string]struct{}{}}
+		d.trackedWorkers[eventID] = worker
+	}
+	return worker
+}
+
+// observeQueueWait observes the time that elapsed between the specified
+// event's creation and its worker starting, unless it has already been
+// observed or the worker hasn't started.
+func (d *durationsCollector) observeQueueWait(
+	event core.Event,
+	worker *trackedWorker,
+) {
+	if worker.queueWaitObserved || event.Created == nil ||
+		event.Worker.Status.Started == nil {
+		return
+	}
+	d.queueWaits.With(
+		prometheus.Labels{"project": event.ProjectID},
+	).Observe(event.Worker.Status.Started.Sub(*event.Created).Seconds())
+	worker.queueWaitObserved = true
+}
+
+// observeFinishedJobs observes the durations of any of the specified event's
+// jobs that have finished since the event was last examined.
+func (d *durationsCollector) observeFinishedJobs(
+	event core.Event,
+	worker *trackedWorker,
+) {
+	for _, job := range event.Worker.Jobs {
+		if _, ok := worker.observedJobs[job.Name]; ok {
+			continue
+		}
+		if job.Status == nil || !job.Status.Phase.IsTerminal() {
+			continue
+		}
+		// Jobs that never started (e.g. canceled ones) have no duration to
+		// observe, but are still marked as observed so they aren't re-examined.
+		if job.Status.Started != nil && job.Status.Ended != nil {
+			d.jobDurations.With(
+				prometheus.Labels{
+					"project":  event.ProjectID,
+					"jobPhase": string(job.Status.Phase),
+				},
+			).Observe(job.Status.Ended.Sub(*job.Status.Started).Seconds())
+		}
+		worker.observedJobs[job.Name] = struct{}{}
+	}
+}
+
+// observeRecentlyFinishedWorkers lists finished workers whose events were
+// created since durationsLookback before the watermark and observes any not
+// already observed. During the first cycle, only workers that were seen
+// unfinished are observed.
+func (d *durationsCollector) observeRecentlyFinishedWorkers(
+	ctx context.Context,
+) error {
+	initializing := d.watermark.IsZero()
+	watermark := d.watermark
+	if initializing {
+		watermark = time.Now()
+	}
+	cutoff := watermark.Add(-durationsLookback)
+	if err := forEachEventWhile(
+		ctx,
+		d.api,
+		core.EventsSelector{WorkerPhases: finishedWorkerPhases},
+		func(event core.Event) bool {
+			if event.Created == nil {
+				return true
+			}
+			created := *event.Created
+			if created.Before(cutoff) {
+				return false
+			}
+			if created.After(watermark) {
+				watermark = created
+			}
+			if _, ok := d.observedWorkers[event.ID]; ok {
+				return true
+			}
+			if _, ok := d.trackedWorkers[event.ID]; ok || !initializing {
+				d.observeFinishedWorker(event)
+			} else {
+				d.observedWorkers[event.ID] = created
+			}
+			return true
+		},
+	); err != nil {
+		return err
+	}
+	// Forget workers that no subsequent cycle will list
+	cutoff = watermark.Add(-durationsLookback)
+	for id, created := range d.observedWorkers {
+		if created.Before(cutoff) {
+			delete(d.observedWorkers, id)
+		}
+	}
+	d.watermark = watermark
+	return nil
+}
+
+// observeFinishedWorkers examines every tracked worker that is no longer
+// unfinished and, if it has finished, observes it. Workers that have finished
+// or whose events no longer exist are no longer tracked afterwards.
+func (d *durationsCollector) observeFinishedWorkers(
+	ctx context.Context,
+	unfinishedWorkers map[string]struct{},
+) {
+	for eventID := range d.trackedWorkers {
+		if _, ok := unfinishedWorkers[eventID]; ok {
+			continue
+		}
+		var event core.Event
+		if err := d.api.call(
+			ctx,
+			"events.get",
+			func(ctx context.Context, client sdk.APIClient) (err error) {
+				event, err = client.Core().Events().Get(ctx, eventID)
+				return err
+			},
+		); err != nil {
+			if _, ok := errors.Cause(err).(*meta.ErrNotFound); ok {
+				delete(d.trackedWorkers, eventID)
+			} else {
+				log.Println(err)
+			}
+			continue
+		}
+		if event.Worker == nil || !event.Worker.Status.Phase.IsTerminal() {
+			continue
+		}
+		d.observeFinishedWorker(event)
+	}
+}
+
+// observeFinishedWorker observes the specified event's finished worker's
+// duration, as well as its queue wait and the durations of its jobs, unless
+// already observed. The worker is no longer tracked afterwards, but is
+// remembered as observed.
+func (d *durationsCollector) observeFinishedWorker(event core.Event) {
+	worker := d.track(event.ID)
+	d.observeQueueWait(event, worker)
+	d.observeFinishedJobs(event, worker)
+	status := event.Worker.Status
+	if status.Started != nil && status.Ended != nil {
+		d.workerDurations.With(
+			prometheus.Labels{
+				"project":     event.ProjectID,
+				"workerPhase": string(status.Phase),
+			},
+		).Observe(status.Ended.Sub(*status.Started).Seconds())
+	}
+	delete(d.trackedWorkers, event.ID)
+	if event.Created != nil {
+		d.observedWorkers[event.ID] = *event.Created
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/brigadecore/brigade/sdk/v2/core"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// eventsLookback is how far before the watermark the events collector looks
+// for events it hasn't yet counted. Events that only become visible longer
+// than this after they were created are never counted.
+const eventsLookback = time.Minute
+
+// eventKey identifies a series of brigade_events_created_total.
+type eventKey struct {
+	source    string
+	eventType string
+	project   string
+}
+
+// eventsCollector produces brigade_events_created_total. Events are listed
+// newest first, so each cycle lists events only until they are older than
+// the watermark, which is the creation time of the newest event seen so far,
+// less eventsLookback. To count each event exactly once, the IDs of events
+// created since then are remembered, so memory use is bounded by the rate at
+// which events are created rather than by the total number of events.
+//
+// Events that already existed when the exporter first ran are not counted.
+// If a state path is configured, the watermark, remembered IDs, and counts are
+// persisted there after every cycle, so counts survive restarts and events
+// created while the exporter was down are still counted.
+type eventsCollector struct {
+	api               *apiCaller
+	eventsCreatedDesc *prometheus.Desc
+	statePath         string
+	// watermark is the creation time of the newest event seen so far. It is
+	// the zero time until the first successful cycle.
+	watermark time.Time
+	// seen maps the IDs of events created since eventsLookback before the
+	// watermark to their creation times.
+	seen   map[string]time.Time
+	counts map[eventKey]float64
+}
+
+func newEventsCollector(api *apiCaller) collector {
+	return &eventsCollector{
+		api: api,
+		eventsCreatedDesc: prometheus.NewDesc(
+			"brigade_events_created_total",
+			"Events created, by source, type, and project",
+			[]string{"source", "type", "project"},
+			nil,
+		),
+		seen:   map[string]time.Time{},
+		counts: map[eventKey]float64{},
+	}
+}
+
+func (e *eventsCollector) describe(ch chan<- *prometheus.Desc) {
+	ch <- e.eventsCreatedDesc
+}
+
+// configure sets the path state is persisted to. If the collector hasn't yet
+// completed a cycle, state is loaded from that path, if it exists.
+func (e *eventsCollector) configure(options collectorOptions) {
+	e.statePath = options.eventsStatePath
+	if e.statePath == "" || !e.watermark.IsZero() {
+		return
+	}
+	if err := e.loadState(); err != nil {
+		log.Println(errors.Wrap(err, "error loading events collector state"))
+	}
+}
+
+func (e *eventsCollector) collect(
+	ctx context.Context,
+) ([]prometheus.Metric, error) {
+	// Nothing is updated until every event has been listed, so that a failed
+	// cycle changes nothing
+	initializing := e.watermark.IsZero()
+	watermark := e.watermark
+	if initializing {
+		watermark = time.Now()
+	}
+	cutoff := watermark.Add(-eventsLookback)
+	seen := map[string]time.Time{}
+	counts := map[eventKey]float64{}
+	for key, count := range e.counts {
+		counts[key] = count
+	}
+	if err := forEachEventWhile(
+		ctx,
+		e.api,
+		core.EventsSelector{WorkerPhases: allWorkerPhases()},
+		func(event core.Event) bool {
+			if event.Created == nil {
+				return true
+			}
+			created := *event.Created
+			if created.Before(cutoff) {
+				return false
+			}
+			seen[event.ID] = created
+			if created.After(watermark) {
+				watermark = created
+			}
+			if _, ok := e.seen[event.ID]; !ok && !initializing {
+				counts[eventKey{
+					source:    event.Source,
+					eventType: event.Type,
+					project:   event.ProjectID,
+				}]++
+			}
+			return true
+		},
+	); err != nil {
+		return nil, err
+	}
+	// Forget events that no subsequent cycle will list
+	cutoff = watermark.Add(-eventsLookback)
+	for id, created := range seen {
+		if created.Before(cutoff) {
+			delete(seen, id)
+		}
+	}
+	e.watermark = watermark
+	e.seen = seen
+	e.counts = counts
+	if e.statePath != "" {
+		if err := e.saveState(); err != nil {
+			log.Println(errors.Wrap(err, "error saving events collector state"))
+		}
+	}
+	metrics := make([]prometheus.Metric, 0, len(e.counts))
+	for key, count := range e.counts {
+		metrics = append(
+			metrics,
+			prometheus.MustNewConstMetric(
+				e.eventsCreatedDesc,
+				prometheus.CounterValue,
+				count,
+				key.source,
+				key.eventType,
+				key.project,
+			),
+		)
+	}
+	return metrics, nil
+}
+
+// eventsState is the persisted form of an eventsCollector's state.
+type eventsState struct {
+	Watermark time.Time            `json:"watermark"`
+	Seen      map[string]time.Time `json:"seen"`
+	Counts    []eventCount         `json:"counts"`
+}
+
+// eventCount is the persisted form of a single series of
+// brigade_events_created_total.
+type eventCount struct {
+	Source  string  `json:"source"`
+	Type    string  `json:"type"`
+	Project string  `json:"project"`
+	Count   float64 `json:"count"`
+}
+
+// loadState replaces the collector's state with that persisted at its state
+// path, if the file exists.
+func (e *eventsCollector) loadState() error {
+	data, err := ioutil.ReadFile(e.statePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error reading %s", e.statePath)
+	}
+	state := eventsState{}
+	if err = json.Unmarshal(data, &state); err != nil {
+		return errors.Wrapf(err, "error parsing %s", e.statePath)
+	}
+	e.watermark = state.Watermark
+	e.seen = state.Seen
+	if e.seen == nil {
+		e.seen = map[string]time.Time{}
+	}
+	e.counts = map[eventKey]float64{}
+	for _, count := range state.Counts {
+		e.counts[eventKey{
+			source:    count.Source,
+			eventType: count.Type,
+			project:   count.Project,
+		}] = count.Count
+	}
+	return nil
+}
+
+// saveState persists the collector's state to its state path. The file is
+// replaced atomically, so a crash can't leave it partially written.
+func (e *eventsCollector) saveState() error {
+	state := eventsState{
+		Watermark: e.watermark,
+		Seen:      e.seen,
+		Counts:    make([]eventCount, 0, len(e.counts)),
+	}
+	for key, count := range e.counts {
+		state.Counts = append(
+			state.Counts,
+			eventCount{
+				Source:  key.source,
+				Type:    key.eventType,
+				Project: key.project,
+				Count:   count,
+			},
+		)
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling state")
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(e.statePath), ".events-state-")
+	if err != nil {
+		return errors.Wrap(err, "error creating temporary state file")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "error writing %s", tmp.Name())
+	}
+	if err = tmp.Close(); err != nil {
+		return errors.Wrapf(err, "error writing %s", tmp.Name())
+	}
+	return errors.Wrapf(
+		os.Rename(tmp.Name(), e.statePath),
+		"error replacing %s",
+		e.statePath,
+	)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// frozenMetric is a prometheus.Metric whose value was captured at a single
+// point in time and never changes afterwards. This permits metrics that are
+// normally live, such as histograms, to be included in a consistent snapshot.
+type frozenMetric struct {
+	desc   *prometheus.Desc
+	metric *dto.Metric
+}
+
+func (f *frozenMetric) Desc() *prometheus.Desc {
+	return f.desc
+}
+
+func (f *frozenMetric) Write(out *dto.Metric) error {
+	out.Label = f.metric.Label
+	out.Gauge = f.metric.Gauge
+	out.Counter = f.metric.Counter
+	out.Summary = f.metric.Summary
+	out.Untyped = f.metric.Untyped
+	out.Histogram = f.metric.Histogram
+	out.TimestampMs = f.metric.TimestampMs
+	return nil
+}
+
+// freeze returns frozen copies of all metrics currently produced by the
+// provided collectors.
+func freeze(collectors ...prometheus.Collector) ([]prometheus.Metric, error) {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		for _, collector := range collectors {
+			collector.Collect(ch)
+		}
+		close(ch)
+	}()
+	metrics := []prometheus.Metric{}
+	var err error
+	for metric := range ch {
+		frozen := &frozenMetric{
+			desc:   metric.Desc(),
+			metric: &dto.Metric{},
+		}
+		// Keep draining the channel after an error so the goroutine above can
+		// finish.
+		if writeErr := metric.Write(frozen.metric); writeErr != nil {
+			err = writeErr
+			continue
+		}
+		metrics = append(metrics, frozen)
+	}
+	return metrics, err
+}
@@ -0,0 +1,277 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// AuthConfig represents configuration for authenticating requests to an
+// HTTP/S server. If neither path is specified, requests are not authenticated.
+type AuthConfig struct {
+	// BearerTokensPath is the path to a file containing the bearer tokens that
+	// are accepted, one per line. Blank lines are ignored.
+	BearerTokensPath string
+	// WebConfigPath is the path to a file in the format of Prometheus' web
+	// configuration file. Only basic_auth_users, which maps usernames to bcrypt
+	// hashes of their passwords, is supported. Other keys are ignored.
+	WebConfigPath string
+}
+
+// dummyHash is a bcrypt hash, of the same cost as bcrypt.DefaultCost, that
+// passwords for unknown users are compared against, so that the time taken to
+// reject them doesn't reveal which usernames exist.
+const dummyHash = "$2a$10$EjIf4WXS9htA6xZnJ/PFSOAEmugUdlNGQ1Ft9vGYLcmHq6/kPzOUO" // nolint: lll
+
+// maxVerifiedCredentials is the most basic auth credentials that are
+// remembered as valid, so that clients scraping frequently don't pay the cost
+// of bcrypt on every request.
+const maxVerifiedCredentials = 100
+
+// basicAuthUsersKey is the only key of Prometheus' web configuration file that
+// is supported.
+const basicAuthUsersKey = "basic_auth_users"
+
+// Authenticator is HTTP middleware that permits only requests bearing one of
+// a set of static bearer tokens or valid basic auth credentials. It is
+// applied to individual routes so that others, such as health checks, can
+// remain open.
+type Authenticator struct {
+	// mu guards bearerTokens and basicAuthUsers.
+	mu           sync.RWMutex
+	bearerTokens [][]byte
+	// basicAuthUsers maps usernames to bcrypt hashes of their passwords.
+	basicAuthUsers map[string][]byte
+
+	// verifiedMu guards verified.
+	verifiedMu sync.Mutex
+	// verified holds a digest of each username, hash, and password that were
+	// found to match, rather than the password itself.
+	verified map[[sha256.Size]byte]struct{}
+}
+
+// NewAuthenticator returns an Authenticator that accepts the credentials
+// loaded from the files specified by the provided configuration.
+func NewAuthenticator(config AuthConfig) (*Authenticator, error) {
+	a := &Authenticator{}
+	return a, a.Reload(config)
+}
+
+// Reload replaces the credentials the Authenticator accepts with those loaded
+// from the files specified by the provided configuration. If any file cannot
+// be loaded, the current credentials are retained.
+func (a *Authenticator) Reload(config AuthConfig) error {
+	var bearerTokens [][]byte
+	var err error
+	if config.BearerTokensPath != "" {
+		bearerTokens, err = loadBearerTokens(config.BearerTokensPath)
+		if err != nil {
+			return err
+		}
+	}
+	var basicAuthUsers map[string][]byte
+	if config.WebConfigPath != "" {
+		basicAuthUsers, err = loadBasicAuthUsers(config.WebConfigPath)
+		if err != nil {
+			return err
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.bearerTokens = bearerTokens
+	a.basicAuthUsers = basicAuthUsers
+	a.verifiedMu.Lock()
+	a.verified = nil
+	a.verifiedMu.Unlock()
+	return nil
+}
+
+// loadBearerTokens returns the tokens in the file at the specified path.
+func loadBearerTokens(path string) ([][]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading bearer tokens file")
+	}
+	tokens := [][]byte{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if token := strings.TrimSpace(scanner.Text()); token != "" {
+			tokens = append(tokens, []byte(token))
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "error reading bearer tokens file")
+	}
+	if len(tokens) == 0 {
+		return nil, errors.Errorf("no bearer tokens found in %s", path)
+	}
+	return tokens, nil
+}
+
+// loadBasicAuthUsers returns the basic auth users from the web configuration
+// file at the specified path, mapped to bcrypt hashes of their passwords.
+func loadBasicAuthUsers(path string) (map[string][]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading web configuration file")
+	}
+	config := map[string]yaml.Node{}
+	if err = yaml.Unmarshal(data, &config); err != nil {
+		return nil, errors.Wrapf(
+			err,
+			"error parsing web configuration file %s",
+			path,
+		)
+	}
+	// A web configuration file shared with other exporters may well configure
+	// TLS and more, so rather than refusing the whole file, the rest is ignored
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		if key != basicAuthUsersKey {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		log.Printf(
+			"Ignoring unsupported key %q in web configuration file %s",
+			key,
+			path,
+		)
+	}
+	basicAuthUsers := map[string]string{}
+	if node, ok := config[basicAuthUsersKey]; ok {
+		if err = node.Decode(&basicAuthUsers); err != nil {
+			return nil, errors.Wrapf(
+				err,
+				"error parsing %s in web configuration file %s",
+				basicAuthUsersKey,
+				path,
+			)
+		}
+	}
+	users := map[string][]byte{}
+	for username, hash := range basicAuthUsers {
+		if _, err = bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, errors.Wrapf(
+				err,
+				"invalid bcrypt hash for basic auth user %q",
+				username,
+			)
+		}
+		users[username] = []byte(hash)
+	}
+	return users, nil
+}
+
+// Require returns an http.Handler that passes authenticated requests to the
+// provided handler and responds to all others with a 401. If the
+// Authenticator has no credentials, all requests are passed through.
+func (a *Authenticator) Require(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.mu.RLock()
+		bearerTokens := a.bearerTokens
+		basicAuthUsers := a.basicAuthUsers
+		a.mu.RUnlock()
+		if len(bearerTokens) == 0 && len(basicAuthUsers) == 0 {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if a.authenticated(r, bearerTokens, basicAuthUsers) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if len(basicAuthUsers) > 0 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="brigade-metrics"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+		}
+		http.Error(
+			w,
+			http.StatusText(http.StatusUnauthorized),
+			http.StatusUnauthorized,
+		)
+	})
+}
+
+// authenticated returns whether the provided request bears one of the
+// specified bearer tokens or valid basic auth credentials for one of the
+// specified users.
+func (a *Authenticator) authenticated(
+	r *http.Request,
+	bearerTokens [][]byte,
+	basicAuthUsers map[string][]byte,
+) bool {
+	header := r.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		token := []byte(strings.TrimPrefix(header, "Bearer "))
+		var ok bool
+		// Every token is compared, so the time taken doesn't reveal which, if
+		// any, matched
+		for _, bearerToken := range bearerTokens {
+			if subtle.ConstantTimeCompare(token, bearerToken) == 1 {
+				ok = true
+			}
+		}
+		return ok
+	}
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	hash, knownUser := basicAuthUsers[username]
+	if !knownUser {
+		hash = []byte(dummyHash)
+	}
+	key := credentialsDigest(username, hash, password)
+	a.verifiedMu.Lock()
+	_, verified := a.verified[key]
+	a.verifiedMu.Unlock()
+	if verified {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil ||
+		!knownUser {
+		return false
+	}
+	a.verifiedMu.Lock()
+	defer a.verifiedMu.Unlock()
+	// Once full, the cache starts over rather than growing without bound
+	if a.verified == nil || len(a.verified) >= maxVerifiedCredentials {
+		a.verified = map[[sha256.Size]byte]struct{}{}
+	}
+	a.verified[key] = struct{}{}
+	return true
+}
+
+// credentialsDigest returns a SHA-256 digest of the provided username, bcrypt
+// hash, and password.
+func credentialsDigest(
+	username string,
+	hash []byte,
+	password string,
+) [sha256.Size]byte {
+	digest := sha256.New()
+	for _, part := range [][]byte{[]byte(username), hash, []byte(password)} {
+		// Lengths are included so that parts can't run into one another
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(part)))
+		digest.Write(length)
+		digest.Write(part)
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], digest.Sum(nil))
+	return sum
+}
@@ -0,0 +1,293 @@
+package http
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestNewAuthenticator(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	testCases := []struct {
+		name       string
+		setup      func() AuthConfig
+		assertions func(*Authenticator, error)
+	}{
+		{
+			name: "no credentials",
+			setup: func() AuthConfig {
+				return AuthConfig{}
+			},
+			assertions: func(a *Authenticator, err error) {
+				require.NoError(t, err)
+				require.Empty(t, a.bearerTokens)
+				require.Empty(t, a.basicAuthUsers)
+			},
+		},
+		{
+			name: "bearer tokens file not found",
+			setup: func() AuthConfig {
+				return AuthConfig{BearerTokensPath: "/app/tokens"}
+			},
+			assertions: func(_ *Authenticator, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "error reading bearer tokens file")
+			},
+		},
+		{
+			name: "bearer tokens file empty",
+			setup: func() AuthConfig {
+				return AuthConfig{BearerTokensPath: writeTempFile(t, "\n\n")}
+			},
+			assertions: func(_ *Authenticator, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "no bearer tokens found")
+			},
+		},
+		{
+			name: "web config file with unsupported keys",
+			setup: func() AuthConfig {
+				return AuthConfig{
+					WebConfigPath: writeTempFile(
+						t,
+						fmt.Sprintf(
+							"tls_server_config: {}\n"+
+								"http_server_config:\n  http2: false\n"+
+								"basic_auth_users:\n  prometheus: %s\n",
+							hash,
+						),
+					),
+				}
+			},
+			assertions: func(a *Authenticator, err error) {
+				require.NoError(t, err)
+				require.Equal(
+					t,
+					map[string][]byte{"prometheus": hash},
+					a.basicAuthUsers,
+				)
+			},
+		},
+		{
+			name: "web config file with invalid basic auth users",
+			setup: func() AuthConfig {
+				return AuthConfig{
+					WebConfigPath: writeTempFile(t, "basic_auth_users: [foo]\n"),
+				}
+			},
+			assertions: func(_ *Authenticator, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "error parsing basic_auth_users")
+			},
+		},
+		{
+			name: "web config file with invalid hash",
+			setup: func() AuthConfig {
+				return AuthConfig{
+					WebConfigPath: writeTempFile(
+						t,
+						"basic_auth_users:\n  prometheus: secret\n",
+					),
+				}
+			},
+			assertions: func(_ *Authenticator, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), `invalid bcrypt hash for basic auth`)
+			},
+		},
+		{
+			name: "success",
+			setup: func() AuthConfig {
+				return AuthConfig{
+					BearerTokensPath: writeTempFile(t, "foo\n\nbar\n"),
+					WebConfigPath: writeTempFile(
+						t,
+						fmt.Sprintf("basic_auth_users:\n  prometheus: %s\n", hash),
+					),
+				}
+			},
+			assertions: func(a *Authenticator, err error) {
+				require.NoError(t, err)
+				require.Equal(t, [][]byte{[]byte("foo"), []byte("bar")}, a.bearerTokens)
+				require.Equal(t, hash, a.basicAuthUsers["prometheus"])
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			a, err := NewAuthenticator(testCase.setup())
+			testCase.assertions(a, err)
+		})
+	}
+}
+
+func TestAuthenticatorRequire(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	testCases := []struct {
+		name          string
+		authenticator *Authenticator
+		setup         func(*http.Request)
+		assertions    func(*httptest.ResponseRecorder)
+	}{
+		{
+			name:          "no credentials configured",
+			authenticator: &Authenticator{},
+			setup:         func(*http.Request) {},
+			assertions: func(rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusOK, rr.Code)
+			},
+		},
+		{
+			name: "no credentials provided",
+			authenticator: &Authenticator{
+				basicAuthUsers: map[string][]byte{"prometheus": hash},
+			},
+			setup: func(*http.Request) {},
+			assertions: func(rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusUnauthorized, rr.Code)
+				require.Equal(
+					t,
+					`Basic realm="brigade-metrics"`,
+					rr.Header().Get("WWW-Authenticate"),
+				)
+			},
+		},
+		{
+			name: "invalid bearer token",
+			authenticator: &Authenticator{
+				bearerTokens: [][]byte{[]byte("foo")},
+			},
+			setup: func(r *http.Request) {
+				r.Header.Set("Authorization", "Bearer bar")
+			},
+			assertions: func(rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusUnauthorized, rr.Code)
+				require.Equal(t, "Bearer", rr.Header().Get("WWW-Authenticate"))
+			},
+		},
+		{
+			name: "valid bearer token",
+			authenticator: &Authenticator{
+				bearerTokens: [][]byte{[]byte("foo"), []byte("bar")},
+			},
+			setup: func(r *http.Request) {
+				r.Header.Set("Authorization", "Bearer bar")
+			},
+			assertions: func(rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusOK, rr.Code)
+			},
+		},
+		{
+			name: "unknown basic auth user",
+			authenticator: &Authenticator{
+				basicAuthUsers: map[string][]byte{"prometheus": hash},
+			},
+			setup: func(r *http.Request) {
+				r.SetBasicAuth("grafana", "secret")
+			},
+			assertions: func(rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusUnauthorized, rr.Code)
+			},
+		},
+		{
+			name: "unknown basic auth user with the dummy hash's password",
+			authenticator: &Authenticator{
+				basicAuthUsers: map[string][]byte{"prometheus": hash},
+			},
+			setup: func(r *http.Request) {
+				r.SetBasicAuth("grafana", "brigade-metrics-dummy")
+			},
+			assertions: func(rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusUnauthorized, rr.Code)
+			},
+		},
+		{
+			name: "wrong basic auth password",
+			authenticator: &Authenticator{
+				basicAuthUsers: map[string][]byte{"prometheus": hash},
+			},
+			setup: func(r *http.Request) {
+				r.SetBasicAuth("prometheus", "guess")
+			},
+			assertions: func(rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusUnauthorized, rr.Code)
+			},
+		},
+		{
+			name: "valid basic auth credentials",
+			authenticator: &Authenticator{
+				basicAuthUsers: map[string][]byte{"prometheus": hash},
+			},
+			setup: func(r *http.Request) {
+				r.SetBasicAuth("prometheus", "secret")
+			},
+			assertions: func(rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusOK, rr.Code)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			testCase.setup(req)
+			rr := httptest.NewRecorder()
+			testCase.authenticator.Require(&mockHandler{}).ServeHTTP(rr, req)
+			testCase.assertions(rr)
+		})
+	}
+}
+
+func TestAuthenticatorRequireRemembersVerifiedCredentials(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	config := AuthConfig{
+		WebConfigPath: writeTempFile(
+			t,
+			fmt.Sprintf("basic_auth_users:\n  prometheus: %s\n", hash),
+		),
+	}
+	a, err := NewAuthenticator(config)
+	require.NoError(t, err)
+	// serve returns the status code of a request with the provided password
+	serve := func(password string) int {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.SetBasicAuth("prometheus", password)
+		rr := httptest.NewRecorder()
+		a.Require(&mockHandler{}).ServeHTTP(rr, req)
+		return rr.Code
+	}
+	require.Equal(t, http.StatusOK, serve("secret"))
+	require.Len(t, a.verified, 1)
+	// Credentials are still accepted once remembered
+	require.Equal(t, http.StatusOK, serve("secret"))
+	require.Len(t, a.verified, 1)
+	// Invalid credentials aren't remembered
+	require.Equal(t, http.StatusUnauthorized, serve("wrong"))
+	require.Len(t, a.verified, 1)
+	// Reloading forgets everything that was remembered
+	require.NoError(t, a.Reload(config))
+	require.Empty(t, a.verified)
+}
+
+// writeTempFile writes the provided contents to a temporary file and returns
+// its path.
+func writeTempFile(t *testing.T, contents string) string {
+	t.Helper()
+	f, err := ioutil.TempFile("", "")
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteString(contents)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		os.Remove(f.Name())
+	})
+	return f.Name()
+}
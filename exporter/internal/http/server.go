@@ -2,9 +2,14 @@ package http
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -24,6 +29,50 @@ type ServerConfig struct {
 	// TLSKeyPath is the path to a PEM-encoded x509 private key that can be used
 	// for serving HTTPS.
 	TLSKeyPath string
+	// TLSClientAuth specifies whether the server requests and verifies client
+	// certificates when serving HTTPS. If unset, ClientAuthNone is used.
+	TLSClientAuth ClientAuthMode
+	// TLSClientCAPath is the path to a PEM-encoded bundle of x509 certificates
+	// for the CAs that client certificates are verified against. It is required
+	// unless TLSClientAuth is ClientAuthNone.
+	TLSClientCAPath string
+	// TLSCheckInterval specifies how often the certificate, key, and client CA
+	// files are checked for changes. Whenever any has changed, all are
+	// reloaded.
+	TLSCheckInterval time.Duration
+}
+
+// ClientAuthMode specifies whether an HTTPS server requests and verifies
+// client certificates.
+type ClientAuthMode string
+
+const (
+	// ClientAuthNone indicates that client certificates are not requested.
+	ClientAuthNone ClientAuthMode = "none"
+	// ClientAuthOptional indicates that client certificates are requested and
+	// verified if presented, but clients may connect without one.
+	ClientAuthOptional ClientAuthMode = "optional"
+	// ClientAuthRequired indicates that clients must present a valid
+	// certificate.
+	ClientAuthRequired ClientAuthMode = "required"
+)
+
+// tlsClientAuthType returns the tls.ClientAuthType corresponding to the
+// specified mode.
+func tlsClientAuthType(mode ClientAuthMode) (tls.ClientAuthType, error) {
+	switch mode {
+	case ClientAuthNone:
+		return tls.NoClientCert, nil
+	case ClientAuthOptional:
+		return tls.VerifyClientCertIfGiven, nil
+	case ClientAuthRequired:
+		return tls.RequireAndVerifyClientCert, nil
+	default:
+		return tls.NoClientCert, errors.Errorf(
+			"unrecognized TLS client authentication mode %q",
+			mode,
+		)
+	}
 }
 
 // Server is an interface for an HTTP/S server. This is an improvement over the
@@ -33,74 +82,152 @@ type Server interface {
 	// ListenAndServe runs the HTTP/S server until the provided context is
 	// canceled. This function always returns a non-nil error.
 	ListenAndServe(ctx context.Context) error
+	// Reload applies the provided configuration to the server. When TLS is
+	// enabled, the certificate and key are reloaded from the configured paths
+	// and, along with client authentication settings, are used for all
+	// subsequent TLS handshakes. Connections already
+	// established are unaffected. The port and whether TLS is enabled cannot be
+	// changed without a restart, so attempting to change either returns an
+	// error. A new TLSCheckInterval takes effect only after a restart.
+	Reload(config *ServerConfig) error
+	// CertificateExpiry returns the time at which the certificate currently
+	// being served expires, or the zero time if no certificate has been loaded.
+	CertificateExpiry() time.Time
 }
 
 // server
 type server struct {
-	config  ServerConfig
 	handler http.Handler
+	// mu guards config, tlsConfig, certificate, clientAuth, clientCAs, and
+	// modTimes.
+	mu     sync.RWMutex
+	config ServerConfig
+	// tlsConfig is the TLS configuration the server was started with, on which
+	// the configuration for each connection is based.
+	tlsConfig   *tls.Config
+	certificate *tls.Certificate
+	clientAuth  tls.ClientAuthType
+	clientCAs   *x509.CertPool
+	// modTimes maps the path of each TLS file that was loaded to its
+	// modification time when loaded.
+	modTimes map[string]time.Time
 }
 
 // NewServer returns a new HTTP/S server.
 func NewServer(handler http.Handler, config *ServerConfig) Server {
+	return &server{
+		config:  withDefaults(config),
+		handler: handler,
+	}
+}
+
+// withDefaults returns a copy of the provided configuration with defaults
+// applied to any unset options.
+func withDefaults(config *ServerConfig) ServerConfig {
 	if config == nil {
 		config = &ServerConfig{}
 	}
-	if config.Port == 0 {
-		config.Port = 8080
+	c := *config
+	if c.Port == 0 {
+		c.Port = 8080
 	}
-	return &server{
-		config:  *config,
-		handler: handler,
+	if c.TLSClientAuth == "" {
+		c.TLSClientAuth = ClientAuthNone
 	}
+	if c.TLSCheckInterval == 0 {
+		c.TLSCheckInterval = time.Minute
+	}
+	return c
 }
 
 func (s *server) ListenAndServe(ctx context.Context) error {
+	s.mu.RLock()
+	config := s.config
+	s.mu.RUnlock()
+
 	srv := &http.Server{
-		Addr:    fmt.Sprintf(":%d", s.config.Port),
+		Addr:    fmt.Sprintf(":%d", config.Port),
 		Handler: s.handler,
 	}
 
 	errCh := make(chan error)
 
-	if s.config.TLSEnabled {
-		if s.config.TLSCertPath == "" {
+	if config.TLSEnabled {
+		if config.TLSCertPath == "" {
 			return errors.New(
 				"TLS was enabled, but no certificate path was specified",
 			)
 		}
 
-		if s.config.TLSKeyPath == "" {
+		if config.TLSKeyPath == "" {
 			return errors.New(
 				"TLS was enabled, but no key path was specified",
 			)
 		}
 
-		ok, err := file.Exists(s.config.TLSCertPath)
+		ok, err := file.Exists(config.TLSCertPath)
 		if err != nil {
 			return errors.Wrap(err, "error checking for existence of TLS cert")
 		}
 		if !ok {
 			return errors.Errorf(
 				"no TLS certificate found at path %s",
-				s.config.TLSCertPath,
+				config.TLSCertPath,
 			)
 		}
 
-		if ok, err = file.Exists(s.config.TLSKeyPath); err != nil {
+		if ok, err = file.Exists(config.TLSKeyPath); err != nil {
 			return errors.Wrap(err, "error checking for existence of TLS key")
 		}
 		if !ok {
-			return errors.Errorf("no TLS key found at path %s", s.config.TLSKeyPath)
+			return errors.Errorf("no TLS key found at path %s", config.TLSKeyPath)
 		}
 
+		if config.TLSClientAuth != ClientAuthNone {
+			if config.TLSClientCAPath == "" {
+				return errors.New(
+					"TLS client authentication was enabled, but no client CA path " +
+						"was specified",
+				)
+			}
+			if ok, err = file.Exists(config.TLSClientCAPath); err != nil {
+				return errors.Wrap(
+					err,
+					"error checking for existence of TLS client CA",
+				)
+			}
+			if !ok {
+				return errors.Errorf(
+					"no TLS client CA found at path %s",
+					config.TLSClientCAPath,
+				)
+			}
+		}
+
+		if err = s.loadTLSFiles(config); err != nil {
+			return err
+		}
+		srv.TLSConfig = &tls.Config{
+			GetCertificate:     s.getCertificate,
+			GetConfigForClient: s.getConfigForClient,
+			// srv sets up these protocols on its own copy of this configuration,
+			// which getConfigForClient can't see, so they're set here too
+			NextProtos: []string{"h2", "http/1.1"},
+		}
+		s.mu.Lock()
+		s.tlsConfig = srv.TLSConfig
+		s.mu.Unlock()
+		go s.watchTLSFiles(ctx, config.TLSCheckInterval)
+
 		log.Printf(
 			"Server is listening with TLS enabled on 0.0.0.0:%d",
-			s.config.Port,
+			config.Port,
 		)
 
 		go func() {
-			err := srv.ListenAndServeTLS(s.config.TLSCertPath, s.config.TLSKeyPath)
+			// The certificate is provided by srv.TLSConfig.GetCertificate, so no
+			// paths are specified here
+			err := srv.ListenAndServeTLS("", "")
 			select {
 			case errCh <- err:
 			case <-ctx.Done():
@@ -109,7 +236,7 @@ func (s *server) ListenAndServe(ctx context.Context) error {
 	} else {
 		log.Printf(
 			"Server is listening without TLS on 0.0.0.0:%d",
-			s.config.Port,
+			config.Port,
 		)
 
 		go func() {
@@ -133,3 +260,165 @@ func (s *server) ListenAndServe(ctx context.Context) error {
 		return ctx.Err()
 	}
 }
+
+func (s *server) Reload(config *ServerConfig) error {
+	c := withDefaults(config)
+	s.mu.RLock()
+	current := s.config
+	s.mu.RUnlock()
+	if c.Port != current.Port {
+		return errors.New("the server's port cannot be changed without a restart")
+	}
+	if c.TLSEnabled != current.TLSEnabled {
+		return errors.New(
+			"TLS cannot be enabled or disabled without a restart",
+		)
+	}
+	if c.TLSEnabled {
+		if err := s.loadTLSFiles(c); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = c
+	return nil
+}
+
+func (s *server) CertificateExpiry() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.certificate == nil || s.certificate.Leaf == nil {
+		return time.Time{}
+	}
+	return s.certificate.Leaf.NotAfter
+}
+
+// watchTLSFiles checks the certificate, key, and client CA files for changes
+// at the specified interval, reloading them whenever any has changed, until
+// the provided context is canceled. Files are compared by modification time,
+// which also detects the symlink swaps used to update mounted Kubernetes
+// secrets, since os.Stat follows symlinks.
+func (s *server) watchTLSFiles(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.RLock()
+			config := s.config
+			modTimes := s.modTimes
+			s.mu.RUnlock()
+			var changed bool
+			for _, path := range tlsFilePaths(config) {
+				info, err := os.Stat(path)
+				if err != nil {
+					log.Println(errors.Wrapf(err, "error checking TLS file %s", path))
+					continue
+				}
+				if !info.ModTime().Equal(modTimes[path]) {
+					changed = true
+				}
+			}
+			if !changed {
+				continue
+			}
+			// If the files are updated one at a time, the certificate and key may
+			// not match when loaded. In that case, the current ones are kept and
+			// loading is retried when next checked.
+			if err := s.loadTLSFiles(config); err != nil {
+				log.Println(err)
+				continue
+			}
+			log.Println("Reloaded TLS files")
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// tlsFilePaths returns the paths of all TLS files used by the provided
+// configuration.
+func tlsFilePaths(config ServerConfig) []string {
+	paths := []string{config.TLSCertPath, config.TLSKeyPath}
+	if config.TLSClientAuth != ClientAuthNone {
+		paths = append(paths, config.TLSClientCAPath)
+	}
+	return paths
+}
+
+// loadTLSFiles loads the certificate, key, and, if client authentication is
+// enabled, client CAs from the paths specified by the provided configuration
+// and makes them the server's own.
+func (s *server) loadTLSFiles(config ServerConfig) error {
+	clientAuth, err := tlsClientAuthType(config.TLSClientAuth)
+	if err != nil {
+		return err
+	}
+	// The files are examined before they are read so that any change made
+	// while they're being read is detected when they're next checked
+	modTimes := map[string]time.Time{}
+	for _, path := range tlsFilePaths(config) {
+		var info os.FileInfo
+		if info, err = os.Stat(path); err != nil {
+			return errors.Wrapf(err, "error checking TLS file %s", path)
+		}
+		modTimes[path] = info.ModTime()
+	}
+	cert, err := tls.LoadX509KeyPair(config.TLSCertPath, config.TLSKeyPath)
+	if err != nil {
+		return errors.Wrap(err, "error loading TLS certificate")
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return errors.Wrap(err, "error parsing TLS certificate")
+	}
+	var clientCAs *x509.CertPool
+	if config.TLSClientAuth != ClientAuthNone {
+		var caBytes []byte
+		if caBytes, err = ioutil.ReadFile(config.TLSClientCAPath); err != nil {
+			return errors.Wrap(err, "error reading TLS client CA")
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caBytes) {
+			return errors.Errorf(
+				"no PEM-encoded certificates found in TLS client CA %s",
+				config.TLSClientCAPath,
+			)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.certificate = &cert
+	s.clientAuth = clientAuth
+	s.clientCAs = clientCAs
+	s.modTimes = modTimes
+	return nil
+}
+
+// getConfigForClient returns the TLS configuration for a new connection: a
+// copy of the configuration the server was started with, with the server's
+// current client authentication settings. It is used as
+// tls.Config.GetConfigForClient so that reloaded settings take effect without
+// restarting the server.
+func (s *server) getConfigForClient(
+	*tls.ClientHelloInfo,
+) (*tls.Config, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	config := s.tlsConfig.Clone()
+	config.GetConfigForClient = nil
+	config.ClientAuth = s.clientAuth
+	config.ClientCAs = s.clientCAs
+	return config, nil
+}
+
+// getCertificate returns the server's current certificate. It is used as
+// tls.Config.GetCertificate so that a reloaded certificate takes effect
+// without restarting the server.
+func (s *server) getCertificate(
+	*tls.ClientHelloInfo,
+) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.certificate, nil
+}
@@ -4,12 +4,16 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"fmt"
 	"io/ioutil"
 	"math/big"
+	"net"
 	"net/http"
+	"os"
 	"testing"
 	"time"
 
@@ -136,6 +140,43 @@ func TestListenAndServe(t *testing.T) {
 				)
 			},
 		},
+		{
+			name: "TLS client auth enabled; missing client CA path",
+			setup: func() *ServerConfig {
+				certPath, keyPath := writeCert(t)
+				return &ServerConfig{
+					TLSEnabled:    true,
+					TLSCertPath:   certPath,
+					TLSKeyPath:    keyPath,
+					TLSClientAuth: ClientAuthRequired,
+				}
+			},
+			assertions: func(ctx context.Context, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "no client CA path was specified")
+			},
+		},
+		{
+			name: "TLS client auth enabled; invalid mode",
+			setup: func() *ServerConfig {
+				certPath, keyPath := writeCert(t)
+				return &ServerConfig{
+					TLSEnabled:      true,
+					TLSCertPath:     certPath,
+					TLSKeyPath:      keyPath,
+					TLSClientAuth:   "sometimes",
+					TLSClientCAPath: certPath,
+				}
+			},
+			assertions: func(ctx context.Context, err error) {
+				require.Error(t, err)
+				require.Contains(
+					t,
+					err.Error(),
+					"unrecognized TLS client authentication mode",
+				)
+			},
+		},
 		{
 			name: "TLS enabled; invalid cert",
 			setup: func() *ServerConfig {
@@ -212,11 +253,242 @@ func TestListenAndServe(t *testing.T) {
 	}
 }
 
+func TestListenAndServeClientAuth(t *testing.T) {
+	certPath, keyPath := writeCert(t)
+	// The client's self-signed certificate doubles as the client CA
+	clientCertPath, clientKeyPath := writeCert(t)
+	clientCert, err := tls.LoadX509KeyPair(clientCertPath, clientKeyPath)
+	require.NoError(t, err)
+	testCases := []struct {
+		name            string
+		clientAuth      ClientAuthMode
+		withClientCert  bool
+		expectConnected bool
+	}{
+		{
+			name:            "client auth required; no client cert",
+			clientAuth:      ClientAuthRequired,
+			expectConnected: false,
+		},
+		{
+			name:            "client auth required; valid client cert",
+			clientAuth:      ClientAuthRequired,
+			withClientCert:  true,
+			expectConnected: true,
+		},
+		{
+			name:            "client auth optional; no client cert",
+			clientAuth:      ClientAuthOptional,
+			expectConnected: true,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			port := freePort(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			s := NewServer(
+				&mockHandler{},
+				&ServerConfig{
+					Port:            port,
+					TLSEnabled:      true,
+					TLSCertPath:     certPath,
+					TLSKeyPath:      keyPath,
+					TLSClientAuth:   testCase.clientAuth,
+					TLSClientCAPath: clientCertPath,
+				},
+			)
+			go s.ListenAndServe(ctx) // nolint: errcheck
+			tlsConfig := &tls.Config{
+				InsecureSkipVerify: true, // nolint: gosec
+			}
+			if testCase.withClientCert {
+				tlsConfig.Certificates = []tls.Certificate{clientCert}
+			}
+			client := &http.Client{
+				Transport: &http.Transport{
+					TLSClientConfig:   tlsConfig,
+					ForceAttemptHTTP2: true,
+				},
+			}
+			url := fmt.Sprintf("https://localhost:%d", port)
+			// Wait for the server to start listening
+			require.Eventually(
+				t,
+				func() bool {
+					conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+					if err != nil {
+						return false
+					}
+					conn.Close()
+					return true
+				},
+				2*time.Second,
+				10*time.Millisecond,
+			)
+			resp, err := client.Get(url)
+			if testCase.expectConnected {
+				require.NoError(t, err)
+				resp.Body.Close()
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+				// HTTP/2 is still negotiated with client authentication settings
+				// applied to each connection
+				require.Equal(t, 2, resp.ProtoMajor)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+// freePort returns a TCP port that is not currently in use.
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestReload(t *testing.T) {
+	certPath, keyPath := writeCert(t)
+	testCases := []struct {
+		name       string
+		config     *ServerConfig
+		assertions func(s *server, err error)
+	}{
+		{
+			name:   "port changed",
+			config: &ServerConfig{Port: 1234},
+			assertions: func(_ *server, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "port cannot be changed")
+			},
+		},
+		{
+			name: "TLS disabled",
+			assertions: func(_ *server, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "TLS cannot be enabled or disabled")
+			},
+		},
+		{
+			name: "invalid cert",
+			config: &ServerConfig{
+				TLSEnabled:  true,
+				TLSCertPath: keyPath,
+				TLSKeyPath:  keyPath,
+			},
+			assertions: func(s *server, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "error loading TLS certificate")
+				// The previous configuration should be retained
+				require.Equal(t, certPath, s.config.TLSCertPath)
+			},
+		},
+		{
+			name: "cert reloaded",
+			config: &ServerConfig{
+				TLSEnabled:  true,
+				TLSCertPath: certPath,
+				TLSKeyPath:  keyPath,
+			},
+			assertions: func(s *server, err error) {
+				require.NoError(t, err)
+				cert, err := s.getCertificate(nil)
+				require.NoError(t, err)
+				require.NotNil(t, cert)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			s := NewServer(
+				nil,
+				&ServerConfig{
+					TLSEnabled:  true,
+					TLSCertPath: certPath,
+					TLSKeyPath:  keyPath,
+				},
+			).(*server)
+			err := s.Reload(testCase.config)
+			testCase.assertions(s, err)
+		})
+	}
+}
+
+func TestWatchTLSFiles(t *testing.T) {
+	certPath, keyPath := writeCert(t)
+	s := NewServer(
+		nil,
+		&ServerConfig{
+			TLSEnabled:  true,
+			TLSCertPath: certPath,
+			TLSKeyPath:  keyPath,
+		},
+	).(*server)
+	require.True(t, s.CertificateExpiry().IsZero())
+	require.NoError(t, s.loadTLSFiles(s.config))
+	require.False(t, s.CertificateExpiry().IsZero())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.watchTLSFiles(ctx, 10*time.Millisecond)
+
+	// Rotate the certificate
+	notAfter := time.Now().UTC().Add(30 * 24 * time.Hour).Truncate(time.Second)
+	cert, key := generateCertExpiring(t, notAfter)
+	require.NoError(t, ioutil.WriteFile(certPath, cert, 0600))
+	require.NoError(t, ioutil.WriteFile(keyPath, key, 0600))
+	// Ensure the modification times change even on file systems with coarse
+	// timestamps
+	modTime := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certPath, modTime, modTime))
+	require.NoError(t, os.Chtimes(keyPath, modTime, modTime))
+
+	require.Eventually(
+		t,
+		func() bool {
+			return s.CertificateExpiry().Equal(notAfter)
+		},
+		2*time.Second,
+		10*time.Millisecond,
+	)
+}
+
+// writeCert writes a PEM encoded, self-signed x.509v3 cert and corresponding
+// PEM encoded private key to temporary files and returns their paths.
+func writeCert(t *testing.T) (string, string) {
+	t.Helper()
+	cert, key := generateCert(t)
+
+	certFile, err := ioutil.TempFile("", "tls-*.crt")
+	require.NoError(t, err)
+	defer certFile.Close()
+	_, err = certFile.Write(cert)
+	require.NoError(t, err)
+
+	keyFile, err := ioutil.TempFile("", "tls-*.key")
+	require.NoError(t, err)
+	defer keyFile.Close()
+	_, err = keyFile.Write(key)
+	require.NoError(t, err)
+
+	return certFile.Name(), keyFile.Name()
+}
+
 // generateCert generates and returns a PEM encoded, self-signed x.509v3 cert
 // and corresponding PEM encoded private key. This cert and corresponding key
 // are adequate for test purposes.
 func generateCert(t *testing.T) ([]byte, []byte) {
 	t.Helper()
+	return generateCertExpiring(t, time.Now().UTC().Add(time.Hour*24))
+}
+
+// generateCertExpiring is like generateCert, but generates a cert that expires
+// at the specified time.
+func generateCertExpiring(t *testing.T, notAfter time.Time) ([]byte, []byte) {
+	t.Helper()
 
 	key, err := rsa.GenerateKey(rand.Reader, 4096)
 	require.NoError(t, err)
@@ -231,7 +503,7 @@ func generateCert(t *testing.T) ([]byte, []byte) {
 			CommonName: "localhost",
 		},
 		NotBefore: time.Now().UTC(),
-		NotAfter:  time.Now().UTC().Add(time.Hour * 24),
+		NotAfter:  notAfter,
 	}
 
 	certBytes, err := x509.CreateCertificate(
@@ -13,7 +13,9 @@ import (
 // program is terminated immediately with exit code 1.
 func Context() context.Context {
 	ctx, cancel := context.WithCancel(context.Background())
-	sigCh := make(chan os.Signal)
+	// signal.Notify does not block when sending to the channel, so it must be
+	// buffered to avoid missing a signal
+	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		sig := <-sigCh
@@ -28,3 +30,22 @@ func Context() context.Context {
 	}()
 	return ctx
 }
+
+// Reload returns a channel that receives a value whenever the SIGHUP signal is
+// caught, which conventionally requests that a program reload its
+// configuration. Signals caught while a previous one is still waiting to be
+// received are coalesced.
+func Reload() <-chan struct{} {
+	reloadCh := make(chan struct{}, 1)
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	go func() {
+		for range sigCh {
+			select {
+			case reloadCh <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return reloadCh
+}
@@ -21,3 +21,14 @@ func TestContext(t *testing.T) {
 		require.Fail(t, "SIGINT did not cancel context as expected")
 	}
 }
+
+func TestReload(t *testing.T) {
+	reloadCh := Reload()
+	err := syscall.Kill(syscall.Getpid(), syscall.SIGHUP)
+	require.NoError(t, err)
+	select {
+	case <-reloadCh:
+	case <-time.After(2 * time.Second):
+		require.Fail(t, "SIGHUP was not received as expected")
+	}
+}
@@ -1,16 +1,77 @@
 package system
 
 import (
+	"context"
+	"encoding/json"
 	"log"
 	"net/http"
 )
 
-// Healthz responds to an HTTP/S request with a 200 and content body "OK".
-func Healthz(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	if _, err := w.Write([]byte("ok")); err != nil {
-		log.Println(err)
+const (
+	// StatusOK is the status of a check that passed.
+	StatusOK = "ok"
+	// StatusFailed is the status of a check that failed.
+	StatusFailed = "failed"
+)
+
+// Check is a named check of some aspect of a process's health. Check functions
+// return an error describing the problem if the check fails.
+type Check struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// Status is the JSON body of a response from a handler returned by Handler.
+type Status struct {
+	// Status is StatusOK if every check passed and StatusFailed otherwise.
+	Status string        `json:"status"`
+	Checks []CheckStatus `json:"checks"`
+}
+
+// CheckStatus is the outcome of a single Check.
+type CheckStatus struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	// Error describes why the check failed, if it did.
+	Error string `json:"error,omitempty"`
+}
+
+// Handler returns an http.HandlerFunc that runs the provided checks, in order,
+// for each HTTP/S request and responds with a JSON body describing the outcome
+// of each. The response status is 200 if every check passed and 503 otherwise.
+func Handler(checks ...Check) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		status := Status{
+			Status: StatusOK,
+			Checks: make([]CheckStatus, len(checks)),
+		}
+		for i, check := range checks {
+			status.Checks[i] = CheckStatus{
+				Name:   check.Name,
+				Status: StatusOK,
+			}
+			if err := check.Check(r.Context()); err != nil {
+				status.Status = StatusFailed
+				status.Checks[i].Status = StatusFailed
+				status.Checks[i].Error = err.Error()
+			}
+		}
+		code := http.StatusOK
+		if status.Status != StatusOK {
+			code = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			log.Println(err)
+		}
 	}
 }
+
+// Healthz responds to an HTTP/S request with a 200 and a JSON body reporting
+// that the process is alive. It performs no checks, so it is suitable for
+// liveness probes.
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	Handler()(w, r)
+}
@@ -0,0 +1,96 @@
+package system
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler(t *testing.T) {
+	testCases := []struct {
+		name       string
+		checks     []Check
+		assertions func(*httptest.ResponseRecorder)
+	}{
+		{
+			name: "no checks",
+			assertions: func(rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusOK, rr.Code)
+				require.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+				require.JSONEq(t, `{"status":"ok","checks":[]}`, rr.Body.String())
+			},
+		},
+		{
+			name: "all checks pass",
+			checks: []Check{
+				{
+					Name:  "foo",
+					Check: func(context.Context) error { return nil },
+				},
+			},
+			assertions: func(rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusOK, rr.Code)
+				status := Status{}
+				require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &status))
+				require.Equal(
+					t,
+					Status{
+						Status: StatusOK,
+						Checks: []CheckStatus{{Name: "foo", Status: StatusOK}},
+					},
+					status,
+				)
+			},
+		},
+		{
+			name: "a check fails",
+			checks: []Check{
+				{
+					Name:  "foo",
+					Check: func(context.Context) error { return nil },
+				},
+				{
+					Name: "bar",
+					Check: func(context.Context) error {
+						return errors.New("something went wrong")
+					},
+				},
+			},
+			assertions: func(rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusServiceUnavailable, rr.Code)
+				status := Status{}
+				require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &status))
+				require.Equal(
+					t,
+					Status{
+						Status: StatusFailed,
+						Checks: []CheckStatus{
+							{Name: "foo", Status: StatusOK},
+							{
+								Name:   "bar",
+								Status: StatusFailed,
+								Error:  "something went wrong",
+							},
+						},
+					},
+					status,
+				)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			Handler(testCase.checks...)(
+				rr,
+				httptest.NewRequest(http.MethodGet, "/readyz", nil),
+			)
+			testCase.assertions(rr)
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/brigadecore/brigade/sdk/v2/core"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// jobPhasesAll returns every job phase. Unlike for worker phases, the Brigade
+// SDK provides no such list.
+func jobPhasesAll() []core.JobPhase {
+	return []core.JobPhase{
+		core.JobPhaseAborted,
+		core.JobPhaseCanceled,
+		core.JobPhaseFailed,
+		core.JobPhasePending,
+		core.JobPhaseRunning,
+		core.JobPhaseSchedulingFailed,
+		core.JobPhaseStarting,
+		core.JobPhaseSucceeded,
+		core.JobPhaseTimedOut,
+		core.JobPhaseUnknown,
+	}
+}
+
+// jobsCollector produces brigade_pending_jobs_total, brigade_jobs_by_phase,
+// brigade_jobs_by_project_and_phase, and brigade_jobs_by_sidecars.
+//
+// There is no way to query the API directly for Jobs, but only running Workers
+// should ever have Jobs that aren't finished, so we can iterate over running
+// Workers to count them. Note, there's a cap on the max number of workers that
+// can run concurrently, so we assume that as long as that cap isn't enormous
+// (which would only occur on an enormous cluster), it's practical to iterate
+// over all the running workers. All of these metrics therefore count only the
+// Jobs of running Workers, and brigade_jobs_by_project_and_phase includes only
+// projects that have running Workers.
+type jobsCollector struct {
+	api                       *apiCaller
+	totalPendingJobsDesc      *prometheus.Desc
+	jobsByPhaseDesc           *prometheus.Desc
+	jobsByProjectAndPhaseDesc *prometheus.Desc
+	jobsBySidecarsDesc        *prometheus.Desc
+}
+
+func newJobsCollector(api *apiCaller) collector {
+	return &jobsCollector{
+		api: api,
+		totalPendingJobsDesc: prometheus.NewDesc(
+			"brigade_pending_jobs_total",
+			"The total number of pending jobs",
+			nil,
+			nil,
+		),
+		jobsByPhaseDesc: prometheus.NewDesc(
+			"brigade_jobs_by_phase",
+			"Jobs of running workers separated by phase",
+			[]string{"jobPhase"},
+			nil,
+		),
+		jobsByProjectAndPhaseDesc: prometheus.NewDesc(
+			"brigade_jobs_by_project_and_phase",
+			"Jobs of running workers separated by project and phase",
+			[]string{"project", "jobPhase"},
+			nil,
+		),
+		jobsBySidecarsDesc: prometheus.NewDesc(
+			"brigade_jobs_by_sidecars",
+			"Jobs of running workers separated by whether they have sidecar "+
+				"containers in addition to their primary container",
+			[]string{"sidecars"},
+			nil,
+		),
+	}
+}
+
+func (j *jobsCollector) describe(ch chan<- *prometheus.Desc) {
+	ch <- j.totalPendingJobsDesc
+	ch <- j.jobsByPhaseDesc
+	ch <- j.jobsByProjectAndPhaseDesc
+	ch <- j.jobsBySidecarsDesc
+}
+
+func (j *jobsCollector) collect(
+	ctx context.Context,
+) ([]prometheus.Metric, error) {
+	jobsByPhase := map[core.JobPhase]int{}
+	jobsByProjectAndPhase := map[string]map[core.JobPhase]int{}
+	jobsBySidecars := map[bool]int{}
+	if err := forEachEvent(
+		ctx,
+		j.api,
+		core.EventsSelector{
+			WorkerPhases: []core.WorkerPhase{core.WorkerPhaseRunning},
+		},
+		func(event core.Event) {
+			if _, ok := jobsByProjectAndPhase[event.ProjectID]; !ok {
+				jobsByProjectAndPhase[event.ProjectID] = map[core.JobPhase]int{}
+			}
+			for _, job := range event.Worker.Jobs {
+				phase := core.JobPhaseUnknown
+				if job.Status != nil {
+					phase = job.Status.Phase
+				}
+				jobsByPhase[phase]++
+				jobsByProjectAndPhase[event.ProjectID][phase]++
+				jobsBySidecars[len(job.Spec.SidecarContainers) > 0]++
+			}
+		},
+	); err != nil {
+		return nil, err
+	}
+	metrics := []prometheus.Metric{
+		prometheus.MustNewConstMetric(
+			j.totalPendingJobsDesc,
+			prometheus.GaugeValue,
+			float64(jobsByPhase[core.JobPhasePending]),
+		),
+	}
+	for _, phase := range jobPhasesAll() {
+		metrics = append(
+			metrics,
+			prometheus.MustNewConstMetric(
+				j.jobsByPhaseDesc,
+				prometheus.GaugeValue,
+				float64(jobsByPhase[phase]),
+				string(phase),
+			),
+		)
+		for projectID, projectJobsByPhase := range jobsByProjectAndPhase {
+			metrics = append(
+				metrics,
+				prometheus.MustNewConstMetric(
+					j.jobsByProjectAndPhaseDesc,
+					prometheus.GaugeValue,
+					float64(projectJobsByPhase[phase]),
+					projectID,
+					string(phase),
+				),
+			)
+		}
+	}
+	for _, sidecars := range []bool{true, false} {
+		metrics = append(
+			metrics,
+			prometheus.MustNewConstMetric(
+				j.jobsBySidecarsDesc,
+				prometheus.GaugeValue,
+				float64(jobsBySidecars[sidecars]),
+				strconv.FormatBool(sidecars),
+			),
+		)
+	}
+	return metrics, nil
+}
@@ -1,13 +1,13 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"net/http"
 	"time"
 
 	"github.com/brigadecore/brigade/sdk/v2"
 	"github.com/gorilla/mux"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	libHTTP "github.com/willie-yao/brigade-metrics/exporter/internal/http"
 	"github.com/willie-yao/brigade-metrics/exporter/internal/signals"
 	"github.com/willie-yao/brigade-metrics/exporter/internal/system"
@@ -22,34 +22,120 @@ func main() {
 	)
 
 	ctx := signals.Context()
+	// SIGHUP is caught from the start, rather than once everything is running,
+	// so that a reload requested during startup doesn't terminate the exporter.
+	// Such a request is applied once startup completes.
+	reloadCh := signals.Reload()
 
+	configPath := flag.String(
+		"config",
+		"",
+		"path to a YAML or TOML configuration file",
+	)
+	flag.Parse()
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var api *apiCaller
+	var exporter *metricsExporter
 	{
-		address, token, opts, err := apiClientConfig()
-		if err != nil {
-			log.Fatal(err)
-		}
-		scrapeInterval, err := scrapeDuration()
-		if err != nil {
-			log.Fatal(err)
-		}
-		go newMetricsExporter(
-			sdk.NewAPIClient(address, token, &opts),
-			time.Duration(scrapeInterval),
-		).run(ctx)
+		opts := cfg.API.clientOptions()
+		api = newAPICaller(
+			sdk.NewAPIClient(cfg.API.Address, cfg.API.Token, &opts),
+			time.Duration(cfg.API.RequestTimeout),
+			cfg.API.MaxInFlight,
+			cfg.API.retryPolicy(),
+			cfg.API.circuitBreakerPolicy(),
+		)
+		exporter = newMetricsExporter(
+			api,
+			time.Duration(cfg.Scrape.Interval),
+			cfg.backgroundRefresh(),
+			cfg.Scrape.stalenessPolicy(),
+			cfg.Collectors.options(),
+			cfg.Collectors.names(),
+		)
+		go exporter.run(ctx)
 	}
 
+	readiness := newReadinessChecker(
+		api,
+		exporter,
+		time.Duration(cfg.Health.APIUnreachableTimeout),
+	)
+
 	var server libHTTP.Server
+	var authenticator *libHTTP.Authenticator
 	{
+		if authenticator, err =
+			libHTTP.NewAuthenticator(cfg.Auth.httpConfig()); err != nil {
+			log.Fatal(err)
+		}
 		router := mux.NewRouter()
 		router.StrictSlash(true)
-		router.Handle("/metrics", promhttp.Handler()).Methods(http.MethodGet)
+		router.Handle("/metrics", authenticator.Require(exporter.handler())).
+			Methods(http.MethodGet)
+		// /healthz and /readyz are deliberately left open for Kubernetes probes
 		router.HandleFunc("/healthz", system.Healthz).Methods(http.MethodGet)
-		serverConfig, err := serverConfig()
-		if err != nil {
-			log.Fatal(err)
-		}
+		router.HandleFunc("/readyz", readiness.handler()).Methods(http.MethodGet)
+		router.Handle("/version", authenticator.Require(versionHandler(api))).
+			Methods(http.MethodGet)
+		serverConfig := cfg.Server.httpConfig()
 		server = libHTTP.NewServer(router, &serverConfig)
+		if serverConfig.TLSEnabled {
+			exporter.registry.MustRegister(newCertificateExpiryGauge(server))
+		}
+	}
+
+	pushes := newPushesCounter()
+	exporter.registry.MustRegister(pushes)
+	otlp, err := newOTLPPusher(
+		exporter.registry,
+		pushes,
+		cfg.Push.OTLP.options(),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go otlp.run(ctx)
+	remoteWrite, err := newRemoteWritePusher(
+		exporter.registry,
+		pushes,
+		cfg.Push.RemoteWrite.options(),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	exporter.registry.MustRegister(
+		remoteWrite.droppedSamples,
+		remoteWrite.queuedSamples,
+	)
+	go remoteWrite.run(ctx)
+	dogStatsD, err := newDogStatsDPusher(
+		exporter.registry,
+		pushes,
+		cfg.Push.DogStatsD.options(),
+	)
+	if err != nil {
+		log.Fatal(err)
 	}
+	go dogStatsD.run(ctx)
+
+	go reloadOnSignal(
+		ctx,
+		reloadCh,
+		*configPath,
+		api,
+		exporter,
+		readiness,
+		server,
+		authenticator,
+		otlp,
+		remoteWrite,
+		dogStatsD,
+	)
 
 	log.Println(
 		server.ListenAndServe(signals.Context()),
@@ -3,179 +3,352 @@ package main
 import (
 	"context"
 	"log"
+	"net/http"
+	"sync"
 	"time"
 
-	"github.com/brigadecore/brigade/sdk/v2"
-	"github.com/brigadecore/brigade/sdk/v2/authn"
-	"github.com/brigadecore/brigade/sdk/v2/core"
-	"github.com/brigadecore/brigade/sdk/v2/meta"
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// stalenessPolicy determines when the metrics a failing collector produced
+// before it began failing are considered stale. Stale metrics are dropped
+// rather than served. Until then, they're carried over from cycle to cycle.
+type stalenessPolicy struct {
+	// maxFailedCycles is the number of consecutive cycles a collector may fail
+	// before its metrics are stale. Zero means any number.
+	maxFailedCycles int
+	// maxAge is how long after a collector last succeeded its metrics are
+	// stale. Zero means they never are.
+	maxAge time.Duration
+}
+
+// stale returns whether the metrics from a collector that has failed the
+// specified number of consecutive cycles and that last succeeded at the
+// specified time are stale.
+func (s stalenessPolicy) stale(failedCycles int, lastSuccess time.Time) bool {
+	return (s.maxFailedCycles > 0 && failedCycles >= s.maxFailedCycles) ||
+		(s.maxAge > 0 && time.Since(lastSuccess) > s.maxAge)
+}
+
+// metricsExporter is a prometheus.Collector that exposes metrics about a
+// Brigade installation. Metrics are gathered from the Brigade API by a set of
+// enabled collectors in collection cycles, each of which produces a consistent
+// snapshot that is served until the next cycle completes. Collectors run
+// concurrently within each cycle. By default, a cycle is run for every scrape.
+// If background refresh is enabled, cycles are instead run on a fixed
+// interval, which is useful when a cycle is too expensive to run for every
+// scrape. The exporter can be reconfigured while running.
 type metricsExporter struct {
-	apiClient            sdk.APIClient
-	scrapeInterval       time.Duration
-	totalProjects        prometheus.Gauge
-	totalUsers           prometheus.Gauge
-	totalServiceAccounts prometheus.Gauge
-	allWorkersByPhase    *prometheus.GaugeVec
-	totalPendingJobs     prometheus.Gauge
+	registry *prometheus.Registry
+	// available maps the name of every available collector to the collector
+	// itself. All are described, so that any of them can be enabled when the
+	// exporter is reconfigured, and each keeps its state while disabled.
+	available map[string]collector
+	// reconfigured receives a value whenever the exporter is reconfigured.
+	reconfigured chan struct{}
+
+	// configMu guards scrapeInterval, backgroundRefresh, and staleness.
+	configMu          sync.RWMutex
+	scrapeInterval    time.Duration
+	backgroundRefresh bool
+	staleness         stalenessPolicy
+
+	// scrapeDurations, scrapeErrors, lastSuccessfulScrapes, and collectorsUp
+	// describe the exporter's own operation. They are live metrics rather than
+	// part of the snapshot, but are emitted by Collect so that they always
+	// reflect the cycle a scrape may have just run.
+	scrapeDurations       *prometheus.GaugeVec
+	scrapeErrors          *prometheus.CounterVec
+	lastSuccessfulScrapes *prometheus.GaugeVec
+	collectorsUp          *prometheus.GaugeVec
+
+	// cycleMu serializes collection cycles. Collectors may keep state between
+	// cycles, so this also guards that state, as well as collectors.
+	cycleMu sync.Mutex
+	// collectors maps the name of each enabled collector to the collector
+	// itself.
+	collectors map[string]collector
+	// failedCycles maps the name of each collector to the number of
+	// consecutive cycles in which it has failed.
+	failedCycles map[string]int
+	// lastSuccesses maps the name of each collector that has ever succeeded to
+	// when it last did.
+	lastSuccesses map[string]time.Time
+
+	// snapshotMu guards snapshot and collected.
+	snapshotMu sync.RWMutex
+	// snapshot holds the metrics produced by the most recent collection cycle,
+	// keyed by the name of the collector that produced them.
+	snapshot map[string][]prometheus.Metric
+	// collected indicates whether any collector has ever succeeded.
+	collected bool
 }
 
+// newMetricsExporter returns a metricsExporter that uses the provided
+// apiCaller to gather metrics using the collectors with the specified names,
+// configured using the provided options, dropping their metrics once stale
+// according to the provided policy. All names must be keys of
+// collectorFactories.
 func newMetricsExporter(
-	apiClient sdk.APIClient,
+	api *apiCaller,
 	scrapeInterval time.Duration,
+	backgroundRefresh bool,
+	staleness stalenessPolicy,
+	options collectorOptions,
+	collectorNames []string,
 ) *metricsExporter {
-	return &metricsExporter{
-		apiClient:      apiClient,
-		scrapeInterval: scrapeInterval,
-		totalProjects: promauto.NewGauge(
-			prometheus.GaugeOpts{
-				Name: "brigade_projects_total",
-				Help: "The total number of brigade projects",
-			},
-		),
-		totalUsers: promauto.NewGauge(
+	m := &metricsExporter{
+		scrapeInterval:    scrapeInterval,
+		backgroundRefresh: backgroundRefresh,
+		staleness:         staleness,
+		registry:          prometheus.NewRegistry(),
+		available:         map[string]collector{},
+		reconfigured:      make(chan struct{}, 1),
+		collectors:        map[string]collector{},
+		failedCycles:      map[string]int{},
+		lastSuccesses:     map[string]time.Time{},
+		snapshot:          map[string][]prometheus.Metric{},
+		scrapeDurations: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
-				Name: "brigade_users_total",
-				Help: "The total number of users",
+				Name: "brigade_exporter_scrape_duration_seconds",
+				Help: "Duration of each collector's most recent collection",
 			},
+			[]string{"collector"},
 		),
-		totalServiceAccounts: promauto.NewGauge(
-			prometheus.GaugeOpts{
-				Name: "brigade_service_accounts_total",
-				Help: "The total number of service accounts",
+		scrapeErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "brigade_exporter_scrape_errors_total",
+				Help: "Failed collections by collector and reason",
 			},
+			[]string{"collector", "reason"},
 		),
-		allWorkersByPhase: promauto.NewGaugeVec(
+		lastSuccessfulScrapes: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
-				Name: "brigade_all_workers_by_phase",
-				Help: "All workers separated by phase",
+				Name: "brigade_exporter_last_successful_scrape_timestamp_seconds",
+				Help: "Unix time of each collector's most recent successful " +
+					"collection",
 			},
-			[]string{"workerPhase"},
+			[]string{"collector"},
 		),
-		totalPendingJobs: promauto.NewGauge(
+		collectorsUp: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
-				Name: "brigade_pending_jobs_total",
-				Help: "The total number of pending jobs",
+				Name: "brigade_exporter_collector_up",
+				Help: "Whether each collector's most recent collection succeeded " +
+					"(1) or failed (0)",
 			},
+			[]string{"collector"},
 		),
 	}
+	for name, newCollector := range collectorFactories {
+		m.available[name] = newCollector(api)
+	}
+	m.configureCollectors(options)
+	for _, name := range collectorNames {
+		m.collectors[name] = m.available[name]
+	}
+	m.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		newBuildInfoGauge(),
+		api.requests,
+		api.breaker.states,
+		m,
+	)
+	return m
+}
+
+// handler returns an http.Handler that serves the exporter's metrics.
+func (m *metricsExporter) handler() http.Handler {
+	return promhttp.InstrumentMetricHandler(
+		m.registry,
+		promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}),
+	)
 }
 
+// run performs a collection cycle at the configured interval, for as long as
+// background refresh is enabled, until the provided context is canceled.
+// Otherwise, cycles are driven by scrapes instead, except that until a
+// collection first succeeds, cycles are run on the configured interval
+// regardless. An exporter isn't ready until then, so it may not be scraped.
+// Whenever the exporter is reconfigured, the new configuration takes effect
+// immediately.
 func (m *metricsExporter) run(ctx context.Context) {
-	ticker := time.NewTicker(m.scrapeInterval)
-	defer ticker.Stop()
 	for {
+		m.configMu.RLock()
+		scrapeInterval := m.scrapeInterval
+		backgroundRefresh := m.backgroundRefresh
+		m.configMu.RUnlock()
+		// Receiving from a nil channel blocks forever, so otherwise, this waits
+		// only for reconfiguration or cancellation
+		var next <-chan time.Time
+		if backgroundRefresh || !m.hasCollected() {
+			m.refresh(ctx)
+			next = time.After(scrapeInterval)
+		}
 		select {
-		case <-ticker.C:
-			m.recordMetrics()
+		case <-next:
+		case <-m.reconfigured:
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func (m *metricsExporter) recordMetrics() {
-	// brigade_projects_total
-	projects, err := m.apiClient.Core().Projects().List(
-		context.Background(),
-		&core.ProjectsSelector{},
-		&meta.ListOptions{},
-	)
-	if err != nil {
-		log.Println(err)
-	} else {
-		m.totalProjects.Set(float64(len(projects.Items) +
-			int(projects.RemainingItemCount)))
+// reconfigure changes the exporter's scrape interval, whether background
+// refresh is enabled, its staleness policy, the collectors' options, and which
+// collectors are enabled. All names must be keys of collectorFactories. Any
+// collection cycle in progress completes using the previous configuration
+// first, so in-flight scrapes are not interrupted.
+func (m *metricsExporter) reconfigure(
+	scrapeInterval time.Duration,
+	backgroundRefresh bool,
+	staleness stalenessPolicy,
+	options collectorOptions,
+	collectorNames []string,
+) {
+	m.cycleMu.Lock()
+	m.configureCollectors(options)
+	m.collectors = map[string]collector{}
+	for _, name := range collectorNames {
+		m.collectors[name] = m.available[name]
+	}
+	// Stop serving metrics from collectors that are no longer enabled. The
+	// snapshot may still be in use by Collect, so it's replaced, not modified.
+	snapshot := map[string][]prometheus.Metric{}
+	for name, metrics := range m.snapshot {
+		if _, ok := m.collectors[name]; ok {
+			snapshot[name] = metrics
+		}
 	}
+	m.snapshotMu.Lock()
+	m.snapshot = snapshot
+	m.snapshotMu.Unlock()
+	m.cycleMu.Unlock()
 
-	// brigade_users_total
-	users, err := m.apiClient.Authn().Users().List(
-		context.Background(),
-		&authn.UsersSelector{},
-		&meta.ListOptions{},
-	)
-	if err != nil {
-		log.Println(err)
-	} else {
-		m.totalUsers.Set(float64(len(users.Items) +
-			int(users.RemainingItemCount)))
+	m.configMu.Lock()
+	m.scrapeInterval = scrapeInterval
+	m.backgroundRefresh = backgroundRefresh
+	m.staleness = staleness
+	m.configMu.Unlock()
+
+	select {
+	case m.reconfigured <- struct{}{}:
+	default:
 	}
+}
 
-	// brigade_service_accounts_total
-	serviceAccounts, err := m.apiClient.Authn().ServiceAccounts().List(
-		context.Background(),
-		&authn.ServiceAccountsSelector{},
-		&meta.ListOptions{},
-	)
-	if err != nil {
-		log.Println(err)
-	} else {
-		m.totalServiceAccounts.Set(
-			float64(
-				len(serviceAccounts.Items) +
-					int(serviceAccounts.RemainingItemCount),
-			),
-		)
+// configureCollectors applies the provided options to every available
+// collector that accepts them. Unless the exporter is being constructed, the
+// caller must hold m.cycleMu.
+func (m *metricsExporter) configureCollectors(options collectorOptions) {
+	for _, c := range m.available {
+		if configurable, ok := c.(configurableCollector); ok {
+			configurable.configure(options)
+		}
 	}
+}
 
-	// brigade_all_workers_by_phase
-	for _, phase := range core.WorkerPhasesAll() {
-		var events core.EventList
-		events, err = m.apiClient.Core().Events().List(
-			context.Background(),
-			&core.EventsSelector{
-				WorkerPhases: []core.WorkerPhase{phase},
-			},
-			&meta.ListOptions{},
-		)
-		if err != nil {
-			log.Println(err)
-		} else {
-			m.allWorkersByPhase.With(
-				prometheus.Labels{"workerPhase": string(phase)},
-			).Set(float64(len(events.Items) + int(events.RemainingItemCount)))
+// hasCollected returns whether any collector has ever succeeded.
+func (m *metricsExporter) hasCollected() bool {
+	m.snapshotMu.RLock()
+	defer m.snapshotMu.RUnlock()
+	return m.collected
+}
+
+// Describe implements prometheus.Collector.
+func (m *metricsExporter) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.available {
+		c.describe(ch)
+	}
+	m.scrapeDurations.Describe(ch)
+	m.scrapeErrors.Describe(ch)
+	m.lastSuccessfulScrapes.Describe(ch)
+	m.collectorsUp.Describe(ch)
+}
+
+// Collect implements prometheus.Collector. It emits the metrics from the most
+// recent collection cycle, first running a new cycle if background refresh is
+// not enabled.
+func (m *metricsExporter) Collect(ch chan<- prometheus.Metric) {
+	m.configMu.RLock()
+	backgroundRefresh := m.backgroundRefresh
+	m.configMu.RUnlock()
+	if !backgroundRefresh {
+		m.refresh(context.Background())
+	}
+	m.snapshotMu.RLock()
+	snapshot := m.snapshot
+	m.snapshotMu.RUnlock()
+	for _, metrics := range snapshot {
+		for _, metric := range metrics {
+			ch <- metric
 		}
+	}
+	m.scrapeDurations.Collect(ch)
+	m.scrapeErrors.Collect(ch)
+	m.lastSuccessfulScrapes.Collect(ch)
+	m.collectorsUp.Collect(ch)
+}
 
-		// brigade_pending_jobs_total
-		//
-		// There is no way to query the API directly for pending Jobs, but only
-		// running Workers should ever HAVE pending Jobs, so if we're currently
-		// counting running Workers, we can iterate over those to count pending
-		// jobs. Note, there's a cap on the max number of workers that can run
-		// concurrently, so we assume that as long as that cap isn't enormous (which
-		// would only occur on an enormous cluster), it's practical to iterate over
-		// all the running workers.
-		if phase == core.WorkerPhaseRunning {
-			var pendingJobs int
-			for {
-				for _, event := range events.Items {
-					for _, job := range event.Worker.Jobs {
-						if job.Status.Phase == core.JobPhasePending {
-							pendingJobs++
-						}
-					}
-				}
-				if events.Continue == "" {
-					break
-				}
-				if events, err = m.apiClient.Core().Events().List(
-					context.Background(),
-					&core.EventsSelector{
-						WorkerPhases: []core.WorkerPhase{phase},
-					},
-					&meta.ListOptions{Continue: events.Continue},
-				); err != nil {
-					log.Println(err)
-					break
-				}
-			}
+// refresh runs a single collection cycle, using the provided context for all
+// API calls, and replaces the snapshot with its results. If any collector
+// fails, the metrics that collector produced in the previous cycle are carried
+// over into the new snapshot, unless the staleness policy deems them stale, in
+// which case they're dropped.
+func (m *metricsExporter) refresh(ctx context.Context) {
+	m.configMu.RLock()
+	staleness := m.staleness
+	m.configMu.RUnlock()
+	m.cycleMu.Lock()
+	defer m.cycleMu.Unlock()
+	snapshot := map[string][]prometheus.Metric{}
+	// snapshotMu guards snapshot and collected, as well as m.failedCycles and
+	// m.lastSuccesses, within this cycle.
+	snapshotMu := sync.Mutex{}
+	var collected bool
+	wg := sync.WaitGroup{}
+	for name, c := range m.collectors {
+		wg.Add(1)
+		go func(name string, c collector) {
+			defer wg.Done()
+			start := time.Now()
+			metrics, err := c.collect(ctx)
+			labels := prometheus.Labels{"collector": name}
+			m.scrapeDurations.With(labels).Set(time.Since(start).Seconds())
+			snapshotMu.Lock()
+			defer snapshotMu.Unlock()
 			if err == nil {
-				m.totalPendingJobs.Set(float64(pendingJobs))
+				m.lastSuccessfulScrapes.With(labels).SetToCurrentTime()
+				m.collectorsUp.With(labels).Set(1)
+				m.failedCycles[name] = 0
+				m.lastSuccesses[name] = time.Now()
+				collected = true
+			} else {
+				log.Println(errors.Wrapf(err, "error collecting %s metrics", name))
+				m.scrapeErrors.With(
+					prometheus.Labels{"collector": name, "reason": errorReason(err)},
+				).Inc()
+				m.collectorsUp.With(labels).Set(0)
+				m.failedCycles[name]++
+				// No other goroutine writes the snapshot while cycleMu is held, so
+				// it's safe to read without holding m.snapshotMu.
+				metrics = m.snapshot[name]
+				if metrics != nil && staleness.stale(
+					m.failedCycles[name],
+					m.lastSuccesses[name],
+				) {
+					log.Printf("Dropping stale %s metrics", name)
+					metrics = nil
+				}
 			}
-		}
+			snapshot[name] = metrics
+		}(name, c)
 	}
-
+	wg.Wait()
+	m.snapshotMu.Lock()
+	defer m.snapshotMu.Unlock()
+	m.snapshot = snapshot
+	m.collected = m.collected || collected
 }
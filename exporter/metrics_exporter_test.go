@@ -0,0 +1,1422 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/brigadecore/brigade/sdk/v2"
+	"github.com/brigadecore/brigade/sdk/v2/authn"
+	"github.com/brigadecore/brigade/sdk/v2/authz"
+	"github.com/brigadecore/brigade/sdk/v2/core"
+	libAuthz "github.com/brigadecore/brigade/sdk/v2/lib/authz"
+	"github.com/brigadecore/brigade/sdk/v2/meta"
+	"github.com/brigadecore/brigade/sdk/v2/system"
+	sdkTesting "github.com/brigadecore/brigade/sdk/v2/testing"
+	authnTesting "github.com/brigadecore/brigade/sdk/v2/testing/authn"
+	authzTesting "github.com/brigadecore/brigade/sdk/v2/testing/authz"
+	coreTesting "github.com/brigadecore/brigade/sdk/v2/testing/core"
+	systemTesting "github.com/brigadecore/brigade/sdk/v2/testing/system"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewMetricsExporter(t *testing.T) {
+	m := newMetricsExporter(
+		newAPICaller(
+			&sdkTesting.MockAPIClient{},
+			time.Second,
+			1,
+			retryPolicy{},
+			circuitBreakerPolicy{},
+		),
+		time.Second,
+		true,
+		stalenessPolicy{maxAge: time.Minute},
+		collectorOptions{},
+		[]string{"projects", "users"},
+	)
+	require.NotNil(t, m.registry)
+	require.Equal(t, time.Second, m.scrapeInterval)
+	require.True(t, m.backgroundRefresh)
+	require.Equal(t, stalenessPolicy{maxAge: time.Minute}, m.staleness)
+	require.Len(t, m.collectors, 2)
+	require.IsType(t, &projectsCollector{}, m.collectors["projects"])
+	require.IsType(t, &usersCollector{}, m.collectors["users"])
+	require.Empty(t, m.snapshot)
+}
+
+func TestMetricsExporterCollect(t *testing.T) {
+	testCases := []struct {
+		name       string
+		brigade    *fakeBrigade
+		staleness  stalenessPolicy
+		setup      func(*fakeBrigade)
+		assertions func(*testing.T, []*dto.MetricFamily)
+	}{
+		{
+			name: "success",
+			brigade: &fakeBrigade{
+				apiServerVersion: "v2.0.0",
+				projects:         []string{"italian", "greek", "french"},
+				users:            5,
+				serviceAccounts:  3,
+				lockedUsers:      1,
+				substrateWorkers: 3,
+				substrateJobs:    2,
+				secrets:          map[string]int{"italian": 2},
+				projectRoleAssignments: map[string][]core.ProjectRoleAssignment{
+					"greek": {
+						{Role: core.RoleProjectAdmin},
+						{Role: core.RoleProjectUser},
+						{Role: core.RoleProjectUser},
+					},
+				},
+				systemRoleAssignments: []libAuthz.RoleAssignment{
+					{Role: system.RoleReader},
+					{Role: "CUSTOM"},
+				},
+				events: []core.Event{
+					newTestEvent("1", "italian", core.WorkerPhaseRunning),
+					newTestEvent("2", "italian", core.WorkerPhasePending),
+					newTestEvent("3", "greek", core.WorkerPhasePending),
+					newTestEvent("4", "greek", core.WorkerPhaseFailed),
+					newTestEvent("6", "greek", core.WorkerPhaseSchedulingFailed),
+					func() core.Event {
+						event := newTestEvent("5", "greek", core.WorkerPhaseRunning)
+						event.Worker.Jobs = []core.Job{
+							{
+								Name: "foo",
+								Spec: core.JobSpec{
+									SidecarContainers: map[string]core.JobContainerSpec{
+										"bar": {},
+									},
+								},
+								Status: &core.JobStatus{Phase: core.JobPhaseRunning},
+							},
+							{
+								Name:   "baz",
+								Status: &core.JobStatus{Phase: core.JobPhaseStarting},
+							},
+						}
+						return event
+					}(),
+				},
+			},
+			assertions: func(t *testing.T, families []*dto.MetricFamily) {
+				require.Equal(
+					t,
+					1.0,
+					gaugeValue(
+						t,
+						families,
+						"brigade_api_server_info",
+						map[string]string{"version": "v2.0.0"},
+					),
+				)
+				require.Equal(
+					t,
+					3.0,
+					gaugeValue(t, families, "brigade_projects_total", nil),
+				)
+				for locked, count := range map[string]float64{
+					"true":  1,
+					"false": 4,
+				} {
+					require.Equal(
+						t,
+						count,
+						gaugeValue(
+							t,
+							families,
+							"brigade_users_total",
+							map[string]string{"locked": locked},
+						),
+					)
+				}
+				for locked, count := range map[string]float64{
+					"true":  0,
+					"false": 3,
+				} {
+					require.Equal(
+						t,
+						count,
+						gaugeValue(
+							t,
+							families,
+							"brigade_service_accounts_total",
+							map[string]string{"locked": locked},
+						),
+					)
+				}
+				require.Equal(
+					t,
+					2.0,
+					gaugeValue(
+						t,
+						families,
+						"brigade_all_workers_by_phase",
+						map[string]string{"workerPhase": "PENDING"},
+					),
+				)
+				for project, count := range map[string]float64{
+					"italian": 2,
+					"greek":   0,
+				} {
+					require.Equal(
+						t,
+						count,
+						gaugeValue(
+							t,
+							families,
+							"brigade_project_secrets",
+							map[string]string{"project": project},
+						),
+					)
+				}
+				for role, count := range map[string]float64{
+					"PROJECT_ADMIN":     1,
+					"PROJECT_DEVELOPER": 0,
+					"PROJECT_USER":      2,
+				} {
+					require.Equal(
+						t,
+						count,
+						gaugeValue(
+							t,
+							families,
+							"brigade_project_role_assignments",
+							map[string]string{"project": "greek", "role": role},
+						),
+					)
+				}
+				for role, count := range map[string]float64{
+					"ADMIN":  0,
+					"READER": 1,
+					// Unknown roles are reported too
+					"CUSTOM": 1,
+				} {
+					require.Equal(
+						t,
+						count,
+						gaugeValue(
+							t,
+							families,
+							"brigade_system_role_assignments",
+							map[string]string{"role": role},
+						),
+					)
+				}
+				require.Equal(
+					t,
+					3.0,
+					gaugeValue(t, families, "brigade_substrate_running_workers", nil),
+				)
+				require.Equal(
+					t,
+					2.0,
+					gaugeValue(t, families, "brigade_substrate_running_jobs", nil),
+				)
+				// Three workers are executing on the substrate, but only two events
+				// have running workers
+				require.Equal(
+					t,
+					1.0,
+					gaugeValue(
+						t,
+						families,
+						"brigade_substrate_running_workers_mismatch",
+						nil,
+					),
+				)
+				require.Equal(
+					t,
+					1.0,
+					gaugeValue(t, families, "brigade_pending_jobs_total", nil),
+				)
+				for phase, count := range map[string]float64{
+					"PENDING":  1,
+					"STARTING": 1,
+					"RUNNING":  1,
+					"FAILED":   0,
+				} {
+					require.Equal(
+						t,
+						count,
+						gaugeValue(
+							t,
+							families,
+							"brigade_jobs_by_phase",
+							map[string]string{"jobPhase": phase},
+						),
+					)
+				}
+				require.Equal(
+					t,
+					1.0,
+					gaugeValue(
+						t,
+						families,
+						"brigade_jobs_by_project_and_phase",
+						map[string]string{"project": "greek", "jobPhase": "STARTING"},
+					),
+				)
+				require.Equal(
+					t,
+					0.0,
+					gaugeValue(
+						t,
+						families,
+						"brigade_jobs_by_project_and_phase",
+						map[string]string{"project": "italian", "jobPhase": "STARTING"},
+					),
+				)
+				require.Equal(
+					t,
+					1.0,
+					gaugeValue(
+						t,
+						families,
+						"brigade_jobs_by_sidecars",
+						map[string]string{"sidecars": "true"},
+					),
+				)
+				require.Equal(
+					t,
+					2.0,
+					gaugeValue(
+						t,
+						families,
+						"brigade_jobs_by_sidecars",
+						map[string]string{"sidecars": "false"},
+					),
+				)
+				require.Equal(
+					t,
+					1.0,
+					gaugeValue(
+						t,
+						families,
+						"brigade_workers_by_project_and_phase",
+						map[string]string{
+							"project":     "greek",
+							"workerPhase": "FAILED",
+						},
+					),
+				)
+				// Phases the SDK's own lists of phases omit are included
+				require.Equal(
+					t,
+					1.0,
+					gaugeValue(
+						t,
+						families,
+						"brigade_workers_by_project_and_phase",
+						map[string]string{
+							"project":     "greek",
+							"workerPhase": "SCHEDULING_FAILED",
+						},
+					),
+				)
+				require.Equal(
+					t,
+					0.0,
+					gaugeValue(
+						t,
+						families,
+						"brigade_workers_by_project_and_phase",
+						map[string]string{
+							"project":     "french",
+							"workerPhase": "STARTING",
+						},
+					),
+				)
+				require.Equal(
+					t,
+					0.0,
+					gaugeValue(
+						t,
+						families,
+						"brigade_workers_by_project_and_phase",
+						map[string]string{
+							"project":     "french",
+							"workerPhase": "RUNNING",
+						},
+					),
+				)
+				require.Greater(
+					t,
+					gaugeValue(
+						t,
+						families,
+						"brigade_oldest_pending_worker_age_seconds",
+						nil,
+					),
+					0.0,
+				)
+			},
+		},
+		{
+			name: "error carries over previous values",
+			brigade: &fakeBrigade{
+				projects: []string{"italian"},
+				users:    5,
+			},
+			setup: func(f *fakeBrigade) {
+				f.users = 10
+				f.err = errors.New("something went wrong")
+			},
+			assertions: func(t *testing.T, families []*dto.MetricFamily) {
+				require.Equal(
+					t,
+					5.0,
+					gaugeValue(
+						t,
+						families,
+						"brigade_users_total",
+						map[string]string{"locked": "false"},
+					),
+				)
+				require.Equal(
+					t,
+					1.0,
+					gaugeValue(t, families, "brigade_projects_total", nil),
+				)
+				require.Equal(
+					t,
+					1.0,
+					counterValue(
+						t,
+						families,
+						"brigade_exporter_scrape_errors_total",
+						map[string]string{"collector": "users", "reason": "other"},
+					),
+				)
+				require.NotZero(
+					t,
+					gaugeValue(
+						t,
+						families,
+						"brigade_exporter_last_successful_scrape_timestamp_seconds",
+						map[string]string{"collector": "users"},
+					),
+				)
+				require.Equal(
+					t,
+					0.0,
+					gaugeValue(
+						t,
+						families,
+						"brigade_exporter_collector_up",
+						map[string]string{"collector": "users"},
+					),
+				)
+			},
+		},
+		{
+			name: "error drops values after max failed cycles",
+			brigade: &fakeBrigade{
+				users: 5,
+			},
+			staleness: stalenessPolicy{maxFailedCycles: 1},
+			setup: func(f *fakeBrigade) {
+				f.err = errors.New("something went wrong")
+			},
+			assertions: func(t *testing.T, families []*dto.MetricFamily) {
+				requireNoMetric(t, families, "brigade_users_total")
+				require.Equal(
+					t,
+					0.0,
+					gaugeValue(
+						t,
+						families,
+						"brigade_exporter_collector_up",
+						map[string]string{"collector": "users"},
+					),
+				)
+			},
+		},
+		{
+			name: "error drops values after max age",
+			brigade: &fakeBrigade{
+				users: 5,
+			},
+			staleness: stalenessPolicy{maxAge: time.Nanosecond},
+			setup: func(f *fakeBrigade) {
+				f.err = errors.New("something went wrong")
+			},
+			assertions: func(t *testing.T, families []*dto.MetricFamily) {
+				requireNoMetric(t, families, "brigade_users_total")
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			m := newMetricsExporter(
+				newAPICaller(
+					testCase.brigade.apiClient(),
+					time.Second,
+					2,
+					retryPolicy{},
+					circuitBreakerPolicy{},
+				),
+				time.Second,
+				false,
+				testCase.staleness,
+				collectorOptions{},
+				collectorNames(),
+			)
+			_, err := m.registry.Gather()
+			require.NoError(t, err)
+			if testCase.setup != nil {
+				testCase.setup(testCase.brigade)
+			}
+			families, err := m.registry.Gather()
+			require.NoError(t, err)
+			testCase.assertions(t, families)
+		})
+	}
+}
+
+func TestMetricsExporterReconfigure(t *testing.T) {
+	brigade := &fakeBrigade{
+		projects: []string{"italian"},
+		users:    5,
+	}
+	m := newMetricsExporter(
+		newAPICaller(
+			brigade.apiClient(),
+			time.Second,
+			2,
+			retryPolicy{},
+			circuitBreakerPolicy{},
+		),
+		time.Second,
+		false,
+		stalenessPolicy{},
+		collectorOptions{},
+		[]string{"projects", "users", "durations"},
+	)
+	durations := m.collectors["durations"]
+	m.refresh(context.Background())
+	require.Contains(t, m.snapshot, "projects")
+
+	m.reconfigure(
+		time.Minute,
+		true,
+		stalenessPolicy{maxFailedCycles: 1},
+		collectorOptions{},
+		[]string{"durations", "users"},
+	)
+	require.Equal(t, time.Minute, m.scrapeInterval)
+	require.True(t, m.backgroundRefresh)
+	require.Equal(t, stalenessPolicy{maxFailedCycles: 1}, m.staleness)
+	require.Len(t, m.collectors, 2)
+	// Collectors that remain enabled should keep their state
+	require.Same(t, durations, m.collectors["durations"])
+	// Metrics from disabled collectors should no longer be served
+	require.NotContains(t, m.snapshot, "projects")
+	require.Contains(t, m.snapshot, "users")
+	select {
+	case <-m.reconfigured:
+	default:
+		require.Fail(t, "reconfiguration was not signaled")
+	}
+}
+
+func TestMetricsExporterRun(t *testing.T) {
+	testCases := []struct {
+		name       string
+		brigade    *fakeBrigade
+		assertions func(*metricsExporter)
+	}{
+		{
+			name: "no collection has succeeded",
+			brigade: &fakeBrigade{
+				err: errors.New("something went wrong"),
+			},
+			assertions: func(m *metricsExporter) {
+				// Cycles are retried until a collection succeeds
+				require.Eventually(
+					t,
+					func() bool {
+						return testutil.ToFloat64(
+							m.scrapeErrors.With(
+								prometheus.Labels{"collector": "users", "reason": "other"},
+							),
+						) > 1
+					},
+					time.Second,
+					10*time.Millisecond,
+				)
+				require.False(t, m.hasCollected())
+			},
+		},
+		{
+			name: "collection has succeeded",
+			brigade: &fakeBrigade{
+				users: 5,
+			},
+			assertions: func(m *metricsExporter) {
+				// The first cycle is run without waiting for a scrape
+				require.Eventually(
+					t,
+					m.hasCollected,
+					time.Second,
+					10*time.Millisecond,
+				)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			m := newMetricsExporter(
+				newAPICaller(
+					testCase.brigade.apiClient(),
+					time.Second,
+					2,
+					retryPolicy{},
+					circuitBreakerPolicy{},
+				),
+				10*time.Millisecond,
+				false,
+				stalenessPolicy{},
+				collectorOptions{},
+				[]string{"users"},
+			)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go m.run(ctx)
+			testCase.assertions(m)
+		})
+	}
+}
+
+func TestMetricsExporterDurations(t *testing.T) {
+	event := newTestEvent("1", "italian", core.WorkerPhaseRunning)
+	brigade := &fakeBrigade{
+		projects: []string{"italian"},
+		events:   []core.Event{event},
+	}
+	m := newMetricsExporter(
+		newAPICaller(
+			brigade.apiClient(),
+			time.Second,
+			2,
+			retryPolicy{},
+			circuitBreakerPolicy{},
+		),
+		time.Second,
+		true,
+		stalenessPolicy{},
+		collectorOptions{},
+		[]string{"durations"},
+	)
+	durations := m.collectors["durations"].(*durationsCollector)
+
+	m.refresh(context.Background())
+	families, err := m.registry.Gather()
+	require.NoError(t, err)
+	require.Equal(
+		t,
+		uint64(1),
+		histogramCount(
+			t,
+			families,
+			"brigade_worker_queue_wait_seconds",
+			map[string]string{"project": "italian"},
+		),
+	)
+	require.Contains(t, durations.trackedWorkers, "1")
+
+	// Finish the worker and its jobs
+	ended := event.Worker.Status.Started.Add(time.Minute)
+	event.Worker.Status.Phase = core.WorkerPhaseSucceeded
+	event.Worker.Status.Ended = &ended
+	for i := range event.Worker.Jobs {
+		event.Worker.Jobs[i].Status.Phase = core.JobPhaseSucceeded
+		event.Worker.Jobs[i].Status.Started = event.Worker.Status.Started
+		event.Worker.Jobs[i].Status.Ended = &ended
+	}
+	brigade.events = []core.Event{event}
+
+	// Finished workers and jobs should be observed exactly once, no matter how
+	// many collection cycles run
+	for i := 0; i < 2; i++ {
+		m.refresh(context.Background())
+		families, err = m.registry.Gather()
+		require.NoError(t, err)
+		require.Equal(
+			t,
+			uint64(1),
+			histogramCount(
+				t,
+				families,
+				"brigade_worker_duration_seconds",
+				map[string]string{
+					"project":     "italian",
+					"workerPhase": "SUCCEEDED",
+				},
+			),
+		)
+		require.Equal(
+			t,
+			uint64(1),
+			histogramCount(
+				t,
+				families,
+				"brigade_job_duration_seconds",
+				map[string]string{
+					"project":  "italian",
+					"jobPhase": "SUCCEEDED",
+				},
+			),
+		)
+		require.Empty(t, durations.trackedWorkers)
+	}
+}
+
+func TestMetricsExporterDurationsOfUnseenWorkers(t *testing.T) {
+	// finish finishes the provided event's worker and jobs a minute after the
+	// worker started, which is ten seconds after the event was created
+	finish := func(event *core.Event) {
+		started := event.Created.Add(10 * time.Second)
+		ended := started.Add(time.Minute)
+		event.Worker.Status.Phase = core.WorkerPhaseSucceeded
+		event.Worker.Status.Started = &started
+		event.Worker.Status.Ended = &ended
+		for i := range event.Worker.Jobs {
+			event.Worker.Jobs[i].Status.Phase = core.JobPhaseSucceeded
+			event.Worker.Jobs[i].Status.Started = &started
+			event.Worker.Jobs[i].Status.Ended = &ended
+		}
+	}
+	// newEvent returns an event created at the specified time, whose worker is
+	// pending and will have a single job
+	newEvent := func(id string, created time.Time) core.Event {
+		event := newTestEvent(id, "italian", core.WorkerPhasePending)
+		event.Created = &created
+		event.Worker.Jobs = []core.Job{
+			{Name: "foo", Status: &core.JobStatus{Phase: core.JobPhasePending}},
+		}
+		return event
+	}
+	finishedBefore := newEvent("1", time.Now().Add(-time.Hour))
+	finish(&finishedBefore)
+	pending := newEvent("2", time.Now())
+	brigade := &fakeBrigade{
+		projects: []string{"italian"},
+		events:   []core.Event{pending, finishedBefore},
+	}
+	m := newMetricsExporter(
+		newAPICaller(
+			brigade.apiClient(),
+			time.Second,
+			2,
+			retryPolicy{},
+			circuitBreakerPolicy{},
+		),
+		time.Second,
+		true,
+		stalenessPolicy{},
+		collectorOptions{},
+		[]string{"durations"},
+	)
+	durations := m.collectors["durations"].(*durationsCollector)
+
+	// Workers that had already finished before the first cycle aren't observed
+	m.refresh(context.Background())
+	families, err := m.registry.Gather()
+	require.NoError(t, err)
+	requireNoMetric(t, families, "brigade_worker_duration_seconds")
+	require.Contains(t, durations.trackedWorkers, "2")
+
+	// Finish the pending worker without it ever being listed as running, and
+	// add a worker that finishes without ever being listed at all
+	finish(&pending)
+	unseen := newEvent("3", time.Now())
+	finish(&unseen)
+	brigade.events = []core.Event{unseen, pending, finishedBefore}
+
+	// Both should be observed exactly once, no matter how many collection cycles
+	// run
+	for i := 0; i < 2; i++ {
+		m.refresh(context.Background())
+		families, err = m.registry.Gather()
+		require.NoError(t, err)
+		require.Equal(
+			t,
+			uint64(2),
+			histogramCount(
+				t,
+				families,
+				"brigade_worker_duration_seconds",
+				map[string]string{
+					"project":     "italian",
+					"workerPhase": "SUCCEEDED",
+				},
+			),
+		)
+		require.Equal(
+			t,
+			uint64(2),
+			histogramCount(
+				t,
+				families,
+				"brigade_job_duration_seconds",
+				map[string]string{
+					"project":  "italian",
+					"jobPhase": "SUCCEEDED",
+				},
+			),
+		)
+		// Queue waits are observed when workers finish if they weren't seen
+		// running
+		queueWaits := findMetric(
+			t,
+			families,
+			"brigade_worker_queue_wait_seconds",
+			map[string]string{"project": "italian"},
+		).GetHistogram()
+		require.Equal(t, uint64(2), queueWaits.GetSampleCount())
+		require.Equal(t, float64(20), queueWaits.GetSampleSum())
+		require.Empty(t, durations.trackedWorkers)
+	}
+}
+
+func TestMetricsExporterOldestPendingWorker(t *testing.T) {
+	// newEvent returns an event created the specified duration ago whose worker
+	// is in the specified phase
+	newEvent := func(
+		id string,
+		age time.Duration,
+		phase core.WorkerPhase,
+	) core.Event {
+		event := newTestEvent(id, "italian", phase)
+		created := time.Now().Add(-age)
+		event.Created = &created
+		return event
+	}
+	testCases := []struct {
+		name   string
+		events []core.Event
+		// age is the expected age of the oldest pending worker
+		age time.Duration
+	}{
+		{
+			name: "no pending workers",
+			events: []core.Event{
+				newEvent("1", time.Hour, core.WorkerPhaseRunning),
+			},
+		},
+		{
+			name: "pending workers",
+			events: []core.Event{
+				newEvent("1", time.Minute, core.WorkerPhasePending),
+				newEvent("2", 10*time.Minute, core.WorkerPhasePending),
+				// Only pending workers are considered
+				newEvent("3", time.Hour, core.WorkerPhaseRunning),
+			},
+			age: 10 * time.Minute,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			brigade := &fakeBrigade{
+				projects: []string{"italian"},
+				events:   testCase.events,
+			}
+			m := newMetricsExporter(
+				newAPICaller(
+					brigade.apiClient(),
+					time.Second,
+					2,
+					retryPolicy{},
+					circuitBreakerPolicy{},
+				),
+				time.Second,
+				true,
+				stalenessPolicy{},
+				collectorOptions{},
+				[]string{"pending_workers"},
+			)
+			m.refresh(context.Background())
+			families, err := m.registry.Gather()
+			require.NoError(t, err)
+			require.InDelta(
+				t,
+				testCase.age.Seconds(),
+				gaugeValue(
+					t,
+					families,
+					"brigade_oldest_pending_worker_age_seconds",
+					nil,
+				),
+				5,
+			)
+		})
+	}
+}
+
+func TestMetricsExporterEvents(t *testing.T) {
+	newEvent := func(id string, created time.Time) core.Event {
+		event := newTestEvent(id, "italian", core.WorkerPhaseSucceeded)
+		event.Source = "github"
+		event.Type = "push"
+		event.Created = &created
+		return event
+	}
+	brigade := &fakeBrigade{
+		projects: []string{"italian"},
+		events:   []core.Event{newEvent("1", time.Now().Add(-time.Hour))},
+	}
+	options := collectorOptions{
+		eventsStatePath: filepath.Join(t.TempDir(), "events.json"),
+	}
+	newExporter := func() *metricsExporter {
+		return newMetricsExporter(
+			newAPICaller(
+				brigade.apiClient(),
+				time.Second,
+				2,
+				retryPolicy{},
+				circuitBreakerPolicy{},
+			),
+			time.Second,
+			true,
+			stalenessPolicy{},
+			options,
+			[]string{"events"},
+		)
+	}
+	labels := map[string]string{
+		"source":  "github",
+		"type":    "push",
+		"project": "italian",
+	}
+	m := newExporter()
+
+	// Events that existed before the first cycle aren't counted
+	m.refresh(context.Background())
+	families, err := m.registry.Gather()
+	require.NoError(t, err)
+	requireNoMetric(t, families, "brigade_events_created_total")
+
+	// New events should be counted exactly once, no matter how many collection
+	// cycles run
+	brigade.events = append(
+		[]core.Event{newEvent("3", time.Now()), newEvent("2", time.Now())},
+		brigade.events...,
+	)
+	for i := 0; i < 2; i++ {
+		m.refresh(context.Background())
+		families, err = m.registry.Gather()
+		require.NoError(t, err)
+		require.Equal(
+			t,
+			float64(2),
+			counterValue(t, families, "brigade_events_created_total", labels),
+		)
+	}
+
+	// Counts should survive a restart, and events created in the meantime should
+	// still be counted
+	brigade.events = append(
+		[]core.Event{newEvent("4", time.Now())},
+		brigade.events...,
+	)
+	m = newExporter()
+	m.refresh(context.Background())
+	families, err = m.registry.Gather()
+	require.NoError(t, err)
+	require.Equal(
+		t,
+		float64(3),
+		counterValue(t, families, "brigade_events_created_total", labels),
+	)
+
+	// Events should be counted whatever phase their workers are in, including
+	// phases the SDK's own lists of phases omit
+	schedulingFailed := newEvent("5", time.Now())
+	schedulingFailed.Worker.Status.Phase = core.WorkerPhaseSchedulingFailed
+	brigade.events = append([]core.Event{schedulingFailed}, brigade.events...)
+	m.refresh(context.Background())
+	families, err = m.registry.Gather()
+	require.NoError(t, err)
+	require.Equal(
+		t,
+		float64(4),
+		counterValue(t, families, "brigade_events_created_total", labels),
+	)
+}
+
+func TestMetricsExporterAccounts(t *testing.T) {
+	testCases := []struct {
+		name       string
+		options    collectorOptions
+		assertions func(*testing.T, []*dto.MetricFamily)
+	}{
+		{
+			name: "info disabled",
+			options: collectorOptions{
+				staleAccountAge: 45 * 24 * time.Hour,
+			},
+			assertions: func(t *testing.T, families []*dto.MetricFamily) {
+				// Accounts are 30, 60, and 90 days old and the first is locked
+				for locked, count := range map[string]float64{
+					"true":  0,
+					"false": 2,
+				} {
+					require.Equal(
+						t,
+						count,
+						gaugeValue(
+							t,
+							families,
+							"brigade_stale_service_accounts",
+							map[string]string{"locked": locked},
+						),
+					)
+				}
+				require.Equal(
+					t,
+					uint64(2),
+					histogramCount(
+						t,
+						families,
+						"brigade_service_account_age_seconds",
+						map[string]string{"locked": "false"},
+					),
+				)
+				require.Equal(
+					t,
+					uint64(1),
+					histogramCount(
+						t,
+						families,
+						"brigade_user_age_seconds",
+						map[string]string{"locked": "false"},
+					),
+				)
+				requireNoMetric(t, families, "brigade_service_account_info")
+				requireNoMetric(t, families, "brigade_user_info")
+			},
+		},
+		{
+			name: "info enabled",
+			options: collectorOptions{
+				staleAccountAge:    45 * 24 * time.Hour,
+				accountInfoEnabled: true,
+			},
+			assertions: func(t *testing.T, families []*dto.MetricFamily) {
+				for _, family := range families {
+					switch family.GetName() {
+					case "brigade_service_account_info":
+						require.Len(t, family.Metric, 3)
+					case "brigade_user_info":
+						require.Len(t, family.Metric, 1)
+					}
+				}
+				metric := findMetric(
+					t,
+					families,
+					"brigade_service_account_info",
+					map[string]string{
+						"service_account": "0",
+						"description":     "account 0",
+						"locked":          "true",
+						"created": testAccountMeta(0).Created.UTC().
+							Format(time.RFC3339),
+					},
+				)
+				require.Equal(t, 1.0, metric.GetGauge().GetValue())
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			brigade := &fakeBrigade{
+				users:                 1,
+				serviceAccounts:       3,
+				lockedServiceAccounts: 1,
+			}
+			m := newMetricsExporter(
+				newAPICaller(
+					brigade.apiClient(),
+					time.Second,
+					2,
+					retryPolicy{},
+					circuitBreakerPolicy{},
+				),
+				time.Second,
+				true,
+				stalenessPolicy{},
+				testCase.options,
+				[]string{"service_accounts", "users"},
+			)
+			m.refresh(context.Background())
+			families, err := m.registry.Gather()
+			require.NoError(t, err)
+			testCase.assertions(t, families)
+		})
+	}
+}
+
+// fakeBrigade is an in-memory stand-in for the Brigade API. All lists it
+// returns are paginated with a page size of one to ensure that pagination is
+// exercised.
+type fakeBrigade struct {
+	apiServerVersion string
+	projects         []string
+	users            int
+	serviceAccounts  int
+	// lockedUsers and lockedServiceAccounts are how many of the users and
+	// service accounts are locked.
+	lockedUsers           int
+	lockedServiceAccounts int
+	events                []core.Event
+	// substrateWorkers and substrateJobs are the numbers of workers and jobs
+	// executing on the substrate.
+	substrateWorkers int
+	substrateJobs    int
+	// secrets maps project IDs to their numbers of secrets.
+	secrets map[string]int
+	// projectRoleAssignments maps project IDs to their role assignments.
+	projectRoleAssignments map[string][]core.ProjectRoleAssignment
+	systemRoleAssignments  []libAuthz.RoleAssignment
+	// err, if non-nil, is returned by every API call
+	err error
+}
+
+// apiClient returns an sdk.APIClient backed by the fakeBrigade.
+func (f *fakeBrigade) apiClient() sdk.APIClient {
+	return &sdkTesting.MockAPIClient{
+		AuthnClient: &authnTesting.MockAPIClient{
+			UsersClient: &authnTesting.MockUsersClient{
+				ListFn: func(
+					_ context.Context,
+					_ *authn.UsersSelector,
+					opts *meta.ListOptions,
+				) (authn.UserList, error) {
+					i, listMeta := paginate(opts, f.users)
+					list := authn.UserList{ListMeta: listMeta}
+					if i >= 0 {
+						user := authn.User{ObjectMeta: testAccountMeta(i)}
+						if i < f.lockedUsers {
+							user.Locked = &time.Time{}
+						}
+						list.Items = []authn.User{user}
+					}
+					return list, f.err
+				},
+			},
+			ServiceAccountsClient: &authnTesting.MockServiceAccountsClient{
+				ListFn: func(
+					_ context.Context,
+					_ *authn.ServiceAccountsSelector,
+					opts *meta.ListOptions,
+				) (authn.ServiceAccountList, error) {
+					i, listMeta := paginate(opts, f.serviceAccounts)
+					list := authn.ServiceAccountList{ListMeta: listMeta}
+					if i >= 0 {
+						serviceAccount := authn.ServiceAccount{
+							ObjectMeta:  testAccountMeta(i),
+							Description: "account " + strconv.Itoa(i),
+						}
+						if i < f.lockedServiceAccounts {
+							serviceAccount.Locked = &time.Time{}
+						}
+						list.Items = []authn.ServiceAccount{serviceAccount}
+					}
+					return list, f.err
+				},
+			},
+		},
+		AuthzClient: &authzTesting.MockAPIClient{
+			RoleAssignmentsClient: &authzTesting.MockRoleAssignmentsClient{
+				ListFn: func(
+					_ context.Context,
+					_ *authz.RoleAssignmentsSelector,
+					opts *meta.ListOptions,
+				) (authz.RoleAssignmentList, error) {
+					i, listMeta := paginate(opts, len(f.systemRoleAssignments))
+					list := authz.RoleAssignmentList{ListMeta: listMeta}
+					if i >= 0 {
+						list.Items = []libAuthz.RoleAssignment{
+							f.systemRoleAssignments[i],
+						}
+					}
+					return list, f.err
+				},
+			},
+		},
+		CoreClient: &coreTesting.MockAPIClient{
+			ProjectsClient: &coreTesting.MockProjectsClient{
+				ListFn: func(
+					_ context.Context,
+					_ *core.ProjectsSelector,
+					opts *meta.ListOptions,
+				) (core.ProjectList, error) {
+					i, listMeta := paginate(opts, len(f.projects))
+					list := core.ProjectList{ListMeta: listMeta}
+					if i >= 0 {
+						list.Items = []core.Project{
+							{ObjectMeta: meta.ObjectMeta{ID: f.projects[i]}},
+						}
+					}
+					return list, f.err
+				},
+				AuthzClient: &coreTesting.MockAuthzClient{
+					RoleAssignmentsClient: &coreTesting.MockProjectRoleAssignmentsClient{
+						ListFn: func(
+							_ context.Context,
+							projectID string,
+							_ *core.ProjectRoleAssignmentsSelector,
+							opts *meta.ListOptions,
+						) (core.ProjectRoleAssignmentList, error) {
+							assignments := f.projectRoleAssignments[projectID]
+							i, listMeta := paginate(opts, len(assignments))
+							list := core.ProjectRoleAssignmentList{ListMeta: listMeta}
+							if i >= 0 {
+								list.Items = []core.ProjectRoleAssignment{assignments[i]}
+							}
+							return list, f.err
+						},
+					},
+				},
+				SecretsClient: &coreTesting.MockSecretsClient{
+					ListFn: func(
+						_ context.Context,
+						projectID string,
+						opts *meta.ListOptions,
+					) (core.SecretList, error) {
+						i, listMeta := paginate(opts, f.secrets[projectID])
+						list := core.SecretList{ListMeta: listMeta}
+						if i >= 0 {
+							list.Items = []core.Secret{{Key: strconv.Itoa(i)}}
+						}
+						return list, f.err
+					},
+				},
+			},
+			EventsClient: &coreTesting.MockEventsClient{
+				ListFn: func(
+					_ context.Context,
+					selector *core.EventsSelector,
+					opts *meta.ListOptions,
+				) (core.EventList, error) {
+					events := f.selectEvents(selector)
+					i, listMeta := paginate(opts, len(events))
+					list := core.EventList{ListMeta: listMeta}
+					if i >= 0 {
+						list.Items = []core.Event{events[i]}
+					}
+					return list, f.err
+				},
+				GetFn: func(_ context.Context, id string) (core.Event, error) {
+					if f.err != nil {
+						return core.Event{}, f.err
+					}
+					for _, event := range f.events {
+						if event.ID == id {
+							return event, nil
+						}
+					}
+					return core.Event{}, &meta.ErrNotFound{}
+				},
+			},
+			SubstrateClient: &coreTesting.MockSubstrateClient{
+				CountRunningWorkersFn: func(
+					context.Context,
+				) (core.SubstrateWorkerCount, error) {
+					return core.SubstrateWorkerCount{Count: f.substrateWorkers}, f.err
+				},
+				CountRunningJobsFn: func(
+					context.Context,
+				) (core.SubstrateJobCount, error) {
+					return core.SubstrateJobCount{Count: f.substrateJobs}, f.err
+				},
+			},
+		},
+		SystemClient: &systemTesting.MockAPIClient{
+			PingFn: func(context.Context) (system.PingResponse, error) {
+				return system.PingResponse{Version: f.apiServerVersion}, f.err
+			},
+		},
+	}
+}
+
+// selectEvents returns all events matching the provided selector.
+func (f *fakeBrigade) selectEvents(selector *core.EventsSelector) []core.Event {
+	events := []core.Event{}
+	for _, event := range f.events {
+		if selector.ProjectID != "" && event.ProjectID != selector.ProjectID {
+			continue
+		}
+		if len(selector.WorkerPhases) > 0 {
+			var matched bool
+			for _, phase := range selector.WorkerPhases {
+				if event.Worker.Status.Phase == phase {
+					matched = true
+				}
+			}
+			if !matched {
+				continue
+			}
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// paginate returns the index of the single item on the page of a list of
+// the specified length that is requested by the provided list options, or -1
+// if the page is empty. It also returns the list metadata for that page.
+func paginate(opts *meta.ListOptions, length int) (int, meta.ListMeta) {
+	var start int
+	if opts != nil {
+		start, _ = strconv.Atoi(opts.Continue)
+	}
+	if start >= length {
+		return -1, meta.ListMeta{}
+	}
+	if start+1 >= length {
+		return start, meta.ListMeta{}
+	}
+	return start, meta.ListMeta{
+		Continue:           strconv.Itoa(start + 1),
+		RemainingItemCount: int64(length - start - 1),
+	}
+}
+
+// testAccountsEpoch is the time relative to which fake users and service
+// accounts were created. It's fixed so that their creation times can be
+// predicted.
+var testAccountsEpoch = time.Now()
+
+// testAccountMeta returns metadata for the fake user or service account with
+// the specified index, which was created (i+1)*30 days before
+// testAccountsEpoch.
+func testAccountMeta(i int) meta.ObjectMeta {
+	created := testAccountsEpoch.Add(-time.Duration(i+1) * 30 * 24 * time.Hour)
+	return meta.ObjectMeta{
+		ID:      strconv.Itoa(i),
+		Created: &created,
+	}
+}
+
+// newTestEvent returns an event for the specified project, created a minute
+// ago, whose worker is in the specified phase. Running workers are given one
+// pending job.
+func newTestEvent(id, projectID string, phase core.WorkerPhase) core.Event {
+	created := time.Now().Add(-time.Minute)
+	event := core.Event{
+		ObjectMeta: meta.ObjectMeta{
+			ID:      id,
+			Created: &created,
+		},
+		ProjectID: projectID,
+		Worker: &core.Worker{
+			Status: core.WorkerStatus{
+				Phase: phase,
+			},
+		},
+	}
+	if phase == core.WorkerPhaseRunning {
+		started := created.Add(10 * time.Second)
+		event.Worker.Status.Started = &started
+		event.Worker.Jobs = []core.Job{
+			{
+				Name: "foo",
+				Status: &core.JobStatus{
+					Phase: core.JobPhasePending,
+				},
+			},
+		}
+	}
+	return event
+}
+
+// findMetric returns the metric in the specified family whose labels match
+// those provided.
+func findMetric(
+	t *testing.T,
+	families []*dto.MetricFamily,
+	name string,
+	labels map[string]string,
+) *dto.Metric {
+	t.Helper()
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.Metric {
+			if len(metric.Label) != len(labels) {
+				continue
+			}
+			for _, label := range metric.Label {
+				if labels[label.GetName()] != label.GetValue() {
+					continue metrics
+				}
+			}
+			return metric
+		}
+	}
+	require.Failf(t, "metric not found", "%s %v", name, labels)
+	return nil
+}
+
+// requireNoMetric fails the test if the provided families include the
+// specified metric.
+func requireNoMetric(
+	t *testing.T,
+	families []*dto.MetricFamily,
+	name string,
+) {
+	t.Helper()
+	for _, family := range families {
+		require.NotEqual(t, name, family.GetName())
+	}
+}
+
+// gaugeValue returns the value of the gauge in the specified family whose
+// labels match those provided.
+func gaugeValue(
+	t *testing.T,
+	families []*dto.MetricFamily,
+	name string,
+	labels map[string]string,
+) float64 {
+	t.Helper()
+	return findMetric(t, families, name, labels).GetGauge().GetValue()
+}
+
+// counterValue returns the value of the counter in the specified family whose
+// labels match those provided.
+func counterValue(
+	t *testing.T,
+	families []*dto.MetricFamily,
+	name string,
+	labels map[string]string,
+) float64 {
+	t.Helper()
+	return findMetric(t, families, name, labels).GetCounter().GetValue()
+}
+
+// histogramCount returns the sample count of the histogram in the specified
+// family whose labels match those provided.
+func histogramCount(
+	t *testing.T,
+	families []*dto.MetricFamily,
+	name string,
+	labels map[string]string,
+) uint64 {
+	t.Helper()
+	return findMetric(t, families, name, labels).GetHistogram().GetSampleCount()
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/willie-yao/brigade-metrics/exporter/internal/version"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	otlpProtocolGRPC = "grpc"
+	otlpProtocolHTTP = "http"
+)
+
+// otlpScope is the instrumentation scope that pushed metrics are attributed
+// to.
+const otlpScope = "github.com/willie-yao/brigade-metrics/exporter"
+
+// otlpOptions determine whether, where, and how often an otlpPusher pushes
+// metrics.
+type otlpOptions struct {
+	enabled  bool
+	protocol string
+	endpoint string
+	// insecure indicates whether to connect to a gRPC endpoint without TLS.
+	insecure bool
+	headers  map[string]string
+	interval time.Duration
+	timeout  time.Duration
+}
+
+// otlpSender sends export requests to an OTLP receiver.
+type otlpSender interface {
+	send(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) error
+	close() error
+}
+
+// otlpPusher periodically pushes the metrics from a prometheus.Gatherer to an
+// OTLP receiver, such as an OpenTelemetry collector, so that the exporter can
+// be used without Prometheus. The same metrics remain available for scraping.
+type otlpPusher struct {
+	gatherer prometheus.Gatherer
+	// start is reported as the start time of cumulative metrics.
+	start time.Time
+
+	// mu guards options and sender. It's held for the duration of each push, so
+	// that the sender isn't closed while in use.
+	mu      sync.Mutex
+	options otlpOptions
+	// sender is nil while pushing is disabled.
+	sender otlpSender
+
+	loop   pushLoop
+	pushes *prometheus.CounterVec
+}
+
+// newOTLPPusher returns an otlpPusher that pushes the metrics from the
+// provided gatherer according to the provided options and counts its pushes
+// using the provided counter. Nothing is pushed until run is called.
+func newOTLPPusher(
+	gatherer prometheus.Gatherer,
+	pushes *prometheus.CounterVec,
+	options otlpOptions,
+) (*otlpPusher, error) {
+	sender, err := newOTLPSender(options)
+	if err != nil {
+		return nil, err
+	}
+	return &otlpPusher{
+		gatherer: gatherer,
+		start:    time.Now(),
+		options:  options,
+		sender:   sender,
+		loop:     newPushLoop(),
+		pushes:   pushes,
+	}, nil
+}
+
+// reconfigure replaces the otlpPusher's options. If the new options can't be
+// applied, the current ones are kept. Any push in progress completes using the
+// current options first.
+func (o *otlpPusher) reconfigure(options otlpOptions) error {
+	sender, err := newOTLPSender(options)
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	if o.sender != nil {
+		if err = o.sender.close(); err != nil {
+			log.Println(errors.Wrap(err, "error closing OTLP connection"))
+		}
+	}
+	o.options = options
+	o.sender = sender
+	o.mu.Unlock()
+	o.loop.restart()
+	return nil
+}
+
+// run pushes metrics at the configured interval, for as long as pushing is
+// enabled, until the provided context is canceled. Whenever the otlpPusher is
+// reconfigured, the interval restarts using the new configuration.
+func (o *otlpPusher) run(ctx context.Context) {
+	o.loop.run(
+		ctx,
+		func() (time.Duration, bool) {
+			o.mu.Lock()
+			defer o.mu.Unlock()
+			return o.options.interval, o.options.enabled
+		},
+		func(ctx context.Context) {
+			if err := o.push(ctx); err != nil {
+				log.Println(err)
+			}
+		},
+	)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.sender != nil {
+		if err := o.sender.close(); err != nil {
+			log.Println(errors.Wrap(err, "error closing OTLP connection"))
+		}
+	}
+}
+
+// push gathers metrics and pushes them once, unless pushing is disabled.
+func (o *otlpPusher) push(ctx context.Context) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.options.enabled {
+		return nil
+	}
+	families := gatherToPush(o.gatherer)
+	ctx, cancel := context.WithTimeout(ctx, o.options.timeout)
+	defer cancel()
+	if err := o.sender.send(
+		ctx,
+		otlpRequest(families, o.start, time.Now()),
+	); err != nil {
+		o.pushes.With(
+			prometheus.Labels{"target": "otlp", "result": "failure"},
+		).Inc()
+		return errors.Wrapf(
+			err,
+			"error pushing metrics to OTLP endpoint %s",
+			o.options.endpoint,
+		)
+	}
+	o.pushes.With(prometheus.Labels{"target": "otlp", "result": "success"}).Inc()
+	return nil
+}
+
+// newOTLPSender returns an otlpSender for the protocol and endpoint specified
+// by the provided options, or nil if pushing is disabled.
+func newOTLPSender(options otlpOptions) (otlpSender, error) {
+	if !options.enabled {
+		return nil, nil
+	}
+	switch options.protocol {
+	case otlpProtocolGRPC:
+		return newOTLPGRPCSender(options)
+	case otlpProtocolHTTP:
+		return newOTLPHTTPSender(options)
+	default:
+		return nil, errors.Errorf("unknown OTLP protocol %q", options.protocol)
+	}
+}
+
+// otlpGRPCSender sends export requests using OTLP/gRPC.
+type otlpGRPCSender struct {
+	conn    *grpc.ClientConn
+	client  colmetricspb.MetricsServiceClient
+	headers metadata.MD
+}
+
+func newOTLPGRPCSender(options otlpOptions) (*otlpGRPCSender, error) {
+	creds := credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+	if options.insecure {
+		creds = insecure.NewCredentials()
+	}
+	// The connection is established lazily, so this doesn't fail if the
+	// receiver is unavailable
+	conn, err := grpc.Dial(
+		options.endpoint,
+		grpc.WithTransportCredentials(creds),
+	)
+	if err != nil {
+		return nil, errors.Wrapf(
+			err,
+			"error connecting to OTLP endpoint %s",
+			options.endpoint,
+		)
+	}
+	return &otlpGRPCSender{
+		conn:    conn,
+		client:  colmetricspb.NewMetricsServiceClient(conn),
+		headers: metadata.New(options.headers),
+	}, nil
+}
+
+func (o *otlpGRPCSender) send(
+	ctx context.Context,
+	req *colmetricspb.ExportMetricsServiceRequest,
+) error {
+	_, err := o.client.Export(
+		metadata.NewOutgoingContext(ctx, o.headers),
+		req,
+	)
+	return err
+}
+
+func (o *otlpGRPCSender) close() error {
+	return o.conn.Close()
+}
+
+// otlpHTTPSender sends export requests using OTLP/HTTP with binary protobuf
+// encoding.
+type otlpHTTPSender struct {
+	client   *http.Client
+	endpoint string
+	headers  map[string]string
+}
+
+func newOTLPHTTPSender(options otlpOptions) (*otlpHTTPSender, error) {
+	if _, err := url.ParseRequestURI(options.endpoint); err != nil {
+		return nil, errors.Wrapf(
+			err,
+			"error parsing OTLP endpoint %s",
+			options.endpoint,
+		)
+	}
+	return &otlpHTTPSender{
+		client:   &http.Client{},
+		endpoint: options.endpoint,
+		headers:  options.headers,
+	}, nil
+}
+
+func (o *otlpHTTPSender) send(
+	ctx context.Context,
+	req *colmetricspb.ExportMetricsServiceRequest,
+) error {
+	body, err := proto.Marshal(req)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling OTLP request")
+	}
+	httpReq, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		o.endpoint,
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return errors.Wrap(err, "error creating OTLP request")
+	}
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	for key, value := range o.headers {
+		httpReq.Header.Set(key, value)
+	}
+	resp, err := o.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Drain the body so the connection can be reused
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("OTLP receiver responded with %s", resp.Status)
+	}
+	return nil
+}
+
+func (o *otlpHTTPSender) close() error {
+	o.client.CloseIdleConnections()
+	return nil
+}
+
+// otlpRequest returns an export request containing the provided metric
+// families as of the specified time. Counters, histograms, and summaries are
+// cumulative since the specified start time.
+func otlpRequest(
+	families []*dto.MetricFamily,
+	start time.Time,
+	now time.Time,
+) *colmetricspb.ExportMetricsServiceRequest {
+	metrics := make([]*metricspb.Metric, 0, len(families))
+	for _, family := range families {
+		metrics = append(metrics, otlpMetric(family, start, now))
+	}
+	return &colmetricspb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{
+			{
+				Resource: &resourcepb.Resource{
+					Attributes: []*commonpb.KeyValue{
+						otlpAttribute("service.name", "brigade-metrics"),
+						otlpAttribute("service.version", version.Version()),
+					},
+				},
+				ScopeMetrics: []*metricspb.ScopeMetrics{
+					{
+						Scope: &commonpb.InstrumentationScope{
+							Name:    otlpScope,
+							Version: version.Version(),
+						},
+						Metrics: metrics,
+					},
+				},
+			},
+		},
+	}
+}
+
+// otlpMetric converts the provided metric family to an OTLP metric. Untyped
+// metrics are treated as gauges.
+func otlpMetric(
+	family *dto.MetricFamily,
+	start time.Time,
+	now time.Time,
+) *metricspb.Metric {
+	metric := &metricspb.Metric{
+		Name:        family.GetName(),
+		Description: family.GetHelp(),
+	}
+	startNanos := uint64(start.UnixNano())
+	switch family.GetType() {
+	case dto.MetricType_COUNTER:
+		sum := &metricspb.Sum{
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE, // nolint: lll
+			IsMonotonic:            true,
+		}
+		for _, m := range family.Metric {
+			sum.DataPoints = append(
+				sum.DataPoints,
+				&metricspb.NumberDataPoint{
+					Attributes:        otlpAttributes(m.Label),
+					StartTimeUnixNano: startNanos,
+					TimeUnixNano:      otlpTimestamp(m, now),
+					Value: &metricspb.NumberDataPoint_AsDouble{
+						AsDouble: m.GetCounter().GetValue(),
+					},
+				},
+			)
+		}
+		metric.Data = &metricspb.Metric_Sum{Sum: sum}
+	case dto.MetricType_HISTOGRAM:
+		histogram := &metricspb.Histogram{
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE, // nolint: lll
+		}
+		for _, m := range family.Metric {
+			histogram.DataPoints = append(
+				histogram.DataPoints,
+				otlpHistogramDataPoint(m, startNanos, now),
+			)
+		}
+		metric.Data = &metricspb.Metric_Histogram{Histogram: histogram}
+	case dto.MetricType_SUMMARY:
+		summary := &metricspb.Summary{}
+		for _, m := range family.Metric {
+			point := &metricspb.SummaryDataPoint{
+				Attributes:        otlpAttributes(m.Label),
+				StartTimeUnixNano: startNanos,
+				TimeUnixNano:      otlpTimestamp(m, now),
+				Count:             m.GetSummary().GetSampleCount(),
+				Sum:               m.GetSummary().GetSampleSum(),
+			}
+			for _, q := range m.GetSummary().GetQuantile() {
+				point.QuantileValues = append(
+					point.QuantileValues,
+					&metricspb.SummaryDataPoint_ValueAtQuantile{
+						Quantile: q.GetQuantile(),
+						Value:    q.GetValue(),
+					},
+				)
+			}
+			summary.DataPoints = append(summary.DataPoints, point)
+		}
+		metric.Data = &metricspb.Metric_Summary{Summary: summary}
+	default:
+		gauge := &metricspb.Gauge{}
+		for _, m := range family.Metric {
+			value := m.GetGauge().GetValue()
+			if family.GetType() == dto.MetricType_UNTYPED {
+				value = m.GetUntyped().GetValue()
+			}
+			gauge.DataPoints = append(
+				gauge.DataPoints,
+				&metricspb.NumberDataPoint{
+					Attributes:   otlpAttributes(m.Label),
+					TimeUnixNano: otlpTimestamp(m, now),
+					Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: value},
+				},
+			)
+		}
+		metric.Data = &metricspb.Metric_Gauge{Gauge: gauge}
+	}
+	return metric
+}
+
+// otlpHistogramDataPoint converts the provided Prometheus histogram, whose
+// bucket counts are cumulative, to an OTLP histogram data point, whose bucket
+// counts aren't.
+func otlpHistogramDataPoint(
+	m *dto.Metric,
+	startNanos uint64,
+	now time.Time,
+) *metricspb.HistogramDataPoint {
+	h := m.GetHistogram()
+	sum := h.GetSampleSum()
+	point := &metricspb.HistogramDataPoint{
+		Attributes:        otlpAttributes(m.Label),
+		StartTimeUnixNano: startNanos,
+		TimeUnixNano:      otlpTimestamp(m, now),
+		Count:             h.GetSampleCount(),
+		Sum:               &sum,
+	}
+	var previous uint64
+	for _, bucket := range h.GetBucket() {
+		if math.IsInf(bucket.GetUpperBound(), 1) {
+			// The +Inf bucket is implied by the count
+			break
+		}
+		point.ExplicitBounds = append(point.ExplicitBounds, bucket.GetUpperBound())
+		point.BucketCounts = append(
+			point.BucketCounts,
+			bucket.GetCumulativeCount()-previous,
+		)
+		previous = bucket.GetCumulativeCount()
+	}
+	point.BucketCounts = append(point.BucketCounts, h.GetSampleCount()-previous)
+	return point
+}
+
+// otlpTimestamp returns the time of the provided metric in nanoseconds since
+// the epoch. Metrics without their own timestamp are as of the specified time.
+func otlpTimestamp(m *dto.Metric, now time.Time) uint64 {
+	if m.TimestampMs != nil {
+		return uint64(m.GetTimestampMs()) * uint64(time.Millisecond)
+	}
+	return uint64(now.UnixNano())
+}
+
+// otlpAttributes converts the provided labels to OTLP attributes.
+func otlpAttributes(labels []*dto.LabelPair) []*commonpb.KeyValue {
+	attributes := make([]*commonpb.KeyValue, 0, len(labels))
+	for _, label := range labels {
+		attributes = append(
+			attributes,
+			otlpAttribute(label.GetName(), label.GetValue()),
+		)
+	}
+	return attributes
+}
+
+// otlpAttribute returns an OTLP attribute with the specified key and string
+// value.
+func otlpAttribute(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{
+		Key: key,
+		Value: &commonpb.AnyValue{
+			Value: &commonpb.AnyValue_StringValue{StringValue: value},
+		},
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestOTLPPusherPush(t *testing.T) {
+	testCases := []struct {
+		name string
+		// options returns options for pushing to the provided receiver.
+		options    func(*testing.T, *fakeOTLPReceiver) otlpOptions
+		receiver   *fakeOTLPReceiver
+		assertions func(*testing.T, *otlpPusher, *fakeOTLPReceiver, error)
+	}{
+		{
+			name: "disabled",
+			options: func(*testing.T, *fakeOTLPReceiver) otlpOptions {
+				return otlpOptions{}
+			},
+			receiver: &fakeOTLPReceiver{},
+			assertions: func(
+				t *testing.T,
+				otlp *otlpPusher,
+				receiver *fakeOTLPReceiver,
+				err error,
+			) {
+				require.NoError(t, err)
+				require.Empty(t, receiver.requests)
+				require.Equal(t, 0, testutil.CollectAndCount(otlp.pushes))
+			},
+		},
+		{
+			name: "gRPC",
+			options: func(t *testing.T, receiver *fakeOTLPReceiver) otlpOptions {
+				return otlpOptions{
+					enabled:  true,
+					protocol: otlpProtocolGRPC,
+					endpoint: receiver.startGRPC(t),
+					insecure: true,
+					headers:  map[string]string{"x-api-key": "foo"},
+					timeout:  5 * time.Second,
+				}
+			},
+			receiver:   &fakeOTLPReceiver{},
+			assertions: requireOTLPPushed,
+		},
+		{
+			name: "HTTP",
+			options: func(t *testing.T, receiver *fakeOTLPReceiver) otlpOptions {
+				return otlpOptions{
+					enabled:  true,
+					protocol: otlpProtocolHTTP,
+					endpoint: receiver.startHTTP(t) + "/v1/metrics",
+					headers:  map[string]string{"x-api-key": "foo"},
+					timeout:  5 * time.Second,
+				}
+			},
+			receiver:   &fakeOTLPReceiver{},
+			assertions: requireOTLPPushed,
+		},
+		{
+			name: "receiver error",
+			options: func(t *testing.T, receiver *fakeOTLPReceiver) otlpOptions {
+				return otlpOptions{
+					enabled:  true,
+					protocol: otlpProtocolHTTP,
+					endpoint: receiver.startHTTP(t) + "/v1/metrics",
+					timeout:  5 * time.Second,
+				}
+			},
+			receiver: &fakeOTLPReceiver{
+				err: errors.New("something went wrong"),
+			},
+			assertions: func(
+				t *testing.T,
+				otlp *otlpPusher,
+				_ *fakeOTLPReceiver,
+				err error,
+			) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "500 Internal Server Error")
+				require.Equal(
+					t,
+					1.0,
+					testutil.ToFloat64(
+						otlp.pushes.With(
+							prometheus.Labels{"target": "otlp", "result": "failure"},
+						),
+					),
+				)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			otlp, err := newOTLPPusher(
+				newTestOTLPRegistry(),
+				newPushesCounter(),
+				testCase.options(t, testCase.receiver),
+			)
+			require.NoError(t, err)
+			err = otlp.push(context.Background())
+			testCase.assertions(t, otlp, testCase.receiver, err)
+		})
+	}
+}
+
+func TestOTLPPusherReconfigure(t *testing.T) {
+	receiver := &fakeOTLPReceiver{}
+	otlp, err := newOTLPPusher(
+		newTestOTLPRegistry(),
+		newPushesCounter(),
+		otlpOptions{},
+	)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go otlp.run(ctx)
+	// Once enabled, metrics should be pushed on the new interval
+	require.NoError(
+		t,
+		otlp.reconfigure(
+			otlpOptions{
+				enabled:  true,
+				protocol: otlpProtocolHTTP,
+				endpoint: receiver.startHTTP(t) + "/v1/metrics",
+				interval: 10 * time.Millisecond,
+				timeout:  5 * time.Second,
+			},
+		),
+	)
+	require.Eventually(
+		t,
+		func() bool {
+			receiver.mu.Lock()
+			defer receiver.mu.Unlock()
+			return len(receiver.requests) > 0
+		},
+		5*time.Second,
+		10*time.Millisecond,
+	)
+}
+
+// requireOTLPPushed asserts that the metrics from newTestOTLPRegistry were
+// pushed successfully and converted correctly.
+func requireOTLPPushed(
+	t *testing.T,
+	otlp *otlpPusher,
+	receiver *fakeOTLPReceiver,
+	err error,
+) {
+	require.NoError(t, err)
+	require.Equal(
+		t,
+		1.0,
+		testutil.ToFloat64(
+			otlp.pushes.With(
+				prometheus.Labels{"target": "otlp", "result": "success"},
+			),
+		),
+	)
+	require.Len(t, receiver.requests, 1)
+	require.Equal(t, "foo", receiver.apiKey)
+	resourceMetrics := receiver.requests[0].ResourceMetrics
+	require.Len(t, resourceMetrics, 1)
+	require.Len(t, resourceMetrics[0].ScopeMetrics, 1)
+	metrics := map[string]*metricspb.Metric{}
+	for _, metric := range resourceMetrics[0].ScopeMetrics[0].Metrics {
+		metrics[metric.Name] = metric
+	}
+
+	sum := metrics["test_requests_total"].GetSum()
+	require.NotNil(t, sum)
+	require.True(t, sum.IsMonotonic)
+	require.Equal(
+		t,
+		metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+		sum.AggregationTemporality,
+	)
+	require.Len(t, sum.DataPoints, 1)
+	require.Equal(t, 3.0, sum.DataPoints[0].GetAsDouble())
+	require.Equal(t, "code", sum.DataPoints[0].Attributes[0].Key)
+	require.Equal(
+		t,
+		"200",
+		sum.DataPoints[0].Attributes[0].Value.GetStringValue(),
+	)
+	require.Equal(
+		t,
+		uint64(otlp.start.UnixNano()),
+		sum.DataPoints[0].StartTimeUnixNano,
+	)
+
+	gauge := metrics["test_temperature"].GetGauge()
+	require.NotNil(t, gauge)
+	require.Equal(t, 21.5, gauge.DataPoints[0].GetAsDouble())
+
+	histogram := metrics["test_latency_seconds"].GetHistogram()
+	require.NotNil(t, histogram)
+	require.Equal(t, []float64{0.1, 1}, histogram.DataPoints[0].ExplicitBounds)
+	// Bucket counts aren't cumulative and include the +Inf bucket
+	require.Equal(t, []uint64{1, 1, 1}, histogram.DataPoints[0].BucketCounts)
+	require.Equal(t, uint64(3), histogram.DataPoints[0].Count)
+	require.Equal(t, 5.55, histogram.DataPoints[0].GetSum())
+}
+
+// newTestOTLPRegistry returns a registry with a counter, a gauge, and a
+// histogram for pushing.
+func newTestOTLPRegistry() *prometheus.Registry {
+	requests := prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "test_requests_total"},
+		[]string{"code"},
+	)
+	requests.With(prometheus.Labels{"code": "200"}).Add(3)
+	temperature := prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "test_temperature"},
+	)
+	temperature.Set(21.5)
+	latency := prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "test_latency_seconds",
+			Buckets: []float64{0.1, 1},
+		},
+	)
+	for _, val := range []float64{0.05, 0.5, 5} {
+		latency.Observe(val)
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(requests, temperature, latency)
+	return registry
+}
+
+// fakeOTLPReceiver is an in-process OTLP receiver that records the requests
+// it receives over gRPC or HTTP.
+type fakeOTLPReceiver struct {
+	colmetricspb.UnimplementedMetricsServiceServer
+	mu       sync.Mutex
+	requests []*colmetricspb.ExportMetricsServiceRequest
+	// apiKey is the value of the x-api-key header of the most recent request.
+	apiKey string
+	// err, if non-nil, is returned for every request
+	err error
+}
+
+// startGRPC serves OTLP/gRPC until the test completes and returns the
+// address of the server.
+func (f *fakeOTLPReceiver) startGRPC(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	colmetricspb.RegisterMetricsServiceServer(server, f)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(server.Stop)
+	return listener.Addr().String()
+}
+
+// startHTTP serves OTLP/HTTP until the test completes and returns the URL of
+// the server.
+func (f *fakeOTLPReceiver) startHTTP(t *testing.T) string {
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func (f *fakeOTLPReceiver) Export(
+	ctx context.Context,
+	req *colmetricspb.ExportMetricsServiceRequest,
+) (*colmetricspb.ExportMetricsServiceResponse, error) {
+	var apiKey string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if vals := md.Get("x-api-key"); len(vals) > 0 {
+			apiKey = vals[0]
+		}
+	}
+	f.record(req, apiKey)
+	return &colmetricspb.ExportMetricsServiceResponse{}, f.err
+}
+
+func (f *fakeOTLPReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/metrics" ||
+		r.Header.Get("Content-Type") != "application/x-protobuf" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	req := &colmetricspb.ExportMetricsServiceRequest{}
+	if err = proto.Unmarshal(body, req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.record(req, r.Header.Get("X-Api-Key"))
+	if f.err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (f *fakeOTLPReceiver) record(
+	req *colmetricspb.ExportMetricsServiceRequest,
+	apiKey string,
+) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, req)
+	f.apiKey = apiKey
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/brigadecore/brigade/sdk/v2/core"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// pendingWorkersCollector produces brigade_oldest_pending_worker_age_seconds.
+// Events are listed newest first, so finding the oldest pending worker requires
+// iterating over all of them.
+type pendingWorkersCollector struct {
+	api                     *apiCaller
+	oldestPendingWorkerDesc *prometheus.Desc
+}
+
+func newPendingWorkersCollector(api *apiCaller) collector {
+	return &pendingWorkersCollector{
+		api: api,
+		oldestPendingWorkerDesc: prometheus.NewDesc(
+			"brigade_oldest_pending_worker_age_seconds",
+			"Age of the oldest pending worker's event",
+			nil,
+			nil,
+		),
+	}
+}
+
+func (p *pendingWorkersCollector) describe(ch chan<- *prometheus.Desc) {
+	ch <- p.oldestPendingWorkerDesc
+}
+
+func (p *pendingWorkersCollector) collect(
+	ctx context.Context,
+) ([]prometheus.Metric, error) {
+	var oldest *time.Time
+	if err := forEachEvent(
+		ctx,
+		p.api,
+		core.EventsSelector{
+			WorkerPhases: []core.WorkerPhase{core.WorkerPhasePending},
+		},
+		func(event core.Event) {
+			if event.Created != nil &&
+				(oldest == nil || event.Created.Before(*oldest)) {
+				oldest = event.Created
+			}
+		},
+	); err != nil {
+		return nil, err
+	}
+	var age float64
+	if oldest != nil {
+		age = time.Since(*oldest).Seconds()
+	}
+	return []prometheus.Metric{
+		prometheus.MustNewConstMetric(
+			p.oldestPendingWorkerDesc,
+			prometheus.GaugeValue,
+			age,
+		),
+	}, nil
+}
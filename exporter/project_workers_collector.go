@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+
+	"github.com/brigadecore/brigade/sdk/v2"
+	"github.com/brigadecore/brigade/sdk/v2/core"
+	"github.com/brigadecore/brigade/sdk/v2/meta"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// projectWorkersCollector produces brigade_workers_by_project_and_phase. This
+// requires one API call per project per worker phase, so it is the most
+// expensive collector on installations with many projects.
+type projectWorkersCollector struct {
+	api                  *apiCaller
+	workersByProjectDesc *prometheus.Desc
+}
+
+func newProjectWorkersCollector(api *apiCaller) collector {
+	return &projectWorkersCollector{
+		api: api,
+		workersByProjectDesc: prometheus.NewDesc(
+			"brigade_workers_by_project_and_phase",
+			"All workers separated by project and phase",
+			[]string{"project", "workerPhase"},
+			nil,
+		),
+	}
+}
+
+func (p *projectWorkersCollector) describe(ch chan<- *prometheus.Desc) {
+	ch <- p.workersByProjectDesc
+}
+
+func (p *projectWorkersCollector) collect(
+	ctx context.Context,
+) ([]prometheus.Metric, error) {
+	projectIDs, err := listProjectIDs(ctx, p.api)
+	if err != nil {
+		return nil, err
+	}
+	metrics := []prometheus.Metric{}
+	for _, projectID := range projectIDs {
+		for _, phase := range allWorkerPhases() {
+			var events core.EventList
+			if err = p.api.call(
+				ctx,
+				"events.list",
+				func(ctx context.Context, client sdk.APIClient) (err error) {
+					events, err = client.Core().Events().List(
+						ctx,
+						&core.EventsSelector{
+							ProjectID:    projectID,
+							WorkerPhases: []core.WorkerPhase{phase},
+						},
+						&meta.ListOptions{},
+					)
+					return err
+				},
+			); err != nil {
+				return nil, err
+			}
+			metrics = append(
+				metrics,
+				prometheus.MustNewConstMetric(
+					p.workersByProjectDesc,
+					prometheus.GaugeValue,
+					float64(len(events.Items)+int(events.RemainingItemCount)),
+					projectID,
+					string(phase),
+				),
+			)
+		}
+	}
+	return metrics, nil
+}
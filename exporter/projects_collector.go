@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+
+	"github.com/brigadecore/brigade/sdk/v2"
+	"github.com/brigadecore/brigade/sdk/v2/core"
+	"github.com/brigadecore/brigade/sdk/v2/meta"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// projectsCollector produces brigade_projects_total.
+type projectsCollector struct {
+	api               *apiCaller
+	totalProjectsDesc *prometheus.Desc
+}
+
+func newProjectsCollector(api *apiCaller) collector {
+	return &projectsCollector{
+		api: api,
+		totalProjectsDesc: prometheus.NewDesc(
+			"brigade_projects_total",
+			"The total number of brigade projects",
+			nil,
+			nil,
+		),
+	}
+}
+
+func (p *projectsCollector) describe(ch chan<- *prometheus.Desc) {
+	ch <- p.totalProjectsDesc
+}
+
+func (p *projectsCollector) collect(
+	ctx context.Context,
+) ([]prometheus.Metric, error) {
+	var projects core.ProjectList
+	if err := p.api.call(
+		ctx,
+		"projects.list",
+		func(ctx context.Context, client sdk.APIClient) (err error) {
+			projects, err = client.Core().Projects().List(
+				ctx,
+				&core.ProjectsSelector{},
+				&meta.ListOptions{},
+			)
+			return err
+		},
+	); err != nil {
+		return nil, err
+	}
+	return []prometheus.Metric{
+		prometheus.MustNewConstMetric(
+			p.totalProjectsDesc,
+			prometheus.GaugeValue,
+			float64(len(projects.Items)+int(projects.RemainingItemCount)),
+		),
+	}, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// newPushesCounter returns a counter of pushes of metrics to other systems by
+// target and result. A single counter is shared by every pusher, with each
+// pusher using its own target.
+func newPushesCounter() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "brigade_exporter_pushes_total",
+			Help: "Pushes of metrics to other systems by target and result",
+		},
+		[]string{"target", "result"},
+	)
+}
+
+// pushLoop runs a pusher's pushes at its configured interval. Every pusher
+// uses one, so that they all respond to reconfiguration alike.
+type pushLoop struct {
+	// reconfigured receives a value whenever the pusher is reconfigured.
+	reconfigured chan struct{}
+}
+
+// newPushLoop returns a pushLoop. Nothing is pushed until run is called.
+func newPushLoop() pushLoop {
+	return pushLoop{reconfigured: make(chan struct{}, 1)}
+}
+
+// restart restarts the interval using the pusher's new configuration. It's
+// called whenever the pusher is reconfigured.
+func (p pushLoop) restart() {
+	select {
+	case p.reconfigured <- struct{}{}:
+	default:
+	}
+}
+
+// run calls push at the interval returned by schedule, for as long as
+// schedule indicates pushing is enabled, until the provided context is
+// canceled. Whenever the loop is restarted, schedule is called again.
+func (p pushLoop) run(
+	ctx context.Context,
+	schedule func() (interval time.Duration, enabled bool),
+	push func(context.Context),
+) {
+	for {
+		// Receiving from a nil channel blocks forever, so while pushing is
+		// disabled, this waits only for reconfiguration or cancellation
+		var next <-chan time.Time
+		if interval, enabled := schedule(); enabled {
+			next = time.After(interval)
+		}
+		select {
+		case <-next:
+			push(ctx)
+		case <-p.reconfigured:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// gatherToPush gathers metrics from the provided gatherer. If gathering
+// partly fails, the error is logged and whatever could be gathered is still
+// returned to be pushed.
+func gatherToPush(gatherer prometheus.Gatherer) []*dto.MetricFamily {
+	families, err := gatherer.Gather()
+	if err != nil {
+		log.Println(errors.Wrap(err, "error gathering metrics to push"))
+	}
+	return families
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushLoopRun(t *testing.T) {
+	loop := newPushLoop()
+	// mu guards enabled and pushes
+	mu := sync.Mutex{}
+	var enabled bool
+	var pushes int
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		loop.run(
+			ctx,
+			func() (time.Duration, bool) {
+				mu.Lock()
+				defer mu.Unlock()
+				return time.Millisecond, enabled
+			},
+			func(context.Context) {
+				mu.Lock()
+				defer mu.Unlock()
+				pushes++
+			},
+		)
+	}()
+	// Nothing is pushed while pushing is disabled
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	require.Zero(t, pushes)
+	enabled = true
+	mu.Unlock()
+	// Once restarted, the new configuration takes effect
+	loop.restart()
+	require.Eventually(
+		t,
+		func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return pushes > 1
+		},
+		5*time.Second,
+		10*time.Millisecond,
+	)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "push loop didn't return once its context was canceled")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/willie-yao/brigade-metrics/exporter/internal/system"
+)
+
+// readinessChecker determines whether the exporter is ready to be scraped. It
+// isn't until a collection has succeeded, and it stops being ready whenever
+// the Brigade API has been unreachable for longer than a configurable timeout.
+type readinessChecker struct {
+	api      *apiCaller
+	exporter *metricsExporter
+
+	// mu guards apiUnreachableTimeout.
+	mu                    sync.RWMutex
+	apiUnreachableTimeout time.Duration
+}
+
+// newReadinessChecker returns a readinessChecker for the provided apiCaller
+// and exporter that considers the Brigade API unreachable once no call to it
+// has succeeded within the specified timeout.
+func newReadinessChecker(
+	api *apiCaller,
+	exporter *metricsExporter,
+	apiUnreachableTimeout time.Duration,
+) *readinessChecker {
+	return &readinessChecker{
+		api:                   api,
+		exporter:              exporter,
+		apiUnreachableTimeout: apiUnreachableTimeout,
+	}
+}
+
+// reconfigure changes the timeout after which the Brigade API is considered
+// unreachable.
+func (r *readinessChecker) reconfigure(apiUnreachableTimeout time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.apiUnreachableTimeout = apiUnreachableTimeout
+}
+
+// handler returns an http.HandlerFunc that responds with the outcome of every
+// readiness check.
+func (r *readinessChecker) handler() http.HandlerFunc {
+	return system.Handler(
+		system.Check{Name: "collection", Check: r.checkCollection},
+		system.Check{Name: "api", Check: r.checkAPI},
+	)
+}
+
+// checkCollection returns an error if no collection has succeeded yet.
+func (r *readinessChecker) checkCollection(context.Context) error {
+	if !r.exporter.hasCollected() {
+		return errors.New("no collection has succeeded yet")
+	}
+	return nil
+}
+
+// checkAPI returns an error if no Brigade API call has succeeded within the
+// configured timeout and the API server can't be pinged now either.
+func (r *readinessChecker) checkAPI(ctx context.Context) error {
+	r.mu.RLock()
+	timeout := r.apiUnreachableTimeout
+	r.mu.RUnlock()
+	if time.Since(r.api.lastSuccessfulCall()) <= timeout {
+		return nil
+	}
+	// Without background refresh, API calls are only made when the exporter is
+	// scraped, which it won't be while it isn't ready, so the API server is
+	// pinged to allow the exporter to become ready again.
+	if _, err := apiServerVersion(ctx, r.api); err != nil {
+		return errors.Wrapf(
+			err,
+			"no Brigade API call has succeeded in the last %s",
+			timeout,
+		)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/willie-yao/brigade-metrics/exporter/internal/system"
+)
+
+func TestReadinessCheckerHandler(t *testing.T) {
+	testCases := []struct {
+		name       string
+		brigade    *fakeBrigade
+		setup      func(*apiCaller, *metricsExporter)
+		assertions func(int, system.Status)
+	}{
+		{
+			name:    "no collection has succeeded",
+			brigade: &fakeBrigade{},
+			setup:   func(*apiCaller, *metricsExporter) {},
+			assertions: func(code int, status system.Status) {
+				require.Equal(t, http.StatusServiceUnavailable, code)
+				require.Equal(t, system.StatusFailed, status.Status)
+				require.Equal(t, "collection", status.Checks[0].Name)
+				require.Equal(t, system.StatusFailed, status.Checks[0].Status)
+				require.Equal(
+					t,
+					"no collection has succeeded yet",
+					status.Checks[0].Error,
+				)
+				// The API server was pinged successfully
+				require.Equal(t, "api", status.Checks[1].Name)
+				require.Equal(t, system.StatusOK, status.Checks[1].Status)
+			},
+		},
+		{
+			name: "API unreachable",
+			brigade: &fakeBrigade{
+				err: errors.New("something went wrong"),
+			},
+			setup: func(_ *apiCaller, exporter *metricsExporter) {
+				exporter.collected = true
+			},
+			assertions: func(code int, status system.Status) {
+				require.Equal(t, http.StatusServiceUnavailable, code)
+				require.Equal(t, system.StatusOK, status.Checks[0].Status)
+				require.Equal(t, system.StatusFailed, status.Checks[1].Status)
+				require.Contains(
+					t,
+					status.Checks[1].Error,
+					"no Brigade API call has succeeded in the last 1m0s",
+				)
+			},
+		},
+		{
+			name: "API call succeeded recently",
+			brigade: &fakeBrigade{
+				err: errors.New("something went wrong"),
+			},
+			setup: func(api *apiCaller, exporter *metricsExporter) {
+				exporter.collected = true
+				api.lastSuccess = time.Now()
+			},
+			assertions: func(code int, status system.Status) {
+				// The API server isn't pinged
+				require.Equal(t, http.StatusOK, code)
+				require.Equal(t, system.StatusOK, status.Status)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			api := newAPICaller(
+				testCase.brigade.apiClient(),
+				time.Second,
+				1,
+				retryPolicy{},
+				circuitBreakerPolicy{},
+			)
+			exporter := newMetricsExporter(
+				api,
+				time.Second,
+				false,
+				stalenessPolicy{},
+				collectorOptions{},
+				collectorNames(),
+			)
+			testCase.setup(api, exporter)
+			readiness := newReadinessChecker(api, exporter, time.Minute)
+			rr := httptest.NewRecorder()
+			readiness.handler()(
+				rr,
+				httptest.NewRequest(http.MethodGet, "/readyz", nil),
+			)
+			status := system.Status{}
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &status))
+			testCase.assertions(rr.Code, status)
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/brigadecore/brigade/sdk/v2"
+	"github.com/pkg/errors"
+	libHTTP "github.com/willie-yao/brigade-metrics/exporter/internal/http"
+)
+
+// reloadOnSignal reloads configuration whenever the provided channel, as
+// returned by signals.Reload, receives a value, until the provided context is
+// canceled.
+func reloadOnSignal(
+	ctx context.Context,
+	reloadCh <-chan struct{},
+	configPath string,
+	api *apiCaller,
+	exporter *metricsExporter,
+	readiness *readinessChecker,
+	server libHTTP.Server,
+	authenticator *libHTTP.Authenticator,
+	otlp *otlpPusher,
+	remoteWrite *remoteWritePusher,
+	dogStatsD *dogStatsDPusher,
+) {
+	for {
+		select {
+		case <-reloadCh:
+			log.Println("Reloading configuration")
+			if err := reload(
+				configPath,
+				api,
+				exporter,
+				readiness,
+				server,
+				authenticator,
+				otlp,
+				remoteWrite,
+				dogStatsD,
+			); err != nil {
+				log.Println(err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reload loads configuration from the file at the specified path, if any, and
+// from environment variables, then applies it to the running apiCaller,
+// exporter, readinessChecker, server, authenticator, and pushers. If the
+// configuration is invalid, none of it is applied. If the server,
+// authenticator, or any pusher can't apply their part of an otherwise valid
+// configuration, they continue with their current configuration, but the rest
+// is still applied.
+func reload(
+	configPath string,
+	api *apiCaller,
+	exporter *metricsExporter,
+	readiness *readinessChecker,
+	server libHTTP.Server,
+	authenticator *libHTTP.Authenticator,
+	otlp *otlpPusher,
+	remoteWrite *remoteWritePusher,
+	dogStatsD *dogStatsDPusher,
+) error {
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		return errors.Wrap(
+			err,
+			"error reloading configuration; continuing with current configuration",
+		)
+	}
+	opts := cfg.API.clientOptions()
+	api.reconfigure(
+		sdk.NewAPIClient(cfg.API.Address, cfg.API.Token, &opts),
+		time.Duration(cfg.API.RequestTimeout),
+		cfg.API.MaxInFlight,
+		cfg.API.retryPolicy(),
+		cfg.API.circuitBreakerPolicy(),
+	)
+	exporter.reconfigure(
+		time.Duration(cfg.Scrape.Interval),
+		cfg.backgroundRefresh(),
+		cfg.Scrape.stalenessPolicy(),
+		cfg.Collectors.options(),
+		cfg.Collectors.names(),
+	)
+	readiness.reconfigure(time.Duration(cfg.Health.APIUnreachableTimeout))
+	serverConfig := cfg.Server.httpConfig()
+	serverErr := server.Reload(&serverConfig)
+	authErr := authenticator.Reload(cfg.Auth.httpConfig())
+	otlpErr := otlp.reconfigure(cfg.Push.OTLP.options())
+	remoteWriteErr := remoteWrite.reconfigure(cfg.Push.RemoteWrite.options())
+	dogStatsDErr := dogStatsD.reconfigure(cfg.Push.DogStatsD.options())
+	if serverErr != nil {
+		return errors.Wrap(serverErr, "error reloading server configuration")
+	}
+	if authErr != nil {
+		return errors.Wrap(authErr, "error reloading credentials")
+	}
+	if otlpErr != nil {
+		return errors.Wrap(otlpErr, "error reloading OTLP push configuration")
+	}
+	if remoteWriteErr != nil {
+		return errors.Wrap(
+			remoteWriteErr,
+			"error reloading remote write push configuration",
+		)
+	}
+	return errors.Wrap(
+		dogStatsDErr,
+		"error reloading DogStatsD push configuration",
+	)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	sdkTesting "github.com/brigadecore/brigade/sdk/v2/testing"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	libHTTP "github.com/willie-yao/brigade-metrics/exporter/internal/http"
+)
+
+func TestReload(t *testing.T) {
+	testCases := []struct {
+		name       string
+		config     string
+		server     *mockServer
+		assertions func(
+			*apiCaller,
+			*metricsExporter,
+			*mockServer,
+			*libHTTP.Authenticator,
+			*otlpPusher,
+			*remoteWritePusher,
+			*dogStatsDPusher,
+			error,
+		)
+	}{
+		{
+			name: "invalid configuration",
+			config: `
+api:
+  address: foo
+`,
+			server: &mockServer{},
+			assertions: func(
+				api *apiCaller,
+				exporter *metricsExporter,
+				server *mockServer,
+				_ *libHTTP.Authenticator,
+				_ *otlpPusher,
+				_ *remoteWritePusher,
+				_ *dogStatsDPusher,
+				err error,
+			) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "continuing with current")
+				require.Equal(t, time.Second, api.timeout)
+				require.Len(t, exporter.collectors, len(collectorNames()))
+				require.Nil(t, server.config)
+			},
+		},
+		{
+			name: "error reloading server",
+			config: `
+api:
+  address: foo
+  token: bar
+`,
+			server: &mockServer{
+				err: errors.New("something went wrong"),
+			},
+			assertions: func(
+				api *apiCaller,
+				_ *metricsExporter,
+				_ *mockServer,
+				_ *libHTTP.Authenticator,
+				_ *otlpPusher,
+				_ *remoteWritePusher,
+				_ *dogStatsDPusher,
+				err error,
+			) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "error reloading server")
+				// Other configuration is still applied
+				require.Equal(t, 10*time.Second, api.timeout)
+			},
+		},
+		{
+			name: "error reloading credentials",
+			config: `
+api:
+  address: foo
+  token: bar
+auth:
+  bearerTokensPath: /nonexistent/tokens
+`,
+			server: &mockServer{},
+			assertions: func(
+				_ *apiCaller,
+				_ *metricsExporter,
+				server *mockServer,
+				authenticator *libHTTP.Authenticator,
+				_ *otlpPusher,
+				_ *remoteWritePusher,
+				_ *dogStatsDPusher,
+				err error,
+			) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "error reloading credentials")
+				// The server configuration is still applied
+				require.NotNil(t, server.config)
+				// Requests remain unauthenticated, as before
+				rr := httptest.NewRecorder()
+				authenticator.Require(
+					http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}),
+				).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+				require.Equal(t, http.StatusOK, rr.Code)
+			},
+		},
+		{
+			name: "error reloading OTLP push configuration",
+			config: `
+api:
+  address: foo
+  token: bar
+push:
+  otlp:
+    enabled: true
+    protocol: http
+    endpoint: not a URL
+`,
+			server: &mockServer{},
+			assertions: func(
+				_ *apiCaller,
+				_ *metricsExporter,
+				server *mockServer,
+				_ *libHTTP.Authenticator,
+				otlp *otlpPusher,
+				_ *remoteWritePusher,
+				_ *dogStatsDPusher,
+				err error,
+			) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "error reloading OTLP")
+				// Other configuration is still applied
+				require.NotNil(t, server.config)
+				// Pushing remains disabled, as before
+				require.False(t, otlp.options.enabled)
+			},
+		},
+		{
+			name: "error reloading remote write push configuration",
+			config: `
+api:
+  address: foo
+  token: bar
+push:
+  remoteWrite:
+    enabled: true
+    url: not a URL
+`,
+			server: &mockServer{},
+			assertions: func(
+				_ *apiCaller,
+				_ *metricsExporter,
+				server *mockServer,
+				_ *libHTTP.Authenticator,
+				_ *otlpPusher,
+				remoteWrite *remoteWritePusher,
+				_ *dogStatsDPusher,
+				err error,
+			) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "error reloading remote write")
+				// Other configuration is still applied
+				require.NotNil(t, server.config)
+				// Pushing remains disabled, as before
+				require.False(t, remoteWrite.options.enabled)
+			},
+		},
+		{
+			name: "success",
+			config: `
+api:
+  address: foo
+  token: bar
+  requestTimeout: 30s
+  maxInFlight: 2
+scrape:
+  interval: 1m
+  backgroundRefresh: true
+collectors:
+  enabled:
+  - users
+server:
+  port: 9090
+push:
+  otlp:
+    enabled: true
+    endpoint: localhost:4317
+    insecure: true
+  remoteWrite:
+    enabled: true
+    url: http://mimir:8080/api/v1/push
+    queueCapacity: 1000
+  dogstatsd:
+    enabled: true
+    address: localhost:8125
+`,
+			server: &mockServer{},
+			assertions: func(
+				api *apiCaller,
+				exporter *metricsExporter,
+				server *mockServer,
+				_ *libHTTP.Authenticator,
+				otlp *otlpPusher,
+				remoteWrite *remoteWritePusher,
+				dogStatsD *dogStatsDPusher,
+				err error,
+			) {
+				require.NoError(t, err)
+				require.Equal(t, 30*time.Second, api.timeout)
+				require.Equal(t, 2, cap(api.inFlight))
+				require.Equal(t, time.Minute, exporter.scrapeInterval)
+				require.True(t, exporter.backgroundRefresh)
+				require.Len(t, exporter.collectors, 1)
+				require.Contains(t, exporter.collectors, "users")
+				require.Equal(t, 9090, server.config.Port)
+				require.True(t, otlp.options.enabled)
+				require.Equal(t, "localhost:4317", otlp.options.endpoint)
+				require.IsType(t, &otlpGRPCSender{}, otlp.sender)
+				require.True(t, remoteWrite.options.enabled)
+				require.Equal(
+					t,
+					"http://mimir:8080/api/v1/push",
+					remoteWrite.options.url,
+				)
+				require.Equal(t, 1000, remoteWrite.queue.capacity)
+				require.True(t, dogStatsD.options.enabled)
+				require.Equal(t, "localhost:8125", dogStatsD.options.address)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			configPath := filepath.Join(dir, "config.yaml")
+			err = ioutil.WriteFile(configPath, []byte(testCase.config), 0600)
+			require.NoError(t, err)
+			api := newAPICaller(
+				&sdkTesting.MockAPIClient{},
+				time.Second,
+				1,
+				retryPolicy{},
+				circuitBreakerPolicy{},
+			)
+			exporter := newMetricsExporter(
+				api,
+				time.Second,
+				false,
+				stalenessPolicy{},
+				collectorOptions{},
+				collectorNames(),
+			)
+			readiness := newReadinessChecker(api, exporter, time.Second)
+			authenticator, err := libHTTP.NewAuthenticator(libHTTP.AuthConfig{})
+			require.NoError(t, err)
+			pushes := newPushesCounter()
+			otlp, err := newOTLPPusher(exporter.registry, pushes, otlpOptions{})
+			require.NoError(t, err)
+			remoteWrite, err := newRemoteWritePusher(
+				exporter.registry,
+				pushes,
+				remoteWriteOptions{},
+			)
+			require.NoError(t, err)
+			dogStatsD, err := newDogStatsDPusher(
+				exporter.registry,
+				pushes,
+				dogStatsDOptions{},
+			)
+			require.NoError(t, err)
+			err = reload(
+				configPath,
+				api,
+				exporter,
+				readiness,
+				testCase.server,
+				authenticator,
+				otlp,
+				remoteWrite,
+				dogStatsD,
+			)
+			testCase.assertions(
+				api,
+				exporter,
+				testCase.server,
+				authenticator,
+				otlp,
+				remoteWrite,
+				dogStatsD,
+				err,
+			)
+		})
+	}
+}
+
+// mockServer is a libHTTP.Server that records the configuration it was most
+// recently reloaded with.
+type mockServer struct {
+	libHTTP.Server
+	config *libHTTP.ServerConfig
+	// err, if non-nil, is returned by Reload
+	err error
+	// expiry is returned by CertificateExpiry
+	expiry time.Time
+}
+
+func (m *mockServer) Reload(config *libHTTP.ServerConfig) error {
+	m.config = config
+	return m.err
+}
+
+func (m *mockServer) CertificateExpiry() time.Time {
+	return m.expiry
+}
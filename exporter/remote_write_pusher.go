@@ -0,0 +1,588 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/willie-yao/brigade-metrics/exporter/internal/version"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteWriteOptions determine whether, where, and how a remoteWritePusher
+// pushes metrics.
+type remoteWriteOptions struct {
+	enabled bool
+	url     string
+	headers map[string]string
+	// externalLabels are added to every series, e.g. to identify the cluster
+	// the metrics came from. They never override a series' own labels.
+	externalLabels map[string]string
+	interval       time.Duration
+	// timeout bounds each attempt at sending a batch of samples.
+	timeout time.Duration
+	// maxSamplesPerSend is the maximum number of samples sent in one request.
+	maxSamplesPerSend int
+	// queueCapacity is the maximum number of samples awaiting sending.
+	queueCapacity int
+	retries       retryPolicy
+}
+
+// remoteWritePusher periodically pushes the metrics from a
+// prometheus.Gatherer to an endpoint that accepts the Prometheus remote write
+// protocol, such as Mimir, Thanos, or Prometheus itself, so that the exporter
+// can be used without a Prometheus server scraping it. Gathered samples are
+// queued and sent separately, in batches, so a slow or failing endpoint
+// doesn't delay collection. Batches that fail with retryable errors are
+// retried with backoff. The same metrics remain available for scraping.
+type remoteWritePusher struct {
+	gatherer prometheus.Gatherer
+	client   *http.Client
+
+	// mu guards options.
+	mu      sync.Mutex
+	options remoteWriteOptions
+
+	queue  *remoteWriteQueue
+	loop   pushLoop
+	pushes *prometheus.CounterVec
+	// droppedSamples counts samples that were never sent, by reason.
+	droppedSamples *prometheus.CounterVec
+	queuedSamples  prometheus.GaugeFunc
+}
+
+// newRemoteWritePusher returns a remoteWritePusher that pushes the metrics
+// from the provided gatherer according to the provided options and counts
+// its pushes using the provided counter. Nothing is pushed until run is
+// called.
+func newRemoteWritePusher(
+	gatherer prometheus.Gatherer,
+	pushes *prometheus.CounterVec,
+	options remoteWriteOptions,
+) (*remoteWritePusher, error) {
+	if err := validateRemoteWriteURL(options); err != nil {
+		return nil, err
+	}
+	queue := newRemoteWriteQueue(options.queueCapacity)
+	return &remoteWritePusher{
+		gatherer: gatherer,
+		client:   &http.Client{},
+		options:  options,
+		queue:    queue,
+		loop:     newPushLoop(),
+		pushes:   pushes,
+		droppedSamples: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "brigade_exporter_remote_write_dropped_samples_total",
+				Help: "Samples that were never pushed using remote write by reason",
+			},
+			[]string{"reason"},
+		),
+		queuedSamples: prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "brigade_exporter_remote_write_queued_samples",
+				Help: "Samples awaiting pushing using remote write",
+			},
+			func() float64 {
+				return float64(queue.len())
+			},
+		),
+	}, nil
+}
+
+// reconfigure replaces the remoteWritePusher's options. If the new options
+// can't be applied, the current ones are kept. Queued samples beyond the new
+// queue capacity are dropped, as are all queued samples if pushing is
+// disabled.
+func (r *remoteWritePusher) reconfigure(options remoteWriteOptions) error {
+	if err := validateRemoteWriteURL(options); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.options = options
+	r.mu.Unlock()
+	if !options.enabled {
+		r.droppedSamples.With(prometheus.Labels{"reason": "disabled"}).Add(
+			float64(r.queue.resize(0)),
+		)
+	}
+	r.droppedSamples.With(prometheus.Labels{"reason": "queue_full"}).Add(
+		float64(r.queue.resize(options.queueCapacity)),
+	)
+	r.loop.restart()
+	return nil
+}
+
+// run collects metrics at the configured interval, for as long as pushing is
+// enabled, and sends them as they're queued, until the provided context is
+// canceled. Whenever the remoteWritePusher is reconfigured, the interval
+// restarts using the new configuration.
+func (r *remoteWritePusher) run(ctx context.Context) {
+	go r.sendQueued(ctx)
+	r.loop.run(
+		ctx,
+		func() (time.Duration, bool) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			return r.options.interval, r.options.enabled
+		},
+		func(context.Context) {
+			r.collect()
+		},
+	)
+}
+
+// sendQueued flushes the queue whenever samples are added to it, until the
+// provided context is canceled.
+func (r *remoteWritePusher) sendQueued(ctx context.Context) {
+	for {
+		select {
+		case <-r.queue.ready:
+			if err := r.flush(ctx); err != nil {
+				log.Println(err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// collect gathers metrics and queues them for sending, unless pushing is
+// disabled. If the queue is full, the oldest samples are dropped.
+func (r *remoteWritePusher) collect() {
+	r.mu.Lock()
+	options := r.options
+	r.mu.Unlock()
+	if !options.enabled {
+		return
+	}
+	dropped := r.queue.add(
+		remoteWriteSamples(
+			gatherToPush(r.gatherer),
+			options.externalLabels,
+			time.Now(),
+		),
+	)
+	r.droppedSamples.With(prometheus.Labels{"reason": "queue_full"}).Add(
+		float64(dropped),
+	)
+}
+
+// flush sends queued samples in batches until the queue is empty or a batch
+// can't be sent. Samples in a batch that can't be sent are dropped, but any
+// still queued are kept for the next flush.
+func (r *remoteWritePusher) flush(ctx context.Context) error {
+	for {
+		r.mu.Lock()
+		options := r.options
+		r.mu.Unlock()
+		if !options.enabled {
+			return nil
+		}
+		batch := r.queue.take(options.maxSamplesPerSend)
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := r.send(ctx, options, batch); err != nil {
+			r.pushes.With(
+				prometheus.Labels{"target": "remote_write", "result": "failure"},
+			).Inc()
+			r.droppedSamples.With(prometheus.Labels{"reason": "send_failed"}).Add(
+				float64(len(batch)),
+			)
+			return errors.Wrapf(
+				err,
+				"error pushing metrics to remote write endpoint %s",
+				options.url,
+			)
+		}
+		r.pushes.With(
+			prometheus.Labels{"target": "remote_write", "result": "success"},
+		).Inc()
+	}
+}
+
+// send sends the provided samples in a single request. If the request fails
+// with a retryable error, it is retried, up to the maximum number of retries,
+// after a backoff.
+func (r *remoteWritePusher) send(
+	ctx context.Context,
+	options remoteWriteOptions,
+	samples []remoteWriteSample,
+) error {
+	body := snappy.Encode(nil, remoteWriteRequest(samples))
+	var err error
+	for retry := 0; ; retry++ {
+		if retry > 0 {
+			select {
+			case <-time.After(options.retries.wait(retry)):
+			case <-ctx.Done():
+				return err
+			}
+		}
+		err = r.post(ctx, options, body)
+		if err == nil || !remoteWriteRetryable(err) ||
+			retry == options.retries.maxRetries || ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+// post makes a single attempt at sending the provided snappy-compressed
+// remote write request on behalf of send.
+func (r *remoteWritePusher) post(
+	ctx context.Context,
+	options remoteWriteOptions,
+	body []byte,
+) error {
+	ctx, cancel := context.WithTimeout(ctx, options.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		options.url,
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return errors.Wrap(err, "error creating remote write request")
+	}
+	for key, value := range options.headers {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "brigade-metrics-exporter/"+version.Version())
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Drain the body so the connection can be reused
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &remoteWriteResponseError{
+			status: resp.Status,
+			code:   resp.StatusCode,
+		}
+	}
+	return nil
+}
+
+// remoteWriteResponseError is returned when a remote write endpoint responds
+// with anything other than a 2xx.
+type remoteWriteResponseError struct {
+	status string
+	code   int
+}
+
+func (r *remoteWriteResponseError) Error() string {
+	return fmt.Sprintf("remote write endpoint responded with %s", r.status)
+}
+
+// remoteWriteRetryable returns whether a request that failed with the
+// provided error may succeed if retried. That's the case if the endpoint
+// responded with a 5xx or a 429, or no response was received at all. Any
+// other response means the request itself was rejected and would only be
+// rejected again.
+func remoteWriteRetryable(err error) bool {
+	var respErr *remoteWriteResponseError
+	if errors.As(err, &respErr) {
+		return respErr.code >= 500 || respErr.code == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// validateRemoteWriteURL returns an error if pushing is enabled by the
+// provided options but their URL can't be parsed.
+func validateRemoteWriteURL(options remoteWriteOptions) error {
+	if !options.enabled {
+		return nil
+	}
+	_, err := url.ParseRequestURI(options.url)
+	return errors.Wrapf(err, "error parsing remote write URL %s", options.url)
+}
+
+// remoteWriteQueue is a bounded queue of samples awaiting sending. When it's
+// full, the oldest samples are dropped to make room for newer ones, which are
+// more useful.
+type remoteWriteQueue struct {
+	mu       sync.Mutex
+	samples  []remoteWriteSample
+	capacity int
+	// ready receives a value whenever samples are added.
+	ready chan struct{}
+}
+
+func newRemoteWriteQueue(capacity int) *remoteWriteQueue {
+	return &remoteWriteQueue{
+		capacity: capacity,
+		ready:    make(chan struct{}, 1),
+	}
+}
+
+// add adds the provided samples to the queue and returns how many samples
+// were dropped to make room for them.
+func (r *remoteWriteQueue) add(samples []remoteWriteSample) int {
+	r.mu.Lock()
+	r.samples = append(r.samples, samples...)
+	dropped := r.trim()
+	r.mu.Unlock()
+	select {
+	case r.ready <- struct{}{}:
+	default:
+	}
+	return dropped
+}
+
+// take removes and returns up to the specified number of the oldest samples
+// in the queue.
+func (r *remoteWriteQueue) take(max int) []remoteWriteSample {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if max > len(r.samples) {
+		max = len(r.samples)
+	}
+	samples := r.samples[:max:max]
+	r.samples = r.samples[max:]
+	return samples
+}
+
+// resize changes the capacity of the queue and returns how many samples were
+// dropped because they no longer fit.
+func (r *remoteWriteQueue) resize(capacity int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.capacity = capacity
+	return r.trim()
+}
+
+// len returns the number of samples in the queue.
+func (r *remoteWriteQueue) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.samples)
+}
+
+// trim drops the oldest samples in excess of the queue's capacity and returns
+// how many were dropped. The caller must hold mu.
+func (r *remoteWriteQueue) trim() int {
+	excess := len(r.samples) - r.capacity
+	if excess <= 0 {
+		return 0
+	}
+	r.samples = r.samples[excess:]
+	return excess
+}
+
+// remoteWriteLabel is a label of a remote write series.
+type remoteWriteLabel struct {
+	name  string
+	value string
+}
+
+// remoteWriteSample is a single sample of the series identified by its
+// labels, including the metric name as the __name__ label. Labels are sorted
+// by name, as the remote write protocol requires.
+type remoteWriteSample struct {
+	labels      []remoteWriteLabel
+	value       float64
+	timestampMs int64
+}
+
+// remoteWriteSamples converts the provided metric families to samples as of
+// the specified time, following the conventions of the Prometheus exposition
+// format. For example, each histogram becomes series for its buckets, sum,
+// and count. The provided external labels are added to every series that
+// doesn't already have labels with the same names.
+func remoteWriteSamples(
+	families []*dto.MetricFamily,
+	externalLabels map[string]string,
+	now time.Time,
+) []remoteWriteSample {
+	var samples []remoteWriteSample
+	for _, family := range families {
+		name := family.GetName()
+		for _, m := range family.Metric {
+			timestampMs := now.UnixNano() / int64(time.Millisecond)
+			if m.TimestampMs != nil {
+				timestampMs = m.GetTimestampMs()
+			}
+			// sample returns a sample of the series with the specified name and
+			// any extra label, in addition to the metric's own.
+			sample := func(
+				name string,
+				value float64,
+				extra ...remoteWriteLabel,
+			) remoteWriteSample {
+				return remoteWriteSample{
+					labels:      remoteWriteLabels(name, m.Label, externalLabels, extra),
+					value:       value,
+					timestampMs: timestampMs,
+				}
+			}
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				samples = append(samples, sample(name, m.GetCounter().GetValue()))
+			case dto.MetricType_GAUGE:
+				samples = append(samples, sample(name, m.GetGauge().GetValue()))
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				var sawInf bool
+				for _, bucket := range h.GetBucket() {
+					sawInf = sawInf || math.IsInf(bucket.GetUpperBound(), 1)
+					samples = append(
+						samples,
+						sample(
+							name+"_bucket",
+							float64(bucket.GetCumulativeCount()),
+							remoteWriteLabel{
+								name:  "le",
+								value: formatFloat(bucket.GetUpperBound()),
+							},
+						),
+					)
+				}
+				if !sawInf {
+					// The +Inf bucket is implied by the count
+					samples = append(
+						samples,
+						sample(
+							name+"_bucket",
+							float64(h.GetSampleCount()),
+							remoteWriteLabel{name: "le", value: "+Inf"},
+						),
+					)
+				}
+				samples = append(
+					samples,
+					sample(name+"_sum", h.GetSampleSum()),
+					sample(name+"_count", float64(h.GetSampleCount())),
+				)
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					samples = append(
+						samples,
+						sample(
+							name,
+							q.GetValue(),
+							remoteWriteLabel{
+								name:  "quantile",
+								value: formatFloat(q.GetQuantile()),
+							},
+						),
+					)
+				}
+				samples = append(
+					samples,
+					sample(name+"_sum", s.GetSampleSum()),
+					sample(name+"_count", float64(s.GetSampleCount())),
+				)
+			default:
+				samples = append(samples, sample(name, m.GetUntyped().GetValue()))
+			}
+		}
+	}
+	return samples
+}
+
+// remoteWriteLabels returns the labels of a series with the specified name,
+// labels, external labels, and extra labels, sorted by name.
+func remoteWriteLabels(
+	name string,
+	labels []*dto.LabelPair,
+	externalLabels map[string]string,
+	extra []remoteWriteLabel,
+) []remoteWriteLabel {
+	seriesLabels := make(
+		[]remoteWriteLabel,
+		0,
+		1+len(labels)+len(externalLabels)+len(extra),
+	)
+	seriesLabels = append(
+		seriesLabels,
+		remoteWriteLabel{name: "__name__", value: name},
+	)
+	names := map[string]struct{}{}
+	for _, label := range labels {
+		seriesLabels = append(
+			seriesLabels,
+			remoteWriteLabel{name: label.GetName(), value: label.GetValue()},
+		)
+		names[label.GetName()] = struct{}{}
+	}
+	seriesLabels = append(seriesLabels, extra...)
+	for _, label := range extra {
+		names[label.name] = struct{}{}
+	}
+	for labelName, value := range externalLabels {
+		if _, ok := names[labelName]; !ok {
+			seriesLabels = append(
+				seriesLabels,
+				remoteWriteLabel{name: labelName, value: value},
+			)
+		}
+	}
+	sort.Slice(seriesLabels, func(i, j int) bool {
+		return seriesLabels[i].name < seriesLabels[j].name
+	})
+	return seriesLabels
+}
+
+// formatFloat formats the provided value as it would be in the Prometheus
+// exposition format, e.g. for use as the value of an le label.
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+// remoteWriteRequest returns the provided samples encoded as an uncompressed
+// remote write WriteRequest protobuf message, with one TimeSeries per sample.
+// The message is encoded directly, rather than using generated code, to avoid
+// depending on the Prometheus server module for a handful of fields.
+func remoteWriteRequest(samples []remoteWriteSample) []byte {
+	var req []byte
+	for _, sample := range samples {
+		var series []byte
+		for _, label := range sample.labels {
+			var l []byte
+			l = protowire.AppendTag(l, 1, protowire.BytesType)
+			l = protowire.AppendString(l, label.name)
+			l = protowire.AppendTag(l, 2, protowire.BytesType)
+			l = protowire.AppendString(l, label.value)
+			series = protowire.AppendTag(series, 1, protowire.BytesType)
+			series = protowire.AppendBytes(series, l)
+		}
+		var s []byte
+		s = protowire.AppendTag(s, 1, protowire.Fixed64Type)
+		s = protowire.AppendFixed64(s, math.Float64bits(sample.value))
+		s = protowire.AppendTag(s, 2, protowire.VarintType)
+		s = protowire.AppendVarint(s, uint64(sample.timestampMs))
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, s)
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, series)
+	}
+	return req
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestRemoteWritePusherPush(t *testing.T) {
+	testCases := []struct {
+		name     string
+		options  remoteWriteOptions
+		receiver *fakeRemoteWriteReceiver
+		// assertions are made after metrics are collected once and the queue is
+		// flushed.
+		assertions func(
+			*testing.T,
+			*remoteWritePusher,
+			*fakeRemoteWriteReceiver,
+			error,
+		)
+	}{
+		{
+			name:     "disabled",
+			options:  remoteWriteOptions{},
+			receiver: &fakeRemoteWriteReceiver{},
+			assertions: func(
+				t *testing.T,
+				remoteWrite *remoteWritePusher,
+				receiver *fakeRemoteWriteReceiver,
+				err error,
+			) {
+				require.NoError(t, err)
+				require.Empty(t, receiver.requests)
+				require.Equal(t, 0, remoteWrite.queue.len())
+			},
+		},
+		{
+			name: "success",
+			options: remoteWriteOptions{
+				enabled:           true,
+				headers:           map[string]string{"X-Scope-OrgID": "brigade"},
+				externalLabels:    map[string]string{"cluster": "a", "code": "x"},
+				timeout:           5 * time.Second,
+				maxSamplesPerSend: 2,
+				queueCapacity:     100,
+			},
+			receiver: &fakeRemoteWriteReceiver{},
+			assertions: func(
+				t *testing.T,
+				remoteWrite *remoteWritePusher,
+				receiver *fakeRemoteWriteReceiver,
+				err error,
+			) {
+				require.NoError(t, err)
+				// 7 samples are sent 2 at a time
+				require.Len(t, receiver.requests, 4)
+				require.Equal(
+					t,
+					4.0,
+					testutil.ToFloat64(
+						remoteWrite.pushes.With(
+							prometheus.Labels{
+								"target": "remote_write",
+								"result": "success",
+							},
+						),
+					),
+				)
+				require.Equal(t, "brigade", receiver.tenant)
+				require.Equal(t, 0, remoteWrite.queue.len())
+				require.Equal(
+					t,
+					map[string]float64{
+						`test_latency_seconds_bucket{cluster="a",code="x",le="0.1"}`:  1,
+						`test_latency_seconds_bucket{cluster="a",code="x",le="1"}`:    2,
+						`test_latency_seconds_bucket{cluster="a",code="x",le="+Inf"}`: 3,
+						`test_latency_seconds_count{cluster="a",code="x"}`:            3,
+						`test_latency_seconds_sum{cluster="a",code="x"}`:              5.55,
+						// The series' own label takes precedence over the external one
+						`test_requests_total{cluster="a",code="200"}`: 3,
+						`test_temperature{cluster="a",code="x"}`:      21.5,
+					},
+					receiver.series(),
+				)
+			},
+		},
+		{
+			name: "retryable error",
+			options: remoteWriteOptions{
+				enabled:           true,
+				timeout:           5 * time.Second,
+				maxSamplesPerSend: 100,
+				queueCapacity:     100,
+				retries:           retryPolicy{maxRetries: 2},
+			},
+			receiver: &fakeRemoteWriteReceiver{
+				statuses: []int{
+					http.StatusServiceUnavailable,
+					http.StatusTooManyRequests,
+				},
+			},
+			assertions: func(
+				t *testing.T,
+				remoteWrite *remoteWritePusher,
+				receiver *fakeRemoteWriteReceiver,
+				err error,
+			) {
+				require.NoError(t, err)
+				require.Len(t, receiver.requests, 3)
+				require.Len(t, receiver.series(), 7)
+			},
+		},
+		{
+			name: "non-retryable error",
+			options: remoteWriteOptions{
+				enabled:           true,
+				timeout:           5 * time.Second,
+				maxSamplesPerSend: 5,
+				queueCapacity:     100,
+				retries:           retryPolicy{maxRetries: 2},
+			},
+			receiver: &fakeRemoteWriteReceiver{
+				statuses: []int{http.StatusBadRequest},
+			},
+			assertions: func(
+				t *testing.T,
+				remoteWrite *remoteWritePusher,
+				receiver *fakeRemoteWriteReceiver,
+				err error,
+			) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "400 Bad Request")
+				require.Len(t, receiver.requests, 1)
+				require.Equal(
+					t,
+					1.0,
+					testutil.ToFloat64(
+						remoteWrite.pushes.With(
+							prometheus.Labels{
+								"target": "remote_write",
+								"result": "failure",
+							},
+						),
+					),
+				)
+				require.Equal(
+					t,
+					5.0,
+					testutil.ToFloat64(
+						remoteWrite.droppedSamples.With(
+							prometheus.Labels{"reason": "send_failed"},
+						),
+					),
+				)
+				// Samples that weren't in the failed batch remain queued
+				require.Equal(t, 2, remoteWrite.queue.len())
+			},
+		},
+		{
+			name: "queue full",
+			options: remoteWriteOptions{
+				enabled:           true,
+				timeout:           5 * time.Second,
+				maxSamplesPerSend: 10,
+				queueCapacity:     3,
+			},
+			receiver: &fakeRemoteWriteReceiver{},
+			assertions: func(
+				t *testing.T,
+				remoteWrite *remoteWritePusher,
+				receiver *fakeRemoteWriteReceiver,
+				err error,
+			) {
+				require.NoError(t, err)
+				require.Equal(
+					t,
+					4.0,
+					testutil.ToFloat64(
+						remoteWrite.droppedSamples.With(
+							prometheus.Labels{"reason": "queue_full"},
+						),
+					),
+				)
+				// Only the newest samples are sent
+				require.Len(t, receiver.requests, 1)
+				require.Len(t, receiver.series(), 3)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			options := testCase.options
+			options.url = testCase.receiver.start(t)
+			remoteWrite, err := newRemoteWritePusher(
+				newTestOTLPRegistry(),
+				newPushesCounter(),
+				options,
+			)
+			require.NoError(t, err)
+			remoteWrite.collect()
+			err = remoteWrite.flush(context.Background())
+			testCase.assertions(t, remoteWrite, testCase.receiver, err)
+		})
+	}
+}
+
+func TestRemoteWritePusherReconfigure(t *testing.T) {
+	receiver := &fakeRemoteWriteReceiver{}
+	remoteWrite, err := newRemoteWritePusher(
+		newTestOTLPRegistry(),
+		newPushesCounter(),
+		remoteWriteOptions{},
+	)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go remoteWrite.run(ctx)
+	// Once enabled, metrics should be pushed on the new interval
+	require.NoError(
+		t,
+		remoteWrite.reconfigure(
+			remoteWriteOptions{
+				enabled:           true,
+				url:               receiver.start(t),
+				interval:          10 * time.Millisecond,
+				timeout:           5 * time.Second,
+				maxSamplesPerSend: 100,
+				queueCapacity:     100,
+			},
+		),
+	)
+	require.Eventually(
+		t,
+		func() bool {
+			receiver.mu.Lock()
+			defer receiver.mu.Unlock()
+			return len(receiver.requests) > 0
+		},
+		5*time.Second,
+		10*time.Millisecond,
+	)
+	// Once disabled, anything still queued is dropped
+	remoteWrite.queue.add([]remoteWriteSample{{}})
+	require.NoError(t, remoteWrite.reconfigure(remoteWriteOptions{}))
+	require.Equal(t, 0, remoteWrite.queue.len())
+}
+
+// fakeRemoteWriteReceiver is an in-process remote write endpoint that records
+// the samples it receives.
+type fakeRemoteWriteReceiver struct {
+	mu sync.Mutex
+	// requests holds the samples received in each request, including requests
+	// that failed.
+	requests [][]remoteWriteSample
+	// accepted holds the samples received in requests that succeeded.
+	accepted []remoteWriteSample
+	// tenant is the value of the X-Scope-OrgID header of the most recent
+	// request.
+	tenant string
+	// statuses, if non-empty, are responded with, in order, before any request
+	// succeeds.
+	statuses []int
+}
+
+// start serves remote write requests until the test completes and returns
+// the URL they're posted to.
+func (f *fakeRemoteWriteReceiver) start(t *testing.T) string {
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return server.URL + "/api/v1/push"
+}
+
+func (f *fakeRemoteWriteReceiver) ServeHTTP(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	if r.URL.Path != "/api/v1/push" ||
+		r.Header.Get("Content-Encoding") != "snappy" ||
+		r.Header.Get("Content-Type") != "application/x-protobuf" ||
+		r.Header.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if body, err = snappy.Decode(nil, body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	samples, err := decodeRemoteWriteRequest(body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, samples)
+	f.tenant = r.Header.Get("X-Scope-OrgID")
+	if len(f.statuses) > 0 {
+		w.WriteHeader(f.statuses[0])
+		f.statuses = f.statuses[1:]
+		return
+	}
+	f.accepted = append(f.accepted, samples...)
+}
+
+// series returns the value of every series that was accepted, keyed by the
+// series' name and labels, e.g. `foo{bar="bat"}`.
+func (f *fakeRemoteWriteReceiver) series() map[string]float64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	series := map[string]float64{}
+	for _, sample := range f.accepted {
+		var name string
+		labels := []string{}
+		for _, label := range sample.labels {
+			if label.name == "__name__" {
+				name = label.value
+				continue
+			}
+			labels = append(labels, fmt.Sprintf("%s=%q", label.name, label.value))
+		}
+		// Round away floating point error in sums
+		series[fmt.Sprintf("%s{%s}", name, strings.Join(labels, ","))] =
+			math.Round(sample.value*100) / 100
+	}
+	return series
+}
+
+// decodeRemoteWriteRequest decodes the provided uncompressed WriteRequest
+// protobuf message.
+func decodeRemoteWriteRequest(body []byte) ([]remoteWriteSample, error) {
+	var samples []remoteWriteSample
+	err := consumeMessage(body, func(num protowire.Number, series []byte) error {
+		if num != 1 {
+			return nil
+		}
+		samples = append(samples, remoteWriteSample{})
+		return consumeMessage(series, func(
+			num protowire.Number,
+			field []byte,
+		) error {
+			s := &samples[len(samples)-1]
+			switch num {
+			case 1:
+				s.labels = append(s.labels, remoteWriteLabel{})
+				return consumeMessage(field, func(
+					num protowire.Number,
+					value []byte,
+				) error {
+					l := &s.labels[len(s.labels)-1]
+					if num == 1 {
+						l.name = string(value)
+					} else {
+						l.value = string(value)
+					}
+					return nil
+				})
+			case 2:
+				for len(field) > 0 {
+					num, typ, n := protowire.ConsumeTag(field)
+					if n < 0 {
+						return protowire.ParseError(n)
+					}
+					field = field[n:]
+					switch {
+					case num == 1 && typ == protowire.Fixed64Type:
+						var v uint64
+						v, n = protowire.ConsumeFixed64(field)
+						s.value = math.Float64frombits(v)
+					case num == 2 && typ == protowire.VarintType:
+						var v uint64
+						v, n = protowire.ConsumeVarint(field)
+						s.timestampMs = int64(v)
+					default:
+						n = protowire.ConsumeFieldValue(num, typ, field)
+					}
+					if n < 0 {
+						return protowire.ParseError(n)
+					}
+					field = field[n:]
+				}
+			}
+			return nil
+		})
+	})
+	return samples, err
+}
+
+// consumeMessage invokes the provided function with the number and contents
+// of every length-delimited field of the provided protobuf message.
+func consumeMessage(
+	msg []byte,
+	fn func(num protowire.Number, value []byte) error,
+) error {
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		msg = msg[n:]
+		if typ != protowire.BytesType {
+			if n = protowire.ConsumeFieldValue(num, typ, msg); n < 0 {
+				return protowire.ParseError(n)
+			}
+			msg = msg[n:]
+			continue
+		}
+		value, n := protowire.ConsumeBytes(msg)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		msg = msg[n:]
+		if err := fn(num, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+
+	"github.com/brigadecore/brigade/sdk/v2"
+	"github.com/brigadecore/brigade/sdk/v2/authz"
+	"github.com/brigadecore/brigade/sdk/v2/core"
+	libAuthz "github.com/brigadecore/brigade/sdk/v2/lib/authz"
+	"github.com/brigadecore/brigade/sdk/v2/meta"
+	"github.com/brigadecore/brigade/sdk/v2/system"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// projectRolesAll returns every project-level role.
+func projectRolesAll() []libAuthz.Role {
+	return []libAuthz.Role{
+		core.RoleProjectAdmin,
+		core.RoleProjectDeveloper,
+		core.RoleProjectUser,
+	}
+}
+
+// systemRolesAll returns every system-level role.
+func systemRolesAll() []libAuthz.Role {
+	return []libAuthz.Role{
+		system.RoleAdmin,
+		system.RoleEventCreator,
+		system.RoleProjectCreator,
+		system.RoleReader,
+	}
+}
+
+// roleAssignmentsCollector produces brigade_project_role_assignments and
+// brigade_system_role_assignments. Every known role is reported, even when it
+// is assigned to no one, so that an increase from zero can be alerted on.
+type roleAssignmentsCollector struct {
+	api                        *apiCaller
+	projectRoleAssignmentsDesc *prometheus.Desc
+	systemRoleAssignmentsDesc  *prometheus.Desc
+}
+
+func newRoleAssignmentsCollector(api *apiCaller) collector {
+	return &roleAssignmentsCollector{
+		api: api,
+		projectRoleAssignmentsDesc: prometheus.NewDesc(
+			"brigade_project_role_assignments",
+			"Project role assignments separated by project and role",
+			[]string{"project", "role"},
+			nil,
+		),
+		systemRoleAssignmentsDesc: prometheus.NewDesc(
+			"brigade_system_role_assignments",
+			"System role assignments separated by role",
+			[]string{"role"},
+			nil,
+		),
+	}
+}
+
+func (r *roleAssignmentsCollector) describe(ch chan<- *prometheus.Desc) {
+	ch <- r.projectRoleAssignmentsDesc
+	ch <- r.systemRoleAssignmentsDesc
+}
+
+func (r *roleAssignmentsCollector) collect(
+	ctx context.Context,
+) ([]prometheus.Metric, error) {
+	projectIDs, err := listProjectIDs(ctx, r.api)
+	if err != nil {
+		return nil, err
+	}
+	metrics := []prometheus.Metric{}
+	for _, projectID := range projectIDs {
+		var counts map[libAuthz.Role]int
+		if counts, err = r.countProjectRoleAssignments(ctx, projectID); err != nil {
+			return nil, err
+		}
+		metrics = append(
+			metrics,
+			roleAssignmentMetrics(
+				r.projectRoleAssignmentsDesc,
+				projectRolesAll(),
+				counts,
+				projectID,
+			)...,
+		)
+	}
+	counts, err := r.countSystemRoleAssignments(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return append(
+		metrics,
+		roleAssignmentMetrics(
+			r.systemRoleAssignmentsDesc,
+			systemRolesAll(),
+			counts,
+		)...,
+	), nil
+}
+
+// countProjectRoleAssignments returns the number of assignments of each role
+// in the specified project, following the continue token of each page until
+// the list is exhausted.
+func (r *roleAssignmentsCollector) countProjectRoleAssignments(
+	ctx context.Context,
+	projectID string,
+) (map[libAuthz.Role]int, error) {
+	counts := map[libAuthz.Role]int{}
+	opts := &meta.ListOptions{}
+	for {
+		var assignments core.ProjectRoleAssignmentList
+		if err := r.api.call(
+			ctx,
+			"project_role_assignments.list",
+			func(ctx context.Context, client sdk.APIClient) (err error) {
+				assignments, err =
+					client.Core().Projects().Authz().RoleAssignments().List(
+						ctx,
+						projectID,
+						&core.ProjectRoleAssignmentsSelector{},
+						opts,
+					)
+				return err
+			},
+		); err != nil {
+			return nil, err
+		}
+		for _, assignment := range assignments.Items {
+			counts[assignment.Role]++
+		}
+		if assignments.Continue == "" {
+			return counts, nil
+		}
+		opts = &meta.ListOptions{Continue: assignments.Continue}
+	}
+}
+
+// countSystemRoleAssignments returns the number of assignments of each
+// system-level role, following the continue token of each page until the list
+// is exhausted.
+func (r *roleAssignmentsCollector) countSystemRoleAssignments(
+	ctx context.Context,
+) (map[libAuthz.Role]int, error) {
+	counts := map[libAuthz.Role]int{}
+	opts := &meta.ListOptions{}
+	for {
+		var assignments authz.RoleAssignmentList
+		if err := r.api.call(
+			ctx,
+			"role_assignments.list",
+			func(ctx context.Context, client sdk.APIClient) (err error) {
+				assignments, err = client.Authz().RoleAssignments().List(
+					ctx,
+					&authz.RoleAssignmentsSelector{},
+					opts,
+				)
+				return err
+			},
+		); err != nil {
+			return nil, err
+		}
+		for _, assignment := range assignments.Items {
+			counts[assignment.Role]++
+		}
+		if assignments.Continue == "" {
+			return counts, nil
+		}
+		opts = &meta.ListOptions{Continue: assignments.Continue}
+	}
+}
+
+// roleAssignmentMetrics returns a metric with the provided descriptor for each
+// of the known roles, and for any other role that has been counted. The
+// provided label values precede the role.
+func roleAssignmentMetrics(
+	desc *prometheus.Desc,
+	knownRoles []libAuthz.Role,
+	counts map[libAuthz.Role]int,
+	labelValues ...string,
+) []prometheus.Metric {
+	roles := append([]libAuthz.Role{}, knownRoles...)
+	for role := range counts {
+		if !containsRole(knownRoles, role) {
+			roles = append(roles, role)
+		}
+	}
+	metrics := make([]prometheus.Metric, 0, len(roles))
+	for _, role := range roles {
+		metrics = append(
+			metrics,
+			prometheus.MustNewConstMetric(
+				desc,
+				prometheus.GaugeValue,
+				float64(counts[role]),
+				append(append([]string{}, labelValues...), string(role))...,
+			),
+		)
+	}
+	return metrics
+}
+
+// containsRole returns whether the provided roles include the specified one.
+func containsRole(roles []libAuthz.Role, role libAuthz.Role) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
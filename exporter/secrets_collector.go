@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+
+	"github.com/brigadecore/brigade/sdk/v2"
+	"github.com/brigadecore/brigade/sdk/v2/core"
+	"github.com/brigadecore/brigade/sdk/v2/meta"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// secretsCollector produces brigade_project_secrets. Only the number of
+// secrets is exported. Their keys and values are never retained.
+type secretsCollector struct {
+	api                *apiCaller
+	projectSecretsDesc *prometheus.Desc
+}
+
+func newSecretsCollector(api *apiCaller) collector {
+	return &secretsCollector{
+		api: api,
+		projectSecretsDesc: prometheus.NewDesc(
+			"brigade_project_secrets",
+			"Secrets separated by project",
+			[]string{"project"},
+			nil,
+		),
+	}
+}
+
+func (s *secretsCollector) describe(ch chan<- *prometheus.Desc) {
+	ch <- s.projectSecretsDesc
+}
+
+func (s *secretsCollector) collect(
+	ctx context.Context,
+) ([]prometheus.Metric, error) {
+	projectIDs, err := listProjectIDs(ctx, s.api)
+	if err != nil {
+		return nil, err
+	}
+	metrics := []prometheus.Metric{}
+	for _, projectID := range projectIDs {
+		var secrets core.SecretList
+		if err = s.api.call(
+			ctx,
+			"secrets.list",
+			func(ctx context.Context, client sdk.APIClient) (err error) {
+				secrets, err = client.Core().Projects().Secrets().List(
+					ctx,
+					projectID,
+					&meta.ListOptions{},
+				)
+				return err
+			},
+		); err != nil {
+			return nil, err
+		}
+		metrics = append(
+			metrics,
+			prometheus.MustNewConstMetric(
+				s.projectSecretsDesc,
+				prometheus.GaugeValue,
+				float64(len(secrets.Items)+int(secrets.RemainingItemCount)),
+				projectID,
+			),
+		)
+	}
+	return metrics, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/brigadecore/brigade/sdk/v2"
+	"github.com/brigadecore/brigade/sdk/v2/authn"
+	"github.com/brigadecore/brigade/sdk/v2/meta"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// serviceAccountsCollector produces brigade_service_accounts_total,
+// brigade_service_account_age_seconds, brigade_stale_service_accounts, and, if
+// enabled, brigade_service_account_info. Determining these requires every
+// service account, so all pages are retrieved.
+type serviceAccountsCollector struct {
+	api     *apiCaller
+	descs   accountDescs
+	options collectorOptions
+}
+
+func newServiceAccountsCollector(api *apiCaller) collector {
+	return &serviceAccountsCollector{
+		api: api,
+		descs: newAccountDescs(
+			"service_account",
+			"service_accounts",
+			"service accounts",
+			"service_account",
+			"description",
+		),
+	}
+}
+
+func (s *serviceAccountsCollector) describe(ch chan<- *prometheus.Desc) {
+	s.descs.describe(ch)
+}
+
+func (s *serviceAccountsCollector) configure(options collectorOptions) {
+	s.options = options
+}
+
+func (s *serviceAccountsCollector) collect(
+	ctx context.Context,
+) ([]prometheus.Metric, error) {
+	accounts := []account{}
+	opts := &meta.ListOptions{}
+	for {
+		var serviceAccounts authn.ServiceAccountList
+		if err := s.api.call(
+			ctx,
+			"service_accounts.list",
+			func(ctx context.Context, client sdk.APIClient) (err error) {
+				serviceAccounts, err = client.Authn().ServiceAccounts().List(
+					ctx,
+					&authn.ServiceAccountsSelector{},
+					opts,
+				)
+				return err
+			},
+		); err != nil {
+			return nil, err
+		}
+		for _, serviceAccount := range serviceAccounts.Items {
+			acct := account{
+				id:          serviceAccount.ID,
+				description: serviceAccount.Description,
+				locked:      serviceAccount.Locked != nil,
+			}
+			if serviceAccount.Created != nil {
+				acct.created = *serviceAccount.Created
+			}
+			accounts = append(accounts, acct)
+		}
+		if serviceAccounts.Continue == "" {
+			break
+		}
+		opts = &meta.ListOptions{Continue: serviceAccounts.Continue}
+	}
+	return s.descs.metrics(accounts, time.Now(), s.options), nil
+}
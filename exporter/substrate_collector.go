@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+
+	"github.com/brigadecore/brigade/sdk/v2"
+	"github.com/brigadecore/brigade/sdk/v2/core"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// substrateCollector produces brigade_substrate_running_workers,
+// brigade_substrate_running_jobs, and
+// brigade_substrate_running_workers_mismatch.
+//
+// Unlike the other collectors, which count event records, the substrate counts
+// reflect what is actually executing on the substrate (i.e. pods). The
+// mismatch is the number of workers executing on the substrate less the number
+// of workers whose events say they're running. A persistently positive
+// mismatch usually indicates orphaned worker pods, while a persistently
+// negative one indicates workers recorded as running that no longer are.
+type substrateCollector struct {
+	api                        *apiCaller
+	runningWorkersDesc         *prometheus.Desc
+	runningJobsDesc            *prometheus.Desc
+	runningWorkersMismatchDesc *prometheus.Desc
+}
+
+func newSubstrateCollector(api *apiCaller) collector {
+	return &substrateCollector{
+		api: api,
+		runningWorkersDesc: prometheus.NewDesc(
+			"brigade_substrate_running_workers",
+			"Workers executing on the substrate",
+			nil,
+			nil,
+		),
+		runningJobsDesc: prometheus.NewDesc(
+			"brigade_substrate_running_jobs",
+			"Jobs executing on the substrate",
+			nil,
+			nil,
+		),
+		runningWorkersMismatchDesc: prometheus.NewDesc(
+			"brigade_substrate_running_workers_mismatch",
+			"Workers executing on the substrate less workers in the RUNNING "+
+				"phase",
+			nil,
+			nil,
+		),
+	}
+}
+
+func (s *substrateCollector) describe(ch chan<- *prometheus.Desc) {
+	ch <- s.runningWorkersDesc
+	ch <- s.runningJobsDesc
+	ch <- s.runningWorkersMismatchDesc
+}
+
+func (s *substrateCollector) collect(
+	ctx context.Context,
+) ([]prometheus.Metric, error) {
+	var workerCount core.SubstrateWorkerCount
+	if err := s.api.call(
+		ctx,
+		"substrate.count_running_workers",
+		func(ctx context.Context, client sdk.APIClient) (err error) {
+			workerCount, err = client.Core().Substrate().CountRunningWorkers(ctx)
+			return err
+		},
+	); err != nil {
+		return nil, err
+	}
+	var jobCount core.SubstrateJobCount
+	if err := s.api.call(
+		ctx,
+		"substrate.count_running_jobs",
+		func(ctx context.Context, client sdk.APIClient) (err error) {
+			jobCount, err = client.Core().Substrate().CountRunningJobs(ctx)
+			return err
+		},
+	); err != nil {
+		return nil, err
+	}
+	runningWorkers, err := countWorkers(ctx, s.api, core.WorkerPhaseRunning)
+	if err != nil {
+		return nil, err
+	}
+	return []prometheus.Metric{
+		prometheus.MustNewConstMetric(
+			s.runningWorkersDesc,
+			prometheus.GaugeValue,
+			float64(workerCount.Count),
+		),
+		prometheus.MustNewConstMetric(
+			s.runningJobsDesc,
+			prometheus.GaugeValue,
+			float64(jobCount.Count),
+		),
+		prometheus.MustNewConstMetric(
+			s.runningWorkersMismatchDesc,
+			prometheus.GaugeValue,
+			float64(workerCount.Count-runningWorkers),
+		),
+	}, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/brigadecore/brigade/sdk/v2"
+	"github.com/brigadecore/brigade/sdk/v2/authn"
+	"github.com/brigadecore/brigade/sdk/v2/meta"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// usersCollector produces brigade_users_total, brigade_user_age_seconds,
+// brigade_stale_users, and, if enabled, brigade_user_info. Determining these
+// requires every user, so all pages are retrieved.
+type usersCollector struct {
+	api     *apiCaller
+	descs   accountDescs
+	options collectorOptions
+}
+
+func newUsersCollector(api *apiCaller) collector {
+	return &usersCollector{
+		api:   api,
+		descs: newAccountDescs("user", "users", "users", "user", "name"),
+	}
+}
+
+func (u *usersCollector) describe(ch chan<- *prometheus.Desc) {
+	u.descs.describe(ch)
+}
+
+func (u *usersCollector) configure(options collectorOptions) {
+	u.options = options
+}
+
+func (u *usersCollector) collect(
+	ctx context.Context,
+) ([]prometheus.Metric, error) {
+	accounts := []account{}
+	opts := &meta.ListOptions{}
+	for {
+		var users authn.UserList
+		if err := u.api.call(
+			ctx,
+			"users.list",
+			func(ctx context.Context, client sdk.APIClient) (err error) {
+				users, err = client.Authn().Users().List(
+					ctx,
+					&authn.UsersSelector{},
+					opts,
+				)
+				return err
+			},
+		); err != nil {
+			return nil, err
+		}
+		for _, user := range users.Items {
+			acct := account{
+				id:          user.ID,
+				description: user.Name,
+				locked:      user.Locked != nil,
+			}
+			if user.Created != nil {
+				acct.created = *user.Created
+			}
+			accounts = append(accounts, acct)
+		}
+		if users.Continue == "" {
+			break
+		}
+		opts = &meta.ListOptions{Continue: users.Continue}
+	}
+	return u.descs.metrics(accounts, time.Now(), u.options), nil
+}
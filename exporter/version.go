@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/willie-yao/brigade-metrics/exporter/internal/version"
+)
+
+// versionInfo is the body of responses from the /version endpoint.
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	GoVersion string `json:"goVersion"`
+	// APIServerVersion is omitted if the Brigade API server's version could not
+	// be discovered.
+	APIServerVersion string `json:"apiServerVersion,omitempty"`
+}
+
+// newBuildInfoGauge returns brigade_exporter_build_info, a gauge that is
+// always 1 and carries the exporter's version, commit, and Go version as
+// labels.
+func newBuildInfoGauge() prometheus.Gauge {
+	gauge := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "brigade_exporter_build_info",
+			Help: "Information about the exporter's build, always 1",
+			ConstLabels: prometheus.Labels{
+				"version":   version.Version(),
+				"commit":    version.Commit(),
+				"goversion": runtime.Version(),
+			},
+		},
+	)
+	gauge.Set(1)
+	return gauge
+}
+
+// versionHandler returns an http.HandlerFunc that responds with the
+// exporter's version information as JSON, including the version of the
+// Brigade API server if it can be discovered.
+func versionHandler(api *apiCaller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		info := versionInfo{
+			Version:   version.Version(),
+			Commit:    version.Commit(),
+			GoVersion: runtime.Version(),
+		}
+		apiServerVersion, err := apiServerVersion(r.Context(), api)
+		if err != nil {
+			log.Println(
+				errors.Wrap(err, "error discovering Brigade API server version"),
+			)
+		} else {
+			info.APIServerVersion = apiServerVersion
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err = json.NewEncoder(w).Encode(info); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/willie-yao/brigade-metrics/exporter/internal/version"
+)
+
+func TestNewBuildInfoGauge(t *testing.T) {
+	gauge := newBuildInfoGauge()
+	require.Equal(t, 1.0, testutil.ToFloat64(gauge))
+	require.Contains(t, gauge.Desc().String(), runtime.Version())
+}
+
+func TestVersionHandler(t *testing.T) {
+	testCases := []struct {
+		name       string
+		brigade    *fakeBrigade
+		assertions func(versionInfo)
+	}{
+		{
+			name:    "API server version discovered",
+			brigade: &fakeBrigade{apiServerVersion: "v2.0.0"},
+			assertions: func(info versionInfo) {
+				require.Equal(t, "v2.0.0", info.APIServerVersion)
+			},
+		},
+		{
+			name:    "API server unreachable",
+			brigade: &fakeBrigade{err: errors.New("connection refused")},
+			assertions: func(info versionInfo) {
+				require.Empty(t, info.APIServerVersion)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			handler := versionHandler(
+				newAPICaller(
+					testCase.brigade.apiClient(),
+					time.Second,
+					1,
+					retryPolicy{},
+					circuitBreakerPolicy{},
+				),
+			)
+			rr := httptest.NewRecorder()
+			handler(rr, httptest.NewRequest(http.MethodGet, "/version", nil))
+			require.Equal(t, http.StatusOK, rr.Code)
+			require.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+			info := versionInfo{}
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &info))
+			require.Equal(t, version.Version(), info.Version)
+			require.Equal(t, version.Commit(), info.Commit)
+			require.Equal(t, runtime.Version(), info.GoVersion)
+			testCase.assertions(info)
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+
+	"github.com/brigadecore/brigade/sdk/v2"
+	"github.com/brigadecore/brigade/sdk/v2/core"
+	"github.com/brigadecore/brigade/sdk/v2/meta"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// workersCollector produces brigade_all_workers_by_phase.
+type workersCollector struct {
+	api                   *apiCaller
+	allWorkersByPhaseDesc *prometheus.Desc
+}
+
+func newWorkersCollector(api *apiCaller) collector {
+	return &workersCollector{
+		api: api,
+		allWorkersByPhaseDesc: prometheus.NewDesc(
+			"brigade_all_workers_by_phase",
+			"All workers separated by phase",
+			[]string{"workerPhase"},
+			nil,
+		),
+	}
+}
+
+func (w *workersCollector) describe(ch chan<- *prometheus.Desc) {
+	ch <- w.allWorkersByPhaseDesc
+}
+
+func (w *workersCollector) collect(
+	ctx context.Context,
+) ([]prometheus.Metric, error) {
+	metrics := []prometheus.Metric{}
+	for _, phase := range core.WorkerPhasesAll() {
+		count, err := countWorkers(ctx, w.api, phase)
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(
+			metrics,
+			prometheus.MustNewConstMetric(
+				w.allWorkersByPhaseDesc,
+				prometheus.GaugeValue,
+				float64(count),
+				string(phase),
+			),
+		)
+	}
+	return metrics, nil
+}
+
+// countWorkers returns the number of workers in the specified phase. Only the
+// first page of events is retrieved, since the count of those remaining is
+// included.
+func countWorkers(
+	ctx context.Context,
+	api *apiCaller,
+	phase core.WorkerPhase,
+) (int, error) {
+	var events core.EventList
+	err := api.call(
+		ctx,
+		"events.list",
+		func(ctx context.Context, client sdk.APIClient) (err error) {
+			events, err = client.Core().Events().List(
+				ctx,
+				&core.EventsSelector{
+					WorkerPhases: []core.WorkerPhase{phase},
+				},
+				&meta.ListOptions{},
+			)
+			return err
+		},
+	)
+	return len(events.Items) + int(events.RemainingItemCount), err
+}